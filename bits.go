@@ -0,0 +1,157 @@
+package structtools
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// bitField is a field packed in a bitGroup
+type bitField struct {
+	index int
+	name  string
+	// name in self-describing streams
+	wire string
+	typ  reflect.Type
+	bits uint
+}
+
+// bitGroup packs consecutive fields tagged with "bits" into as few
+// bytes as possible. The last byte is padded with zeros. Fields are
+// packed starting from the most significant bit of the first byte,
+// or from the least significant bit with the "lsb" option.
+type bitGroup struct {
+	fields []bitField
+	lsb    bool
+	size   int
+}
+
+// groupBits replaces each run of bit-fields with the same bit
+// order in fields with a single field that encodes the whole group
+func groupBits(t reflect.Type, fields []field) []field {
+	var (
+		out   []field
+		group *bitGroup
+	)
+	for _, f := range fields {
+		if f.tag.bits == 0 {
+			group = nil
+			out = append(out, f)
+			continue
+		}
+		// a different bit order starts a new group
+		if group == nil || group.lsb != f.tag.lsb {
+			group = &bitGroup{lsb: f.tag.lsb}
+			out = append(out, field{
+				index: f.index,
+				name:  f.name,
+				typ:   t,
+				tag:   f.tag,
+				codec: &codec{enc: group.encode, dec: group.decode, size: group.sizeOf},
+				bits:  group,
+			})
+		}
+		group.fields = append(group.fields, bitField{index: f.index, name: f.name, wire: f.tag.wireName(f.name), typ: f.typ, bits: uint(f.tag.bits)})
+		nBits := 0
+		for _, bf := range group.fields {
+			nBits += int(bf.bits)
+		}
+		group.size = (nBits + 7) / 8
+		out[len(out)-1].codec.fixed = group.size
+	}
+	return out
+}
+
+func (g *bitGroup) encode(e *Encoder, v reflect.Value) error {
+	off := e.offset()
+	b := e.grow(g.size)
+	for i := range b {
+		b[i] = 0
+	}
+	pos := uint(0)
+	for _, f := range g.fields {
+		n, err := f.uint64(v.Field(f.index))
+		if err != nil {
+			return &FieldError{Type: f.typ, Path: "." + f.name, Offset: off, Err: err}
+		}
+		g.put(b, pos, f.bits, n)
+		pos += f.bits
+	}
+	return e.written()
+}
+
+func (g *bitGroup) sizeOf(reflect.Value) (int, error) { return g.size, nil }
+
+func (g *bitGroup) decode(d *Decoder, v reflect.Value) error {
+	b, err := d.read(g.size)
+	if err != nil {
+		return err
+	}
+	pos := uint(0)
+	for _, f := range g.fields {
+		f.set(v.Field(f.index), g.get(b, pos, f.bits))
+		pos += f.bits
+	}
+	return nil
+}
+
+func (g *bitGroup) put(b []byte, pos, bits uint, n uint64) {
+	for i := uint(0); i < bits; i++ {
+		p := pos + i
+		if g.lsb {
+			b[p/8] |= byte(n>>i&1) << (p % 8)
+		} else {
+			b[p/8] |= byte(n>>(bits-1-i)&1) << (7 - p%8)
+		}
+	}
+}
+
+func (g *bitGroup) get(b []byte, pos, bits uint) uint64 {
+	var n uint64
+	for i := uint(0); i < bits; i++ {
+		p := pos + i
+		if g.lsb {
+			n |= uint64(b[p/8]>>(p%8)&1) << i
+		} else {
+			n |= uint64(b[p/8]>>(7-p%8)&1) << (bits - 1 - i)
+		}
+	}
+	return n
+}
+
+// uint64 returns the bits of v, checking that it fits in f.bits
+func (f bitField) uint64(v reflect.Value) (uint64, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if f.bits < 64 {
+			if min, max := -int64(1)<<(f.bits-1), int64(1)<<(f.bits-1)-1; n < min || n > max {
+				return 0, fmt.Errorf("%d doesn't fit in %d bits", n, f.bits)
+			}
+			return uint64(n) & (1<<f.bits - 1), nil
+		}
+		return uint64(n), nil
+	}
+	n := v.Uint()
+	if f.bits < 64 && n>>f.bits != 0 {
+		return 0, fmt.Errorf("%d doesn't fit in %d bits", n, f.bits)
+	}
+	return n, nil
+}
+
+// set sets v to the bits in n, extending the sign of signed integers
+func (f bitField) set(v reflect.Value, n uint64) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		shift := 64 - f.bits
+		v.SetInt(int64(n<<shift) >> shift)
+	default:
+		v.SetUint(n)
+	}
+}
@@ -0,0 +1,53 @@
+package structtools
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestBitFields(t *testing.T) {
+	type header struct {
+		Version uint8  `bin:",bits=3"`
+		Flag    bool   `bin:",bits=1"`
+		Length  uint16 `bin:",bits=12"`
+		Delta   int8   `bin:",bits=4,lsb"`
+		Kind    uint8  `bin:",bits=2,lsb"`
+		Tail    uint8
+	}
+	v := header{Version: 5, Flag: true, Length: 0x123, Delta: -2, Kind: 3, Tail: 9}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// 101 1 0001 0010 0011, then 0b00_11_1110 and the tail
+	if xs := hex.EncodeToString(b); xs != "b123"+"3e"+"09" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out header
+	if _, err := Unmarshal(b, &out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out != v {
+		t.Error("got different values", out, v)
+		return
+	}
+
+	for _, bad := range []header{{Version: 8}, {Delta: 8}, {Delta: -9}} {
+		_, err := Marshal(bad)
+		if fe, ok := err.(*FieldError); !ok || (fe.Path != "header.Version" && fe.Path != "header.Delta") {
+			t.Error("expecting a *FieldError, got:", err)
+			return
+		}
+	}
+
+	type invalid struct {
+		A bool `bin:",bits=2"`
+	}
+	if _, err := Marshal(invalid{}); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
@@ -0,0 +1,360 @@
+package structtools
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"time"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigRatType   = reflect.TypeOf(big.Rat{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+)
+
+// isBuiltin reports if values of type t have a builtin codec,
+// instead of being written as the structs they are.
+//
+// time.Time is written as set by TimeFormat, TimeBinary is left to
+// its BinaryMarshaler. big.Int is a sign byte, 1 for negative numbers
+// and 0 otherwise, followed by the absolute value as a length prefixed
+// big-endian byte slice. big.Rat is the numerator as a big.Int followed
+// by the denominator as a length prefixed byte slice. big.Float is the
+// output of its GobEncode method with a length prefix, which keeps its
+// precision, rounding mode and accuracy
+func isBuiltin(t reflect.Type, o codecOptions) bool {
+	switch t {
+	case timeType:
+		return o.timeFormat != TimeBinary
+	case bigIntType, bigRatType, bigFloatType:
+		return true
+	}
+	return false
+}
+
+// builtinCodec returns the plan for t if isBuiltin, or nil
+func builtinCodec(t reflect.Type, o codecOptions) *codec {
+	if !isBuiltin(t, o) {
+		return nil
+	}
+	switch t {
+	case timeType:
+		if o.timeFormat == TimeUnixNano {
+			return unixNanoCodec(o)
+		}
+		return unixZoneCodec(o)
+	case bigIntType:
+		return &codec{enc: bigIntEncoder(o), dec: bigIntDecoder(o), size: bigIntSizer(o), fixed: -1}
+	case bigRatType:
+		return &codec{enc: bigRatEncoder(o), dec: bigRatDecoder(o), size: bigRatSizer(o), fixed: -1}
+	}
+	return &codec{enc: bigFloatEncoder(o), dec: bigFloatDecoder(o), size: bigFloatSizer(o), fixed: -1}
+}
+
+// the times that fit in an int64 of nanoseconds
+var (
+	minUnixNano = time.Unix(0, math.MinInt64)
+	maxUnixNano = time.Unix(0, math.MaxInt64)
+)
+
+func unixNanoCodec(o codecOptions) *codec {
+	c := &codec{
+		enc: func(e *Encoder, v reflect.Value) error {
+			t := marshaler(v, true).(*time.Time)
+			if t.Before(minUnixNano) || t.After(maxUnixNano) {
+				return fmt.Errorf("%s doesn't fit in int64 nanoseconds", t)
+			}
+			return e.putInt(o, t.UnixNano(), 8)
+		},
+		dec: func(d *Decoder, v reflect.Value) error {
+			n, err := d.getInt(o, 8)
+			if err != nil {
+				return err
+			}
+			*v.Addr().Interface().(*time.Time) = time.Unix(0, n).UTC()
+			return nil
+		},
+		size:  func(reflect.Value) (int, error) { return 8, nil },
+		fixed: 8,
+	}
+	if o.varint {
+		c.fixed = -1
+		c.size = func(v reflect.Value) (int, error) {
+			return varintSize(marshaler(v, true).(*time.Time).UnixNano()), nil
+		}
+	}
+	return c
+}
+
+func unixZoneCodec(o codecOptions) *codec {
+	c := &codec{
+		enc: func(e *Encoder, v reflect.Value) error {
+			t := marshaler(v, true).(*time.Time)
+			_, off := t.Zone()
+			if err := e.putInt(o, t.Unix(), 8); err != nil {
+				return err
+			}
+			if err := e.putUint(o, uint64(t.Nanosecond()), 4); err != nil {
+				return err
+			}
+			return e.putInt(o, int64(off), 4)
+		},
+		dec: func(d *Decoder, v reflect.Value) error {
+			sec, err := d.getInt(o, 8)
+			if err != nil {
+				return err
+			}
+			nsec, err := d.getUint(o, 4)
+			if err != nil {
+				return err
+			}
+			if nsec >= 1e9 {
+				return fmt.Errorf("invalid nanoseconds %d", nsec)
+			}
+			off, err := d.getInt(o, 4)
+			if err != nil {
+				return err
+			}
+			loc := time.UTC
+			if off != 0 {
+				loc = time.FixedZone("", int(off))
+			}
+			*v.Addr().Interface().(*time.Time) = time.Unix(sec, int64(nsec)).In(loc)
+			return nil
+		},
+		size:  func(reflect.Value) (int, error) { return 16, nil },
+		fixed: 16,
+	}
+	if o.varint {
+		c.fixed = -1
+		c.size = func(v reflect.Value) (int, error) {
+			t := marshaler(v, true).(*time.Time)
+			_, off := t.Zone()
+			return varintSize(t.Unix()) + uvarintSize(uint64(t.Nanosecond())) + varintSize(int64(off)), nil
+		}
+	}
+	return c
+}
+
+// putInt writes n like basicEncoder writes a signed integer
+// of size bytes, 4 or 8
+func (e *Encoder) putInt(o codecOptions, n int64, size int) error {
+	switch {
+	case o.varint:
+		return e.putVarint(n)
+	case size == 4:
+		return e.putUint32(o.byteOrder, uint32(n))
+	}
+	return e.putUint64(o.byteOrder, uint64(n))
+}
+
+// putUint writes n like basicEncoder writes an unsigned
+// integer of size bytes, 4 or 8
+func (e *Encoder) putUint(o codecOptions, n uint64, size int) error {
+	switch {
+	case o.varint:
+		return e.putUvarint(n)
+	case size == 4:
+		return e.putUint32(o.byteOrder, uint32(n))
+	}
+	return e.putUint64(o.byteOrder, n)
+}
+
+// getInt reads an integer written by putInt
+func (d *Decoder) getInt(o codecOptions, size int) (int64, error) {
+	switch {
+	case o.varint:
+		n, err := d.varint()
+		if err == nil && size == 4 && int64(int32(n)) != n {
+			return 0, fmt.Errorf("%d overflows int32", n)
+		}
+		return n, err
+	case size == 4:
+		n, err := d.uint32(o.byteOrder)
+		return int64(int32(n)), err
+	}
+	n, err := d.uint64(o.byteOrder)
+	return int64(n), err
+}
+
+// getUint reads an integer written by putUint
+func (d *Decoder) getUint(o codecOptions, size int) (uint64, error) {
+	switch {
+	case o.varint:
+		n, err := d.uvarint()
+		if err == nil && size == 4 && n > math.MaxUint32 {
+			return 0, fmt.Errorf("%d overflows uint32", n)
+		}
+		return n, err
+	case size == 4:
+		n, err := d.uint32(o.byteOrder)
+		return uint64(n), err
+	}
+	return d.uint64(o.byteOrder)
+}
+
+// putBigInt writes the sign of x and its absolute value
+func (e *Encoder) putBigInt(o codecOptions, x *big.Int) error {
+	var sign byte
+	if x.Sign() < 0 {
+		sign = 1
+	}
+	if err := e.writeByte(sign); err != nil {
+		return err
+	}
+	return e.putBigAbs(o, x)
+}
+
+// putBigAbs writes the absolute value of x
+func (e *Encoder) putBigAbs(o codecOptions, x *big.Int) error {
+	n := (x.BitLen() + 7) / 8
+	if err := e.putLen(o, n); err != nil {
+		return err
+	}
+	x.FillBytes(e.grow(n))
+	return e.written()
+}
+
+func bigIntEncoder(o codecOptions) encodeFunc {
+	return func(e *Encoder, v reflect.Value) error { return e.putBigInt(o, marshaler(v, true).(*big.Int)) }
+}
+
+func bigIntDecoder(o codecOptions) decodeFunc {
+	return func(d *Decoder, v reflect.Value) error { return d.bigInt(o, v.Addr().Interface().(*big.Int)) }
+}
+
+func bigIntSizer(o codecOptions) sizeFunc {
+	return func(v reflect.Value) (int, error) {
+		n, err := bigAbsSize(o, marshaler(v, true).(*big.Int))
+		return 1 + n, err
+	}
+}
+
+// bigAbsSize returns the size of the absolute value of x
+func bigAbsSize(o codecOptions, x *big.Int) (int, error) {
+	n := (x.BitLen() + 7) / 8
+	ln, err := lenSize(o, n)
+	return ln + n, err
+}
+
+// bigInt reads a big.Int written by putBigInt to x
+func (d *Decoder) bigInt(o codecOptions, x *big.Int) error {
+	b, err := d.read(1)
+	if err != nil {
+		return err
+	}
+	sign := b[0]
+	if sign > 1 {
+		return fmt.Errorf("invalid sign %d", sign)
+	}
+	if err := d.bigAbs(o, x); err != nil {
+		return err
+	}
+	if sign == 1 {
+		x.Neg(x)
+	}
+	return nil
+}
+
+// bigAbs reads an absolute value written by putBigAbs to x
+func (d *Decoder) bigAbs(o codecOptions, x *big.Int) error {
+	n, err := d.length(o)
+	if err != nil {
+		return err
+	}
+	if err := d.allocBytes(n); err != nil {
+		return err
+	}
+	b, err := d.read(n)
+	if err != nil {
+		return err
+	}
+	x.SetBytes(b)
+	return nil
+}
+
+func bigRatEncoder(o codecOptions) encodeFunc {
+	return func(e *Encoder, v reflect.Value) error {
+		x := marshaler(v, true).(*big.Rat)
+		if err := e.putBigInt(o, x.Num()); err != nil {
+			return err
+		}
+		return e.putBigAbs(o, x.Denom())
+	}
+}
+
+func bigRatDecoder(o codecOptions) decodeFunc {
+	return func(d *Decoder, v reflect.Value) error {
+		var num, den big.Int
+		if err := d.bigInt(o, &num); err != nil {
+			return err
+		}
+		if err := d.bigAbs(o, &den); err != nil {
+			return err
+		}
+		if den.Sign() == 0 {
+			return fmt.Errorf("zero denominator")
+		}
+		v.Addr().Interface().(*big.Rat).SetFrac(&num, &den)
+		return nil
+	}
+}
+
+func bigRatSizer(o codecOptions) sizeFunc {
+	return func(v reflect.Value) (int, error) {
+		x := marshaler(v, true).(*big.Rat)
+		num, err := bigAbsSize(o, x.Num())
+		if err != nil {
+			return 0, err
+		}
+		den, err := bigAbsSize(o, x.Denom())
+		return 1 + num + den, err
+	}
+}
+
+func bigFloatEncoder(o codecOptions) encodeFunc {
+	return func(e *Encoder, v reflect.Value) error {
+		b, err := marshaler(v, true).(*big.Float).GobEncode()
+		if err != nil {
+			return err
+		}
+		if err := e.putLen(o, len(b)); err != nil {
+			return err
+		}
+		return e.write(b)
+	}
+}
+
+func bigFloatDecoder(o codecOptions) decodeFunc {
+	return func(d *Decoder, v reflect.Value) error {
+		n, err := d.length(o)
+		if err != nil {
+			return err
+		}
+		if err := d.allocBytes(n); err != nil {
+			return err
+		}
+		b, err := d.read(n)
+		if err != nil {
+			return err
+		}
+		// GobDecode rounds to the precision of a Float that has one
+		x := v.Addr().Interface().(*big.Float)
+		*x = big.Float{}
+		return x.GobDecode(b)
+	}
+}
+
+func bigFloatSizer(o codecOptions) sizeFunc {
+	return func(v reflect.Value) (int, error) {
+		b, err := marshaler(v, true).(*big.Float).GobEncode()
+		if err != nil {
+			return 0, err
+		}
+		n, err := lenSize(o, len(b))
+		return n + len(b), err
+	}
+}
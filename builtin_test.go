@@ -0,0 +1,302 @@
+package structtools
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type times struct {
+	A time.Time
+	B *time.Time
+	C []time.Time `bin:",time=unixnano"`
+	D time.Duration
+}
+
+func TestTimeFormats(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("", -7200))
+	v := times{A: at, B: &at, C: []time.Time{at, time.Unix(0, 0).UTC()}, D: 90 * time.Minute}
+	for _, tf := range []TimeFormat{TimeBinary, TimeUnixNano, TimeUnixZone} {
+		encoders := []*Encoder{
+			{Tag: DefaultTag, ByteOrder: DefaultByteOrder, TimeFormat: tf},
+			{Tag: DefaultTag, ByteOrder: binary.LittleEndian, VarInt: true, TimeFormat: tf},
+		}
+		for _, enc := range encoders {
+			b, err := enc.Append(nil, v)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if n, err := enc.Size(v); err != nil || n != len(b) {
+				t.Error("got different sizes:", n, len(b), err)
+				return
+			}
+			dec := NewBytesDecoder(b)
+			dec.ByteOrder, dec.VarInt, dec.TimeFormat = enc.ByteOrder, enc.VarInt, tf
+			var out times
+			if err := dec.Decode(&out); err != nil {
+				t.Error(err)
+				return
+			}
+			if !out.A.Equal(at) || !out.B.Equal(at) || len(out.C) != 2 || !out.C[0].Equal(at) || out.D != v.D {
+				t.Error(tf, "got different values", out)
+				return
+			}
+			if _, off := out.A.Zone(); tf != TimeUnixNano && off != -7200 {
+				t.Error(tf, "got a different zone", out.A)
+				return
+			}
+			if out.C[0].Location() != time.UTC {
+				t.Error("expecting UTC", out.C[0])
+				return
+			}
+		}
+	}
+
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, TimeFormat: TimeUnixZone}
+	at = time.Unix(1, 6).In(time.FixedZone("CET", 3600))
+	for _, test := range []struct {
+		tf  TimeFormat
+		exp string
+	}{
+		{TimeUnixNano, "000000003b9aca06"},
+		{TimeUnixZone, "0000000000000001" + "00000006" + "00000e10"},
+	} {
+		enc.TimeFormat = test.tf
+		b, err := enc.Append(nil, at)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if xs := hex.EncodeToString(b); xs != test.exp {
+			t.Error("got different values:", xs)
+			return
+		}
+		if n := codecFor(timeType, enc.options()).fixed; n != len(b) {
+			t.Error("got different sizes:", n, len(b))
+			return
+		}
+	}
+}
+
+func TestTimeFormatsCLayout(t *testing.T) {
+	type rec struct {
+		A uint8
+		T time.Time
+	}
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, Layout: CLayout, TimeFormat: TimeUnixNano}
+	b, err := enc.Append(nil, rec{1, time.Unix(0, 2)})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "01"+"00000000000000"+"0000000000000002" {
+		t.Error("got different values:", xs)
+		return
+	}
+}
+
+type bigs struct {
+	I *big.Int
+	R *big.Rat
+	F *big.Float
+	V big.Int
+	M map[string]big.Int
+}
+
+func TestBigNumbers(t *testing.T) {
+	huge, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	v := bigs{
+		I: huge,
+		R: big.NewRat(-3, 9),
+		F: new(big.Float).SetPrec(200).SetFloat64(math.Pi),
+		M: map[string]big.Int{"a": *big.NewInt(255)},
+	}
+	v.V.SetInt64(-5)
+	for _, enc := range []*Encoder{
+		NewEncoder(nil),
+		{Tag: DefaultTag, ByteOrder: binary.LittleEndian, VarInt: true, Presence: PointerPresence, LenPrefix: Len8},
+	} {
+		b, err := enc.Append(nil, v)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if n, err := enc.Size(v); err != nil || n != len(b) {
+			t.Error("got different sizes:", n, len(b), err)
+			return
+		}
+		dec := NewBytesDecoder(b)
+		dec.ByteOrder, dec.VarInt, dec.Presence, dec.LenPrefix = enc.ByteOrder, enc.VarInt, enc.Presence, enc.LenPrefix
+		out := bigs{F: new(big.Float).SetPrec(10)}
+		if err := dec.Decode(&out); err != nil {
+			t.Error(err)
+			return
+		}
+		m := out.M["a"]
+		if out.I.Cmp(v.I) != 0 || out.R.Cmp(v.R) != 0 || out.F.Cmp(v.F) != 0 || out.F.Prec() != 200 ||
+			out.V.Cmp(&v.V) != 0 || m.Int64() != 255 {
+			t.Error("got different values", out)
+			return
+		}
+	}
+
+	b, err := Marshal(struct {
+		I *big.Int
+		R big.Rat
+	}{big.NewInt(-5), *big.NewRat(6, -8)})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "01"+"00000001"+"05"+"01"+"00000001"+"03"+"00000001"+"04" {
+		t.Error("got different values:", xs)
+		return
+	}
+	if _, ok := FixedSize(bigIntType); ok {
+		t.Error("big.Int can't have a fixed size")
+		return
+	}
+}
+
+func TestBuiltinSelfDescribing(t *testing.T) {
+	at := time.Unix(10, 20).UTC()
+	v := struct {
+		T time.Time `bin:",time=unixzone"`
+		I *big.Int
+		F big.Float
+	}{T: at, I: big.NewInt(-7)}
+	v.F.SetFloat64(0.5)
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, SelfDescribing: true}
+	b, err := enc.Append(nil, v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dec := NewBytesDecoder(b)
+	dec.SelfDescribing = true
+	var out interface{}
+	if err := dec.Decode(&out); err != nil {
+		t.Error(err)
+		return
+	}
+	m, ok := out.(map[string]interface{})
+	if !ok {
+		t.Error("got unexpected value", out)
+		return
+	}
+	if tv, ok := m["T"].(time.Time); !ok || !tv.Equal(at) {
+		t.Error("got different values", m["T"])
+		return
+	}
+	if iv, ok := m["I"].(*big.Int); !ok || iv.Int64() != -7 {
+		t.Error("got different values", m["I"])
+		return
+	}
+	if fv, ok := m["F"].(*big.Float); !ok || fv.Cmp(&v.F) != 0 {
+		t.Error("got different values", m["F"])
+		return
+	}
+
+	var wrong struct{ T int64 }
+	dec = NewBytesDecoder(b)
+	dec.SelfDescribing = true
+	if err := dec.Decode(&wrong); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
+
+type event struct {
+	At time.Time
+	N  uint16
+}
+
+func init() {
+	Register("event", event{})
+}
+
+func TestBuiltinInterfaces(t *testing.T) {
+	type holder struct{ P interface{} }
+	at := time.Unix(10, 20).UTC()
+	for _, tf := range []TimeFormat{TimeUnixNano, TimeUnixZone} {
+		enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, SelfDescribing: true, TimeFormat: tf}
+		b, err := enc.Append(nil, holder{event{at, 3}})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// the format comes from the description of the interface
+		dec := NewBytesDecoder(b)
+		dec.SelfDescribing = true
+		var out holder
+		if err := dec.Decode(&out); err != nil {
+			t.Error(tf, err)
+			return
+		}
+		if ev, ok := out.P.(event); !ok || !ev.At.Equal(at) || ev.N != 3 {
+			t.Error(tf, "got different values", out)
+			return
+		}
+		dec = NewBytesDecoder(b)
+		dec.SelfDescribing = true
+		var g interface{}
+		if err := dec.Decode(&g); err != nil {
+			t.Error(tf, err)
+			return
+		}
+		if m, ok := g.(map[string]interface{}); !ok || m["P"] != (event{at, 3}) {
+			t.Error(tf, "got different values", g)
+			return
+		}
+	}
+}
+
+func TestBuiltinErrors(t *testing.T) {
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, TimeFormat: TimeUnixNano}
+	if _, err := enc.Append(nil, time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+	for _, test := range []struct {
+		in string
+		v  interface{}
+		tf TimeFormat
+	}{
+		// sign
+		{"02" + "00000000", new(big.Int), TimeBinary},
+		// zero denominator
+		{"00" + "00000001" + "01" + "00000000", new(big.Rat), TimeBinary},
+		// nanoseconds
+		{"0000000000000000" + "3b9aca00" + "00000000", new(time.Time), TimeUnixZone},
+		// truncated
+		{"00" + "00000002" + "01", new(big.Int), TimeBinary},
+		{"00000000", new(time.Time), TimeUnixNano},
+	} {
+		b, _ := hex.DecodeString(test.in)
+		dec := NewBytesDecoder(b)
+		dec.TimeFormat = test.tf
+		if err := dec.Decode(test.v); err == nil {
+			t.Error("expecting an error", test.in)
+			return
+		}
+	}
+	for _, v := range []interface{}{
+		struct {
+			A int64 `bin:",time=unixnano"`
+		}{},
+		struct {
+			A time.Time `bin:",time=unix"`
+		}{},
+	} {
+		if _, err := Marshal(v); err == nil {
+			t.Error("expecting an error", reflect.TypeOf(v))
+			return
+		}
+	}
+}
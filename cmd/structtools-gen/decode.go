@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+)
+
+// decode writes the code that reads the addressable value v of type t
+// from the *stgenReader d
+func (g *generator) decode(w *bytes.Buffer, v string, t types.Type, o options) error {
+	if err := g.unsupported(t, o); err != nil {
+		return err
+	}
+	if n, ok := t.(*types.Named); ok && g.named[n] {
+		fmt.Fprintf(w, "if err = %s.stgenDecode(d); err != nil {\nreturn err\n}\n", v)
+		return nil
+	}
+	if g.isUnmarshaler(t) {
+		fmt.Fprintf(w, "if _, err = %s.UnmarshalBinary(d); err != nil {\nreturn err\n}\n", v)
+		return nil
+	}
+	if g.isBinaryMarshaler(t) {
+		fmt.Fprintf(w, "{\nn, err := d.length(%s)\nif err != nil {\nreturn err\n}\n", o.lenArgs())
+		fmt.Fprintf(w, "p, err := d.bytes(n)\nif err != nil {\nreturn err\n}\n")
+		fmt.Fprintf(w, "if err := %s.UnmarshalBinary(p); err != nil {\nreturn err\n}\n}\n", v)
+		return nil
+	}
+	if err := g.enter(t); err != nil {
+		return err
+	}
+	defer g.leave(t)
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		g.decodeBasic(w, v, t, u, o)
+		return nil
+	case *types.Pointer:
+		if o.presence != presenceNone {
+			fmt.Fprintf(w, "if ok, err := d.presence(); err != nil {\nreturn err\n} else if !ok {\n%s = nil\n} else {\n", v)
+		}
+		fmt.Fprintf(w, "if %[1]s == nil {\n%[1]s = new(%[2]s)\n}\n", v, g.typeName(u.Elem()))
+		if err := g.decode(w, "(*"+v+")", u.Elem(), o); err != nil {
+			return err
+		}
+		if o.presence != presenceNone {
+			w.WriteString("}\n")
+		}
+		return nil
+	case *types.Struct:
+		return g.decodeStruct(w, v, t, u, o)
+	case *types.Array:
+		i := g.temp("i")
+		fmt.Fprintf(w, "for %s := range %s {\n", i, v)
+		if err := g.decode(w, v+"["+i+"]", u.Elem(), o.elem()); err != nil {
+			return err
+		}
+		w.WriteString("}\n")
+		return nil
+	case *types.Slice:
+		g.readNil(w, v, o)
+		if err := g.decodeSlice(w, v, t, u, o); err != nil {
+			return err
+		}
+		if o.presence == presenceNil {
+			w.WriteString("}\n")
+		}
+		return nil
+	case *types.Map:
+		g.readNil(w, v, o)
+		if err := g.decodeMap(w, v, t, u, o); err != nil {
+			return err
+		}
+		if o.presence == presenceNil {
+			w.WriteString("}\n")
+		}
+		return nil
+	}
+	return fmt.Errorf("can't generate code for %s", reflectName(t))
+}
+
+// readNil opens the block of a slice or map that is marked with a
+// presence byte, the caller closes it
+func (g *generator) readNil(w *bytes.Buffer, v string, o options) {
+	if o.presence == presenceNil {
+		fmt.Fprintf(w, "if ok, err := d.presence(); err != nil {\nreturn err\n} else if !ok {\n%s = nil\n} else {\n", v)
+	}
+}
+
+// readInto writes the code that calls the reader method call, with
+// the result in n, and sets v to the expression set
+func readInto(w *bytes.Buffer, call, v, set string) {
+	fmt.Fprintf(w, "if n, err := d.%s; err != nil {\nreturn err\n} else {\n%s = %s\n}\n", call, v, set)
+}
+
+// wrap converts the expression v to the type named tn, unless
+// it is the type of v, one of vt
+func wrap(tn, v string, vt ...string) string {
+	for _, n := range vt {
+		if tn == n {
+			return v
+		}
+	}
+	return tn + "(" + v + ")"
+}
+
+func (g *generator) decodeBasic(w *bytes.Buffer, v string, t types.Type, b *types.Basic, o options) {
+	bo := o.byteOrder()
+	tn := g.typeName(t)
+	if o.varint {
+		switch b.Kind() {
+		case types.Int16, types.Int32, types.Int64, types.Int:
+			fmt.Fprintf(w, "if n, err := d.varint(); err != nil {\nreturn err\n}")
+			if b.Kind() != types.Int64 {
+				fmt.Fprintf(w, " else if int64(%s(n)) != n {\nreturn fmt.Errorf(\"%%d overflows %s\", n)\n}", tn, reflectName(t))
+			}
+			fmt.Fprintf(w, " else {\n%s = %s\n}\n", v, wrap(tn, "n", "int64"))
+			return
+		case types.Uint16, types.Uint32, types.Uint64, types.Uint:
+			fmt.Fprintf(w, "if n, err := d.uvarint(); err != nil {\nreturn err\n}")
+			if b.Kind() != types.Uint64 {
+				fmt.Fprintf(w, " else if uint64(%s(n)) != n {\nreturn fmt.Errorf(\"%%d overflows %s\", n)\n}", tn, reflectName(t))
+			}
+			fmt.Fprintf(w, " else {\n%s = %s\n}\n", v, wrap(tn, "n", "uint64"))
+			return
+		}
+	}
+	switch b.Kind() {
+	case types.Int8:
+		readInto(w, "uint8()", v, wrap(tn, "int8(n)", "int8"))
+	case types.Uint8:
+		readInto(w, "uint8()", v, wrap(tn, "n", "uint8", "byte"))
+	case types.Int16:
+		readInto(w, "uint16("+bo+")", v, wrap(tn, "int16(n)", "int16"))
+	case types.Uint16:
+		readInto(w, "uint16("+bo+")", v, wrap(tn, "n", "uint16"))
+	case types.Int32:
+		readInto(w, "uint32("+bo+")", v, wrap(tn, "int32(n)", "int32"))
+	case types.Uint32:
+		readInto(w, "uint32("+bo+")", v, wrap(tn, "n", "uint32"))
+	case types.Int64, types.Int:
+		readInto(w, "uint64("+bo+")", v, wrap(tn, "int64(n)", "int64"))
+	case types.Uint64, types.Uint:
+		readInto(w, "uint64("+bo+")", v, wrap(tn, "n", "uint64"))
+	case types.Float32:
+		readInto(w, "uint32("+bo+")", v, wrap(tn, "math.Float32frombits(n)", "float32"))
+	case types.Float64:
+		readInto(w, "uint64("+bo+")", v, wrap(tn, "math.Float64frombits(n)", "float64"))
+	case types.Complex64:
+		fmt.Fprintf(w, "if p, err := d.read(8); err != nil {\nreturn err\n} else {\n")
+		c := fmt.Sprintf("complex(math.Float32frombits(%[1]s.Uint32(p)), math.Float32frombits(%[1]s.Uint32(p[4:])))", bo)
+		fmt.Fprintf(w, "%s = %s\n}\n", v, wrap(tn, c, "complex64"))
+	case types.Complex128:
+		fmt.Fprintf(w, "if p, err := d.read(16); err != nil {\nreturn err\n} else {\n")
+		c := fmt.Sprintf("complex(math.Float64frombits(%[1]s.Uint64(p)), math.Float64frombits(%[1]s.Uint64(p[8:])))", bo)
+		fmt.Fprintf(w, "%s = %s\n}\n", v, wrap(tn, c, "complex128"))
+	case types.Bool:
+		readInto(w, "uint8()", v, "n != 0")
+	case types.String:
+		switch {
+		case o.cstr && o.size == 0:
+			fmt.Fprintf(w, "if p, err := d.cstring(); err != nil {\nreturn err\n} else {\n%s = %s(p)\n}\n", v, tn)
+		case o.size > 0:
+			fmt.Fprintf(w, "if p, err := d.padded(%d, %d, %t); err != nil {\nreturn err\n} else {\n%s = %s(p)\n}\n", o.size, o.pad, o.cstr, v, tn)
+		default:
+			fmt.Fprintf(w, "if n, err := d.length(%s); err != nil {\nreturn err\n} else if p, err := d.read(n); err != nil {\nreturn err\n} else {\n%s = %s(p)\n}\n", o.lenArgs(), v, tn)
+		}
+	}
+}
+
+func (g *generator) decodeStruct(w *bytes.Buffer, v string, t types.Type, st *types.Struct, o options) error {
+	fields, err := g.fields(t, st, o)
+	if err != nil {
+		return err
+	}
+	if hasFieldIDs(fields) {
+		return g.decodeFieldIDs(w, v, t, fields)
+	}
+	for _, f := range fields {
+		if f.group != nil {
+			g.decodeBits(w, v, f.group)
+			continue
+		}
+		if err := g.decode(w, v+"."+f.name, f.typ, f.opts); err != nil {
+			return fmt.Errorf("%s.%s: %v", t, f.name, err)
+		}
+	}
+	return nil
+}
+
+// decodeFieldIDs reads numbered fields. Unknown fields are
+// skipped and missing fields are left as they are
+func (g *generator) decodeFieldIDs(w *bytes.Buffer, v string, t types.Type, fields []field) error {
+	w.WriteString(`for first := true; ; first = false {
+id, err := d.uvarint()
+if err != nil {
+if err == io.EOF && !first {
+err = io.ErrUnexpectedEOF
+}
+return err
+}
+if id == 0 {
+break
+}
+n, err := d.fieldLength()
+if err != nil {
+return err
+}
+start := d.n
+switch id {
+`)
+	for _, f := range fields {
+		fmt.Fprintf(w, "case %d:\n", f.tag.id)
+		if err := g.decode(w, v+"."+f.name, f.typ, f.opts); err != nil {
+			return fmt.Errorf("%s.%s: %v", t, f.name, err)
+		}
+	}
+	w.WriteString("}\nif err := d.skipRest(n, start); err != nil {\nreturn err\n}\n}\n")
+	return nil
+}
+
+// decodeBits unpacks a group of bit-fields
+func (g *generator) decodeBits(w *bytes.Buffer, v string, group []field) {
+	fmt.Fprintf(w, "if p, err := d.read(%d); err != nil {\nreturn err\n} else {\n", groupSize(group))
+	pos := 0
+	for _, f := range group {
+		fv, n, lsb := v+"."+f.name, f.tag.bits, f.tag.lsb
+		bits := fmt.Sprintf("stgenGetBits(p, %d, %d, %t)", pos, n, lsb)
+		b := f.typ.Underlying().(*types.Basic)
+		switch {
+		case b.Kind() == types.Bool:
+			fmt.Fprintf(w, "%s = %s != 0\n", fv, bits)
+		case isSigned(b):
+			// extend the sign
+			fmt.Fprintf(w, "%s = %s(int64(%s<<%d) >> %[4]d)\n", fv, g.typeName(f.typ), bits, 64-n)
+		default:
+			fmt.Fprintf(w, "%s = %s\n", fv, wrap(g.typeName(f.typ), bits, "uint64"))
+		}
+		pos += n
+	}
+	w.WriteString("}\n")
+}
+
+func (g *generator) decodeSlice(w *bytes.Buffer, v string, t types.Type, s *types.Slice, o options) error {
+	tn := g.typeName(t)
+	if g.isPaddedBytes(s) {
+		if o.size > 0 {
+			fmt.Fprintf(w, "if p, err := d.padded(%d, %d, false); err != nil {\nreturn err\n} else {\n", o.size, o.pad)
+			if isByte(s.Elem()) {
+				fmt.Fprintf(w, "%s = append(%s{}, p...)\n}\n", v, tn)
+			} else {
+				fmt.Fprintf(w, "%[1]s = make(%[2]s, len(p))\nfor i, c := range p {\n%[1]s[i] = %[3]s(c)\n}\n}\n", v, tn, g.typeName(s.Elem()))
+			}
+			return nil
+		}
+		fmt.Fprintf(w, "if n, err := d.length(%s); err != nil {\nreturn err\n} else if p, err := d.bytes(n); err != nil {\nreturn err\n} else {\n", o.lenArgs())
+		if isByte(s.Elem()) {
+			fmt.Fprintf(w, "%s = %s\n}\n", v, wrap(tn, "p", "[]byte", "[]uint8"))
+		} else {
+			fmt.Fprintf(w, "%[1]s = make(%[2]s, len(p))\nfor i, c := range p {\n%[1]s[i] = %[3]s(c)\n}\n}\n", v, tn, g.typeName(s.Elem()))
+		}
+		return nil
+	}
+	n, i, e := g.temp("n"), g.temp("i"), g.temp("e")
+	if o.size > 0 {
+		fmt.Fprintf(w, "{\n%s := %d\n", n, o.size)
+	} else {
+		fmt.Fprintf(w, "if %s, err := d.length(%s); err != nil {\nreturn err\n} else {\n", n, o.lenArgs())
+	}
+	fmt.Fprintf(w, "%s = make(%s, 0, stgenCap(%s))\n", v, tn, n)
+	fmt.Fprintf(w, "for %[1]s := 0; %[1]s < %[2]s; %[1]s++ {\nvar %[3]s %[4]s\n", i, n, e, g.typeName(s.Elem()))
+	if err := g.decode(w, e, s.Elem(), o.elem()); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%[1]s = append(%[1]s, %[2]s)\n}\n}\n", v, e)
+	return nil
+}
+
+func (g *generator) decodeMap(w *bytes.Buffer, v string, t types.Type, m *types.Map, o options) error {
+	n, i, k, e := g.temp("n"), g.temp("i"), g.temp("k"), g.temp("e")
+	fmt.Fprintf(w, "if %s, err := d.length(%s); err != nil {\nreturn err\n} else {\n", n, o.lenArgs())
+	fmt.Fprintf(w, "%s = make(%s)\n", v, g.typeName(t))
+	fmt.Fprintf(w, "for %[1]s := 0; %[1]s < %[2]s; %[1]s++ {\nvar %[3]s %[4]s\nvar %[5]s %[6]s\n", i, n, k, g.typeName(m.Key()), e, g.typeName(m.Elem()))
+	if err := g.decode(w, k, m.Key(), o.elem()); err != nil {
+		return err
+	}
+	if err := g.decode(w, e, m.Elem(), o.elem()); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s[%s] = %s\n}\n}\n", v, k, e)
+	return nil
+}
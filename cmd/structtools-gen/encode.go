@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+)
+
+// methods writes the methods of the struct type n
+func (g *generator) methods(w *bytes.Buffer, n *types.Named) error {
+	st := n.Underlying().(*types.Struct)
+	enc, dec := &bytes.Buffer{}, &bytes.Buffer{}
+	g.inline = []*types.Named{n}
+	if err := g.encodeStruct(enc, "b", "x", n, st, g.cfg.opts); err != nil {
+		return err
+	}
+	if err := g.decodeStruct(dec, "x", n, st, g.cfg.opts); err != nil {
+		return err
+	}
+	name := n.Obj().Name()
+	fmt.Fprintf(w, `// MarshalBinary implements the Marshaler interface of the structtools package
+func (x %[1]s) MarshalBinary(w io.Writer) (int, error) {
+	b, err := x.stgenAppend(nil)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(b)
+}
+
+// UnmarshalBinary implements the Unmarshaler interface of the structtools package
+func (x *%[1]s) UnmarshalBinary(r io.Reader) (int, error) {
+	d := &stgenReader{r: r}
+	err := x.stgenDecode(d)
+	if err == io.EOF && d.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return d.n, err
+}
+
+func (x *%[1]s) stgenAppend(b []byte) (_ []byte, err error) {
+%[2]s	return b, nil
+}
+
+func (x *%[1]s) stgenDecode(d *stgenReader) (err error) {
+%[3]s	return nil
+}
+
+`, name, enc, dec)
+	return nil
+}
+
+// encode writes the code that appends the value v of type t to
+// the []byte buf. Errors are returned with b, the main buffer
+func (g *generator) encode(w *bytes.Buffer, buf, v string, t types.Type, o options) error {
+	if err := g.unsupported(t, o); err != nil {
+		return err
+	}
+	u := t.Underlying()
+	// a pointer to a value marshaler is handled below,
+	// so a nil pointer is skipped instead of dereferenced
+	if p, ok := u.(*types.Pointer); g.hasMarshaler(t) && (!ok || !g.hasMarshaler(p.Elem())) {
+		g.encodeMarshaler(w, buf, v, t, o)
+		return nil
+	}
+	if err := g.enter(t); err != nil {
+		return err
+	}
+	defer g.leave(t)
+
+	switch u := u.(type) {
+	case *types.Basic:
+		g.encodeBasic(w, buf, v, t, u, o)
+		return nil
+	case *types.Pointer:
+		if o.presence != presenceNone {
+			fmt.Fprintf(w, "if %[2]s == nil {\n%[1]s = append(%[1]s, 0)\n} else {\n%[1]s = append(%[1]s, 1)\n", buf, v)
+		} else {
+			fmt.Fprintf(w, "if %s != nil {\n", v)
+		}
+		if err := g.encode(w, buf, "(*"+v+")", u.Elem(), o); err != nil {
+			return err
+		}
+		w.WriteString("}\n")
+		return nil
+	case *types.Struct:
+		return g.encodeStruct(w, buf, v, t, u, o)
+	case *types.Array:
+		i := g.temp("i")
+		fmt.Fprintf(w, "for %s := range %s {\n", i, v)
+		if err := g.encode(w, buf, v+"["+i+"]", u.Elem(), o.elem()); err != nil {
+			return err
+		}
+		w.WriteString("}\n")
+		return nil
+	case *types.Slice:
+		g.markNil(w, buf, v, o)
+		if err := g.encodeSlice(w, buf, v, u, o); err != nil {
+			return err
+		}
+		if o.presence == presenceNil {
+			w.WriteString("}\n")
+		}
+		return nil
+	case *types.Map:
+		g.markNil(w, buf, v, o)
+		if err := g.encodeMap(w, buf, v, u, o); err != nil {
+			return err
+		}
+		if o.presence == presenceNil {
+			w.WriteString("}\n")
+		}
+		return nil
+	}
+	return fmt.Errorf("can't generate code for %s", reflectName(t))
+}
+
+// encodeMarshaler calls the methods of a type that marshals itself
+func (g *generator) encodeMarshaler(w *bytes.Buffer, buf, v string, t types.Type, o options) {
+	if n, ok := t.(*types.Named); ok && g.named[n] {
+		fmt.Fprintf(w, "if %[1]s, err = %[2]s.stgenAppend(%[1]s); err != nil {\nreturn b, err\n}\n", buf, v)
+		return
+	}
+	if g.isMarshaler(t) {
+		fmt.Fprintf(w, "{\nw := stgenBuffer(%[1]s)\nif _, err = %[2]s.MarshalBinary(&w); err != nil {\nreturn b, err\n}\n%[1]s = w\n}\n", buf, v)
+		return
+	}
+	// encoding.BinaryMarshaler, written as a length prefixed blob
+	fmt.Fprintf(w, "{\np, err := %s.MarshalBinary()\nif err != nil {\nreturn b, err\n}\n", v)
+	g.putLen(w, buf, "len(p)", o)
+	fmt.Fprintf(w, "%[1]s = append(%[1]s, p...)\n}\n", buf)
+}
+
+// putLen writes the length prefix n
+func (g *generator) putLen(w *bytes.Buffer, buf, n string, o options) {
+	fmt.Fprintf(w, "if %[1]s, err = stgenPutLen(%[1]s, %[2]s, %[3]s); err != nil {\nreturn b, err\n}\n", buf, n, o.lenArgs())
+}
+
+// markNil opens the block of a slice or map that is marked with a
+// presence byte, the caller closes it
+func (g *generator) markNil(w *bytes.Buffer, buf, v string, o options) {
+	if o.presence == presenceNil {
+		fmt.Fprintf(w, "if %[2]s == nil {\n%[1]s = append(%[1]s, 0)\n} else {\n%[1]s = append(%[1]s, 1)\n", buf, v)
+	}
+}
+
+func (g *generator) encodeBasic(w *bytes.Buffer, buf, v string, t types.Type, b *types.Basic, o options) {
+	bo := o.byteOrder()
+	if o.varint {
+		switch b.Kind() {
+		case types.Int16, types.Int32, types.Int64, types.Int:
+			fmt.Fprintf(w, "%[1]s = binary.AppendVarint(%[1]s, %[2]s)\n", buf, convert("int64", v, t))
+			return
+		case types.Uint16, types.Uint32, types.Uint64, types.Uint:
+			fmt.Fprintf(w, "%[1]s = binary.AppendUvarint(%[1]s, %[2]s)\n", buf, convert("uint64", v, t))
+			return
+		}
+	}
+	switch b.Kind() {
+	case types.Int8, types.Uint8:
+		fmt.Fprintf(w, "%[1]s = append(%[1]s, byte(%[2]s))\n", buf, v)
+	case types.Int16, types.Uint16:
+		fmt.Fprintf(w, "%[1]s = %[2]s.AppendUint16(%[1]s, %[3]s)\n", buf, bo, convert("uint16", v, t))
+	case types.Int32, types.Uint32:
+		fmt.Fprintf(w, "%[1]s = %[2]s.AppendUint32(%[1]s, %[3]s)\n", buf, bo, convert("uint32", v, t))
+	case types.Int64, types.Int, types.Uint64, types.Uint:
+		fmt.Fprintf(w, "%[1]s = %[2]s.AppendUint64(%[1]s, %[3]s)\n", buf, bo, convert("uint64", v, t))
+	case types.Float32:
+		fmt.Fprintf(w, "%[1]s = %[2]s.AppendUint32(%[1]s, math.Float32bits(%[3]s))\n", buf, bo, convert("float32", v, t))
+	case types.Float64:
+		fmt.Fprintf(w, "%[1]s = %[2]s.AppendUint64(%[1]s, math.Float64bits(%[3]s))\n", buf, bo, convert("float64", v, t))
+	case types.Complex64:
+		fmt.Fprintf(w, "%[1]s = %[2]s.AppendUint32(%[2]s.AppendUint32(%[1]s, math.Float32bits(real(%[3]s))), math.Float32bits(imag(%[3]s)))\n", buf, bo, v)
+	case types.Complex128:
+		fmt.Fprintf(w, "%[1]s = %[2]s.AppendUint64(%[2]s.AppendUint64(%[1]s, math.Float64bits(real(%[3]s))), math.Float64bits(imag(%[3]s)))\n", buf, bo, v)
+	case types.Bool:
+		fmt.Fprintf(w, "%[1]s = stgenPutBool(%[1]s, %[2]s)\n", buf, convert("bool", v, t))
+	case types.String:
+		s := convert("string", v, t)
+		switch {
+		case o.cstr && o.size == 0:
+			fmt.Fprintf(w, "if %[1]s, err = stgenPutCString(%[1]s, %[2]s); err != nil {\nreturn b, err\n}\n", buf, s)
+		case o.size > 0:
+			fmt.Fprintf(w, "if %[1]s, err = stgenPutPadded(%[1]s, %[2]s, %[3]d, %[4]d, %[5]t); err != nil {\nreturn b, err\n}\n", buf, s, o.size, o.pad, o.cstr)
+		default:
+			g.putLen(w, buf, "len("+v+")", o)
+			fmt.Fprintf(w, "%[1]s = append(%[1]s, %[2]s...)\n", buf, s)
+		}
+	}
+}
+
+func (g *generator) encodeStruct(w *bytes.Buffer, buf, v string, t types.Type, st *types.Struct, o options) error {
+	fields, err := g.fields(t, st, o)
+	if err != nil {
+		return err
+	}
+	ids := hasFieldIDs(fields)
+	for _, f := range fields {
+		if f.group != nil {
+			g.encodeBits(w, buf, v, f.group)
+			continue
+		}
+		var start string
+		_, ptr := f.typ.Underlying().(*types.Pointer)
+		// nil pointers are left out without presence bytes
+		missing := ids && ptr && f.opts.presence == presenceNone
+		if missing {
+			fmt.Fprintf(w, "if %s.%s != nil {\n", v, f.name)
+		}
+		if ids {
+			// the length of the value is inserted before it
+			start = g.temp("start")
+			fmt.Fprintf(w, "%[1]s = binary.AppendUvarint(%[1]s, %[2]d)\n%[3]s := len(%[1]s)\n", buf, f.tag.id, start)
+		}
+		if err := g.encode(w, buf, v+"."+f.name, f.typ, f.opts); err != nil {
+			return fmt.Errorf("%s.%s: %v", t, f.name, err)
+		}
+		if ids {
+			fmt.Fprintf(w, "%[1]s = stgenInsertLen(%[1]s, %[2]s)\n", buf, start)
+		}
+		if missing {
+			w.WriteString("}\n")
+		}
+	}
+	if ids {
+		fmt.Fprintf(w, "%[1]s = append(%[1]s, 0)\n", buf)
+	}
+	return nil
+}
+
+// encodeBits packs a group of bit-fields
+func (g *generator) encodeBits(w *bytes.Buffer, buf, v string, group []field) {
+	bits := g.temp("bits")
+	fmt.Fprintf(w, "var %s [%d]byte\n", bits, groupSize(group))
+	pos := 0
+	for _, f := range group {
+		fv, n, lsb := v+"."+f.name, f.tag.bits, f.tag.lsb
+		b := f.typ.Underlying().(*types.Basic)
+		switch {
+		case b.Kind() == types.Bool:
+			fmt.Fprintf(w, "if %s {\nstgenPutBits(%s[:], %d, 1, 1, %t)\n}\n", fv, bits, pos, lsb)
+		case isSigned(b) && n < 64:
+			lo, hi := -int64(1)<<uint(n-1), int64(1)<<uint(n-1)-1
+			fmt.Fprintf(w, "if n := int64(%s); n < %d || n > %d {\nreturn b, fmt.Errorf(\"%%d doesn't fit in %d bits\", n)\n}\n", fv, lo, hi, n)
+			fmt.Fprintf(w, "stgenPutBits(%s[:], %d, %d, uint64(%s)&%#x, %t)\n", bits, pos, n, fv, uint64(1)<<uint(n)-1, lsb)
+		default:
+			if !isSigned(b) && n < 64 {
+				fmt.Fprintf(w, "if n := uint64(%s); n>>%d != 0 {\nreturn b, fmt.Errorf(\"%%d doesn't fit in %d bits\", n)\n}\n", fv, n, n)
+			}
+			fmt.Fprintf(w, "stgenPutBits(%s[:], %d, %d, uint64(%s), %t)\n", bits, pos, n, fv, lsb)
+		}
+		pos += n
+	}
+	fmt.Fprintf(w, "%[1]s = append(%[1]s, %[2]s[:]...)\n", buf, bits)
+}
+
+func (g *generator) encodeSlice(w *bytes.Buffer, buf, v string, s *types.Slice, o options) error {
+	if g.isPaddedBytes(s) {
+		if o.size > 0 {
+			fmt.Fprintf(w, "if %[1]s, err = stgenPutPadded(%[1]s, string(%[2]s), %[3]d, %[4]d, false); err != nil {\nreturn b, err\n}\n", buf, v, o.size, o.pad)
+			return nil
+		}
+		// the same as encoding byte by byte
+		g.putLen(w, buf, "len("+v+")", o)
+		elems := v
+		if !isByte(s.Elem()) {
+			elems = "string(" + v + ")"
+		}
+		fmt.Fprintf(w, "%[1]s = append(%[1]s, %[2]s...)\n", buf, elems)
+		return nil
+	}
+	if o.size > 0 {
+		fmt.Fprintf(w, "if len(%[1]s) != %[2]d {\nreturn b, fmt.Errorf(\"length %%d doesn't match size %[2]d\", len(%[1]s))\n}\n", v, o.size)
+	} else {
+		g.putLen(w, buf, "len("+v+")", o)
+	}
+	i := g.temp("i")
+	fmt.Fprintf(w, "for %s := range %s {\n", i, v)
+	if err := g.encode(w, buf, v+"["+i+"]", s.Elem(), o.elem()); err != nil {
+		return err
+	}
+	w.WriteString("}\n")
+	return nil
+}
+
+// encodeMap writes the entries of a map ordered by their encoded keys
+func (g *generator) encodeMap(w *bytes.Buffer, buf, v string, m *types.Map, o options) error {
+	g.putLen(w, buf, "len("+v+")", o)
+	keys, vals, kb, ends, i := g.temp("keys"), g.temp("vals"), g.temp("kb"), g.temp("ends"), g.temp("i")
+	fmt.Fprintf(w, "%s := make([]%s, 0, len(%s))\n", keys, g.typeName(m.Key()), v)
+	fmt.Fprintf(w, "%s := make([]%s, 0, len(%s))\n", vals, g.typeName(m.Elem()), v)
+	fmt.Fprintf(w, "for k, e := range %s {\n%[2]s = append(%[2]s, k)\n%[3]s = append(%[3]s, e)\n}\n", v, keys, vals)
+	fmt.Fprintf(w, "var %s []byte\n%s := make([]int, len(%s))\n", kb, ends, keys)
+	fmt.Fprintf(w, "for %s := range %s {\n", i, keys)
+	if err := g.encode(w, kb, keys+"["+i+"]", m.Key(), o.elem()); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s[%s] = len(%s)\n}\n", ends, i, kb)
+	fmt.Fprintf(w, "for _, %s := range stgenSortKeys(%s, %s) {\n", i, kb, ends)
+	fmt.Fprintf(w, "%[1]s = append(%[1]s, stgenKey(%[2]s, %[3]s, %[4]s)...)\n", buf, kb, ends, i)
+	if err := g.encode(w, buf, vals+"["+i+"]", m.Elem(), o.elem()); err != nil {
+		return err
+	}
+	w.WriteString("}\n")
+	return nil
+}
@@ -0,0 +1,80 @@
+// Package example has types with methods generated by structtools-gen.
+// The generated tests check that they write the same bytes as the Encoder.
+package example
+
+import (
+	"io"
+	"time"
+)
+
+//go:generate go run .. -presence pointer
+
+// Order uses most of the tag options
+type Order struct {
+	ID    uint32
+	Items []Item
+	Note  *string
+	Tags  map[string]int16
+	When  time.Time
+	Code  string `bin:",size=4,pad=space"`
+	Flags struct {
+		Paid   bool  `bin:",bits=1"`
+		Status uint8 `bin:",bits=3"`
+		Delta  int8  `bin:",bits=4,lsb"`
+	}
+	Name   string `bin:",cstr"`
+	Label  string `bin:",size=8,cstr"`
+	Raw    []byte `bin:",len=u16"`
+	Key    []byte `bin:",size=6"`
+	Sum    [4]byte
+	Parts  [2]complex64     `bin:",le"`
+	Scores map[Kind][]int32 `bin:",varint,len=u8"`
+	First  uint64           `bin:",order=-1,varint"`
+	Ratio  float32
+	Stamp  Stamp
+	Record *Record
+	Labels Labels
+	Hidden int `bin:",omit"`
+	secret int
+}
+
+// Item is recursive
+type Item struct {
+	Sku   string
+	Qty   int16 `bin:",varint"`
+	Price float64
+	Parts []Item
+	Next  *Item
+}
+
+// Record has numbered fields
+type Record struct {
+	A uint16 `bin:",id=1"`
+	B string `bin:",id=2"`
+	C []Kind `bin:",id=3"`
+	D *struct {
+		X, Y int32
+	} `bin:",id=4"`
+}
+
+// Kind is written like its underlying type
+type Kind uint8
+
+// Labels is written like its underlying type
+type Labels []string
+
+// Stamp marshals itself, as a little endian uint32
+type Stamp uint32
+
+// MarshalBinary implements the Marshaler interface of the structtools package
+func (s Stamp) MarshalBinary(w io.Writer) (int, error) {
+	return w.Write([]byte{byte(s), byte(s >> 8), byte(s >> 16), byte(s >> 24)})
+}
+
+// UnmarshalBinary implements the Unmarshaler interface of the structtools package
+func (s *Stamp) UnmarshalBinary(r io.Reader) (int, error) {
+	var b [4]byte
+	n, err := io.ReadFull(r, b[:])
+	*s = Stamp(b[0]) | Stamp(b[1])<<8 | Stamp(b[2])<<16 | Stamp(b[3])<<24
+	return n, err
+}
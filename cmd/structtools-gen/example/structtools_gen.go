@@ -0,0 +1,958 @@
+// Code generated by "structtools-gen -presence pointer"; DO NOT EDIT.
+
+package example
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// MarshalBinary implements the Marshaler interface of the structtools package
+func (x Item) MarshalBinary(w io.Writer) (int, error) {
+	b, err := x.stgenAppend(nil)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(b)
+}
+
+// UnmarshalBinary implements the Unmarshaler interface of the structtools package
+func (x *Item) UnmarshalBinary(r io.Reader) (int, error) {
+	d := &stgenReader{r: r}
+	err := x.stgenDecode(d)
+	if err == io.EOF && d.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return d.n, err
+}
+
+func (x *Item) stgenAppend(b []byte) (_ []byte, err error) {
+	if b, err = stgenPutLen(b, len(x.Sku), 4, binary.BigEndian); err != nil {
+		return b, err
+	}
+	b = append(b, x.Sku...)
+	b = binary.AppendVarint(b, int64(x.Qty))
+	b = binary.BigEndian.AppendUint64(b, math.Float64bits(x.Price))
+	if b, err = stgenPutLen(b, len(x.Parts), 4, binary.BigEndian); err != nil {
+		return b, err
+	}
+	for i1 := range x.Parts {
+		if b, err = x.Parts[i1].stgenAppend(b); err != nil {
+			return b, err
+		}
+	}
+	if x.Next == nil {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+		if b, err = (*x.Next).stgenAppend(b); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (x *Item) stgenDecode(d *stgenReader) (err error) {
+	if n, err := d.length(4, binary.BigEndian); err != nil {
+		return err
+	} else if p, err := d.read(n); err != nil {
+		return err
+	} else {
+		x.Sku = string(p)
+	}
+	if n, err := d.varint(); err != nil {
+		return err
+	} else if int64(int16(n)) != n {
+		return fmt.Errorf("%d overflows int16", n)
+	} else {
+		x.Qty = int16(n)
+	}
+	if n, err := d.uint64(binary.BigEndian); err != nil {
+		return err
+	} else {
+		x.Price = math.Float64frombits(n)
+	}
+	if n2, err := d.length(4, binary.BigEndian); err != nil {
+		return err
+	} else {
+		x.Parts = make([]Item, 0, stgenCap(n2))
+		for i3 := 0; i3 < n2; i3++ {
+			var e4 Item
+			if err = e4.stgenDecode(d); err != nil {
+				return err
+			}
+			x.Parts = append(x.Parts, e4)
+		}
+	}
+	if ok, err := d.presence(); err != nil {
+		return err
+	} else if !ok {
+		x.Next = nil
+	} else {
+		if x.Next == nil {
+			x.Next = new(Item)
+		}
+		if err = (*x.Next).stgenDecode(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalBinary implements the Marshaler interface of the structtools package
+func (x Order) MarshalBinary(w io.Writer) (int, error) {
+	b, err := x.stgenAppend(nil)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(b)
+}
+
+// UnmarshalBinary implements the Unmarshaler interface of the structtools package
+func (x *Order) UnmarshalBinary(r io.Reader) (int, error) {
+	d := &stgenReader{r: r}
+	err := x.stgenDecode(d)
+	if err == io.EOF && d.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return d.n, err
+}
+
+func (x *Order) stgenAppend(b []byte) (_ []byte, err error) {
+	b = binary.AppendUvarint(b, x.First)
+	b = binary.BigEndian.AppendUint32(b, x.ID)
+	if b, err = stgenPutLen(b, len(x.Items), 4, binary.BigEndian); err != nil {
+		return b, err
+	}
+	for i5 := range x.Items {
+		if b, err = x.Items[i5].stgenAppend(b); err != nil {
+			return b, err
+		}
+	}
+	if x.Note == nil {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+		if b, err = stgenPutLen(b, len((*x.Note)), 4, binary.BigEndian); err != nil {
+			return b, err
+		}
+		b = append(b, (*x.Note)...)
+	}
+	if b, err = stgenPutLen(b, len(x.Tags), 4, binary.BigEndian); err != nil {
+		return b, err
+	}
+	keys6 := make([]string, 0, len(x.Tags))
+	vals7 := make([]int16, 0, len(x.Tags))
+	for k, e := range x.Tags {
+		keys6 = append(keys6, k)
+		vals7 = append(vals7, e)
+	}
+	var kb8 []byte
+	ends9 := make([]int, len(keys6))
+	for i10 := range keys6 {
+		if kb8, err = stgenPutLen(kb8, len(keys6[i10]), 4, binary.BigEndian); err != nil {
+			return b, err
+		}
+		kb8 = append(kb8, keys6[i10]...)
+		ends9[i10] = len(kb8)
+	}
+	for _, i10 := range stgenSortKeys(kb8, ends9) {
+		b = append(b, stgenKey(kb8, ends9, i10)...)
+		b = binary.BigEndian.AppendUint16(b, uint16(vals7[i10]))
+	}
+	{
+		p, err := x.When.MarshalBinary()
+		if err != nil {
+			return b, err
+		}
+		if b, err = stgenPutLen(b, len(p), 4, binary.BigEndian); err != nil {
+			return b, err
+		}
+		b = append(b, p...)
+	}
+	if b, err = stgenPutPadded(b, x.Code, 4, 32, false); err != nil {
+		return b, err
+	}
+	var bits11 [1]byte
+	if x.Flags.Paid {
+		stgenPutBits(bits11[:], 0, 1, 1, false)
+	}
+	if n := uint64(x.Flags.Status); n>>3 != 0 {
+		return b, fmt.Errorf("%d doesn't fit in 3 bits", n)
+	}
+	stgenPutBits(bits11[:], 1, 3, uint64(x.Flags.Status), false)
+	b = append(b, bits11[:]...)
+	var bits12 [1]byte
+	if n := int64(x.Flags.Delta); n < -8 || n > 7 {
+		return b, fmt.Errorf("%d doesn't fit in 4 bits", n)
+	}
+	stgenPutBits(bits12[:], 0, 4, uint64(x.Flags.Delta)&0xf, true)
+	b = append(b, bits12[:]...)
+	if b, err = stgenPutCString(b, x.Name); err != nil {
+		return b, err
+	}
+	if b, err = stgenPutPadded(b, x.Label, 8, 0, true); err != nil {
+		return b, err
+	}
+	if b, err = stgenPutLen(b, len(x.Raw), 2, binary.BigEndian); err != nil {
+		return b, err
+	}
+	b = append(b, x.Raw...)
+	if b, err = stgenPutPadded(b, string(x.Key), 6, 0, false); err != nil {
+		return b, err
+	}
+	for i13 := range x.Sum {
+		b = append(b, byte(x.Sum[i13]))
+	}
+	for i14 := range x.Parts {
+		b = binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(b, math.Float32bits(real(x.Parts[i14]))), math.Float32bits(imag(x.Parts[i14])))
+	}
+	if b, err = stgenPutLen(b, len(x.Scores), 1, binary.BigEndian); err != nil {
+		return b, err
+	}
+	keys15 := make([]Kind, 0, len(x.Scores))
+	vals16 := make([][]int32, 0, len(x.Scores))
+	for k, e := range x.Scores {
+		keys15 = append(keys15, k)
+		vals16 = append(vals16, e)
+	}
+	var kb17 []byte
+	ends18 := make([]int, len(keys15))
+	for i19 := range keys15 {
+		kb17 = append(kb17, byte(keys15[i19]))
+		ends18[i19] = len(kb17)
+	}
+	for _, i19 := range stgenSortKeys(kb17, ends18) {
+		b = append(b, stgenKey(kb17, ends18, i19)...)
+		if b, err = stgenPutLen(b, len(vals16[i19]), 1, binary.BigEndian); err != nil {
+			return b, err
+		}
+		for i20 := range vals16[i19] {
+			b = binary.AppendVarint(b, int64(vals16[i19][i20]))
+		}
+	}
+	b = binary.BigEndian.AppendUint32(b, math.Float32bits(x.Ratio))
+	{
+		w := stgenBuffer(b)
+		if _, err = x.Stamp.MarshalBinary(&w); err != nil {
+			return b, err
+		}
+		b = w
+	}
+	if x.Record == nil {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+		if b, err = (*x.Record).stgenAppend(b); err != nil {
+			return b, err
+		}
+	}
+	if b, err = stgenPutLen(b, len(x.Labels), 4, binary.BigEndian); err != nil {
+		return b, err
+	}
+	for i21 := range x.Labels {
+		if b, err = stgenPutLen(b, len(x.Labels[i21]), 4, binary.BigEndian); err != nil {
+			return b, err
+		}
+		b = append(b, x.Labels[i21]...)
+	}
+	return b, nil
+}
+
+func (x *Order) stgenDecode(d *stgenReader) (err error) {
+	if n, err := d.uvarint(); err != nil {
+		return err
+	} else {
+		x.First = n
+	}
+	if n, err := d.uint32(binary.BigEndian); err != nil {
+		return err
+	} else {
+		x.ID = n
+	}
+	if n22, err := d.length(4, binary.BigEndian); err != nil {
+		return err
+	} else {
+		x.Items = make([]Item, 0, stgenCap(n22))
+		for i23 := 0; i23 < n22; i23++ {
+			var e24 Item
+			if err = e24.stgenDecode(d); err != nil {
+				return err
+			}
+			x.Items = append(x.Items, e24)
+		}
+	}
+	if ok, err := d.presence(); err != nil {
+		return err
+	} else if !ok {
+		x.Note = nil
+	} else {
+		if x.Note == nil {
+			x.Note = new(string)
+		}
+		if n, err := d.length(4, binary.BigEndian); err != nil {
+			return err
+		} else if p, err := d.read(n); err != nil {
+			return err
+		} else {
+			(*x.Note) = string(p)
+		}
+	}
+	if n25, err := d.length(4, binary.BigEndian); err != nil {
+		return err
+	} else {
+		x.Tags = make(map[string]int16)
+		for i26 := 0; i26 < n25; i26++ {
+			var k27 string
+			var e28 int16
+			if n, err := d.length(4, binary.BigEndian); err != nil {
+				return err
+			} else if p, err := d.read(n); err != nil {
+				return err
+			} else {
+				k27 = string(p)
+			}
+			if n, err := d.uint16(binary.BigEndian); err != nil {
+				return err
+			} else {
+				e28 = int16(n)
+			}
+			x.Tags[k27] = e28
+		}
+	}
+	{
+		n, err := d.length(4, binary.BigEndian)
+		if err != nil {
+			return err
+		}
+		p, err := d.bytes(n)
+		if err != nil {
+			return err
+		}
+		if err := x.When.UnmarshalBinary(p); err != nil {
+			return err
+		}
+	}
+	if p, err := d.padded(4, 32, false); err != nil {
+		return err
+	} else {
+		x.Code = string(p)
+	}
+	if p, err := d.read(1); err != nil {
+		return err
+	} else {
+		x.Flags.Paid = stgenGetBits(p, 0, 1, false) != 0
+		x.Flags.Status = uint8(stgenGetBits(p, 1, 3, false))
+	}
+	if p, err := d.read(1); err != nil {
+		return err
+	} else {
+		x.Flags.Delta = int8(int64(stgenGetBits(p, 0, 4, true)<<60) >> 60)
+	}
+	if p, err := d.cstring(); err != nil {
+		return err
+	} else {
+		x.Name = string(p)
+	}
+	if p, err := d.padded(8, 0, true); err != nil {
+		return err
+	} else {
+		x.Label = string(p)
+	}
+	if n, err := d.length(2, binary.BigEndian); err != nil {
+		return err
+	} else if p, err := d.bytes(n); err != nil {
+		return err
+	} else {
+		x.Raw = p
+	}
+	if p, err := d.padded(6, 0, false); err != nil {
+		return err
+	} else {
+		x.Key = append([]byte{}, p...)
+	}
+	for i29 := range x.Sum {
+		if n, err := d.uint8(); err != nil {
+			return err
+		} else {
+			x.Sum[i29] = n
+		}
+	}
+	for i30 := range x.Parts {
+		if p, err := d.read(8); err != nil {
+			return err
+		} else {
+			x.Parts[i30] = complex(math.Float32frombits(binary.LittleEndian.Uint32(p)), math.Float32frombits(binary.LittleEndian.Uint32(p[4:])))
+		}
+	}
+	if n31, err := d.length(1, binary.BigEndian); err != nil {
+		return err
+	} else {
+		x.Scores = make(map[Kind][]int32)
+		for i32 := 0; i32 < n31; i32++ {
+			var k33 Kind
+			var e34 []int32
+			if n, err := d.uint8(); err != nil {
+				return err
+			} else {
+				k33 = Kind(n)
+			}
+			if n35, err := d.length(1, binary.BigEndian); err != nil {
+				return err
+			} else {
+				e34 = make([]int32, 0, stgenCap(n35))
+				for i36 := 0; i36 < n35; i36++ {
+					var e37 int32
+					if n, err := d.varint(); err != nil {
+						return err
+					} else if int64(int32(n)) != n {
+						return fmt.Errorf("%d overflows int32", n)
+					} else {
+						e37 = int32(n)
+					}
+					e34 = append(e34, e37)
+				}
+			}
+			x.Scores[k33] = e34
+		}
+	}
+	if n, err := d.uint32(binary.BigEndian); err != nil {
+		return err
+	} else {
+		x.Ratio = math.Float32frombits(n)
+	}
+	if _, err = x.Stamp.UnmarshalBinary(d); err != nil {
+		return err
+	}
+	if ok, err := d.presence(); err != nil {
+		return err
+	} else if !ok {
+		x.Record = nil
+	} else {
+		if x.Record == nil {
+			x.Record = new(Record)
+		}
+		if err = (*x.Record).stgenDecode(d); err != nil {
+			return err
+		}
+	}
+	if n38, err := d.length(4, binary.BigEndian); err != nil {
+		return err
+	} else {
+		x.Labels = make(Labels, 0, stgenCap(n38))
+		for i39 := 0; i39 < n38; i39++ {
+			var e40 string
+			if n, err := d.length(4, binary.BigEndian); err != nil {
+				return err
+			} else if p, err := d.read(n); err != nil {
+				return err
+			} else {
+				e40 = string(p)
+			}
+			x.Labels = append(x.Labels, e40)
+		}
+	}
+	return nil
+}
+
+// MarshalBinary implements the Marshaler interface of the structtools package
+func (x Record) MarshalBinary(w io.Writer) (int, error) {
+	b, err := x.stgenAppend(nil)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(b)
+}
+
+// UnmarshalBinary implements the Unmarshaler interface of the structtools package
+func (x *Record) UnmarshalBinary(r io.Reader) (int, error) {
+	d := &stgenReader{r: r}
+	err := x.stgenDecode(d)
+	if err == io.EOF && d.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return d.n, err
+}
+
+func (x *Record) stgenAppend(b []byte) (_ []byte, err error) {
+	b = binary.AppendUvarint(b, 1)
+	start41 := len(b)
+	b = binary.BigEndian.AppendUint16(b, x.A)
+	b = stgenInsertLen(b, start41)
+	b = binary.AppendUvarint(b, 2)
+	start42 := len(b)
+	if b, err = stgenPutLen(b, len(x.B), 4, binary.BigEndian); err != nil {
+		return b, err
+	}
+	b = append(b, x.B...)
+	b = stgenInsertLen(b, start42)
+	b = binary.AppendUvarint(b, 3)
+	start43 := len(b)
+	if b, err = stgenPutLen(b, len(x.C), 4, binary.BigEndian); err != nil {
+		return b, err
+	}
+	b = append(b, string(x.C)...)
+	b = stgenInsertLen(b, start43)
+	b = binary.AppendUvarint(b, 4)
+	start44 := len(b)
+	if x.D == nil {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+		b = binary.BigEndian.AppendUint32(b, uint32((*x.D).X))
+		b = binary.BigEndian.AppendUint32(b, uint32((*x.D).Y))
+	}
+	b = stgenInsertLen(b, start44)
+	b = append(b, 0)
+	return b, nil
+}
+
+func (x *Record) stgenDecode(d *stgenReader) (err error) {
+	for first := true; ; first = false {
+		id, err := d.uvarint()
+		if err != nil {
+			if err == io.EOF && !first {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if id == 0 {
+			break
+		}
+		n, err := d.fieldLength()
+		if err != nil {
+			return err
+		}
+		start := d.n
+		switch id {
+		case 1:
+			if n, err := d.uint16(binary.BigEndian); err != nil {
+				return err
+			} else {
+				x.A = n
+			}
+		case 2:
+			if n, err := d.length(4, binary.BigEndian); err != nil {
+				return err
+			} else if p, err := d.read(n); err != nil {
+				return err
+			} else {
+				x.B = string(p)
+			}
+		case 3:
+			if n, err := d.length(4, binary.BigEndian); err != nil {
+				return err
+			} else if p, err := d.bytes(n); err != nil {
+				return err
+			} else {
+				x.C = make([]Kind, len(p))
+				for i, c := range p {
+					x.C[i] = Kind(c)
+				}
+			}
+		case 4:
+			if ok, err := d.presence(); err != nil {
+				return err
+			} else if !ok {
+				x.D = nil
+			} else {
+				if x.D == nil {
+					x.D = new(struct {
+						X int32
+						Y int32
+					})
+				}
+				if n, err := d.uint32(binary.BigEndian); err != nil {
+					return err
+				} else {
+					(*x.D).X = int32(n)
+				}
+				if n, err := d.uint32(binary.BigEndian); err != nil {
+					return err
+				} else {
+					(*x.D).Y = int32(n)
+				}
+			}
+		}
+		if err := d.skipRest(n, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stgenBuffer is the io.Writer given to custom marshalers
+type stgenBuffer []byte
+
+func (b *stgenBuffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+// stgenPutLen appends the length prefix of a string, slice or map.
+// A width of 0 is a varint
+func stgenPutLen(b []byte, n int, width int, bo binary.AppendByteOrder) ([]byte, error) {
+	switch width {
+	case 0:
+		return binary.AppendUvarint(b, uint64(n)), nil
+	case 1:
+		if n > math.MaxUint8 {
+			return b, fmt.Errorf("length %d doesn't fit in a uint8 prefix", n)
+		}
+		return append(b, byte(n)), nil
+	case 2:
+		if n > math.MaxUint16 {
+			return b, fmt.Errorf("length %d doesn't fit in a uint16 prefix", n)
+		}
+		return bo.AppendUint16(b, uint16(n)), nil
+	case 8:
+		return bo.AppendUint64(b, uint64(n)), nil
+	}
+	if uint64(n) > math.MaxUint32 {
+		return b, fmt.Errorf("length %d doesn't fit in a uint32 prefix", n)
+	}
+	return bo.AppendUint32(b, uint32(n)), nil
+}
+
+// stgenPutPadded appends s padded to size
+func stgenPutPadded(b []byte, s string, size int, pad byte, cstr bool) ([]byte, error) {
+	max := size
+	if cstr {
+		// room for the NUL
+		max--
+		if strings.IndexByte(s, 0) >= 0 {
+			return b, fmt.Errorf("C string contains a NUL byte")
+		}
+	}
+	if len(s) > max {
+		return b, fmt.Errorf("%d bytes don't fit in size %d", len(s), size)
+	}
+	n := len(b) + size
+	b = append(b, s...)
+	if cstr {
+		b = append(b, 0)
+	}
+	for len(b) < n {
+		b = append(b, pad)
+	}
+	return b, nil
+}
+
+// stgenPutCString appends s followed by a NUL
+func stgenPutCString(b []byte, s string) ([]byte, error) {
+	if strings.IndexByte(s, 0) >= 0 {
+		return b, fmt.Errorf("C string contains a NUL byte")
+	}
+	return append(append(b, s...), 0), nil
+}
+
+func stgenPutBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// stgenPutBits sets bits bits of p at the bit position pos to n
+func stgenPutBits(p []byte, pos, bits uint, n uint64, lsb bool) {
+	for i := uint(0); i < bits; i++ {
+		q := pos + i
+		if lsb {
+			p[q/8] |= byte(n>>i&1) << (q % 8)
+		} else {
+			p[q/8] |= byte(n>>(bits-1-i)&1) << (7 - q%8)
+		}
+	}
+}
+
+// stgenGetBits returns the bits bits of p at the bit position pos
+func stgenGetBits(p []byte, pos, bits uint, lsb bool) uint64 {
+	var n uint64
+	for i := uint(0); i < bits; i++ {
+		q := pos + i
+		if lsb {
+			n |= uint64(p[q/8]>>(q%8)&1) << i
+		} else {
+			n |= uint64(p[q/8]>>(7-q%8)&1) << (bits - 1 - i)
+		}
+	}
+	return n
+}
+
+// stgenInsertLen inserts the length of b[pos:] at pos, as a varint
+func stgenInsertLen(b []byte, pos int) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(b)-pos))
+	b = append(b, l[:n]...)
+	copy(b[pos+n:], b[pos:len(b)-n])
+	copy(b[pos:], l[:n])
+	return b
+}
+
+// stgenKeys sorts the keys of a map by their encoded bytes
+type stgenKeys struct {
+	order   []int
+	encoded [][]byte
+}
+
+func (k *stgenKeys) Len() int           { return len(k.order) }
+func (k *stgenKeys) Less(i, j int) bool { return bytes.Compare(k.encoded[i], k.encoded[j]) < 0 }
+func (k *stgenKeys) Swap(i, j int) {
+	k.order[i], k.order[j] = k.order[j], k.order[i]
+	k.encoded[i], k.encoded[j] = k.encoded[j], k.encoded[i]
+}
+
+// stgenSortKeys returns the order of the keys encoded in kb,
+// where key i ends at ends[i]
+func stgenSortKeys(kb []byte, ends []int) []int {
+	k := &stgenKeys{order: make([]int, len(ends)), encoded: make([][]byte, len(ends))}
+	for i := range ends {
+		k.order[i], k.encoded[i] = i, stgenKey(kb, ends, i)
+	}
+	sort.Sort(k)
+	return k.order
+}
+
+// stgenKey returns key i of the keys encoded in kb
+func stgenKey(kb []byte, ends []int, i int) []byte {
+	if i == 0 {
+		return kb[:ends[0]]
+	}
+	return kb[ends[i-1]:ends[i]]
+}
+
+// stgenChunk is the most allocated for a slice before reading
+// its elements, so corrupted lengths fail before allocating them
+const stgenChunk = 1 << 16
+
+func stgenCap(n int) int {
+	if n > stgenChunk {
+		return stgenChunk
+	}
+	return n
+}
+
+// stgenReader counts the bytes read from r
+type stgenReader struct {
+	r   io.Reader
+	n   int
+	buf [16]byte
+}
+
+func (d *stgenReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.n += n
+	return n, err
+}
+
+// read returns the next n bytes. Unless n is large, they're
+// only valid until the next read
+func (d *stgenReader) read(n int) ([]byte, error) {
+	if n > len(d.buf) {
+		return d.bytes(n)
+	}
+	p := d.buf[:n]
+	if _, err := io.ReadFull(d, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// bytes returns the next n bytes in a new slice
+func (d *stgenReader) bytes(n int) ([]byte, error) {
+	p := make([]byte, 0, stgenCap(n))
+	for len(p) < n {
+		c := stgenCap(n - len(p))
+		p = append(p, make([]byte, c)...)
+		if _, err := io.ReadFull(d, p[len(p)-c:]); err != nil {
+			if err == io.EOF && len(p) > c {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (d *stgenReader) uint8() (uint8, error) {
+	p, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+func (d *stgenReader) uint16(bo binary.ByteOrder) (uint16, error) {
+	p, err := d.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint16(p), nil
+}
+
+func (d *stgenReader) uint32(bo binary.ByteOrder) (uint32, error) {
+	p, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint32(p), nil
+}
+
+func (d *stgenReader) uint64(bo binary.ByteOrder) (uint64, error) {
+	p, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint64(p), nil
+}
+
+func (d *stgenReader) uvarint() (uint64, error) {
+	var (
+		n uint64
+		s uint
+	)
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b, err := d.uint8()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				return 0, fmt.Errorf("varint overflows a 64-bit integer")
+			}
+			return n | uint64(b)<<s, nil
+		}
+		n |= uint64(b&0x7f) << s
+		s += 7
+	}
+	return 0, fmt.Errorf("varint overflows a 64-bit integer")
+}
+
+func (d *stgenReader) varint() (int64, error) {
+	un, err := d.uvarint()
+	n := int64(un >> 1)
+	if un&1 != 0 {
+		n = ^n
+	}
+	return n, err
+}
+
+// length reads the length prefix of a string, slice or map
+func (d *stgenReader) length(width int, bo binary.ByteOrder) (int, error) {
+	var (
+		n   uint64
+		err error
+	)
+	switch width {
+	case 0:
+		n, err = d.uvarint()
+	case 1:
+		var n8 uint8
+		n8, err = d.uint8()
+		n = uint64(n8)
+	case 2:
+		var n16 uint16
+		n16, err = d.uint16(bo)
+		n = uint64(n16)
+	case 8:
+		n, err = d.uint64(bo)
+	default:
+		var n32 uint32
+		n32, err = d.uint32(bo)
+		n = uint64(n32)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(int(^uint(0)>>1)) {
+		return 0, fmt.Errorf("length %d overflows an int", n)
+	}
+	return int(n), nil
+}
+
+// padded reads size bytes and trims the padding
+func (d *stgenReader) padded(size int, pad byte, cstr bool) ([]byte, error) {
+	p, err := d.read(size)
+	if err != nil {
+		return nil, err
+	}
+	if cstr {
+		if i := bytes.IndexByte(p, 0); i >= 0 {
+			return p[:i], nil
+		}
+		return nil, fmt.Errorf("C string isn't NUL terminated")
+	}
+	return bytes.TrimRight(p, string(pad)), nil
+}
+
+// cstring reads a NUL terminated string, without the NUL
+func (d *stgenReader) cstring() ([]byte, error) {
+	var s []byte
+	for {
+		b, err := d.uint8()
+		if err != nil {
+			if err == io.EOF && len(s) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if b == 0 {
+			return s, nil
+		}
+		s = append(s, b)
+	}
+}
+
+// presence reads a presence byte
+func (d *stgenReader) presence() (bool, error) {
+	b, err := d.uint8()
+	if err != nil {
+		return false, err
+	}
+	switch b {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid presence byte %d", b)
+}
+
+// fieldLength reads the length of a numbered field
+func (d *stgenReader) fieldLength() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if n > uint64(int(^uint(0)>>1)) {
+		return 0, fmt.Errorf("length %d overflows an int", n)
+	}
+	return int(n), nil
+}
+
+// skipRest skips what's left of a field of n bytes that started at
+// the offset start, a newer version of its type may have written more
+func (d *stgenReader) skipRest(n, start int) error {
+	used := d.n - start
+	if used > n {
+		return fmt.Errorf("value of %d bytes is longer than its length %d", used, n)
+	}
+	if _, err := d.bytes(n - used); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// Code generated by "structtools-gen -presence pointer"; DO NOT EDIT.
+
+package example
+
+import (
+	"bytes"
+	"github.com/heliorosa/structtools"
+	"reflect"
+	"testing"
+)
+
+// stgenPlainItem is marshaled by the Encoder using reflection
+type stgenPlainItem Item
+
+func TestStructtoolsItem(t *testing.T) {
+	v := stgenSampleItem(0)
+	want := &bytes.Buffer{}
+	enc := structtools.NewEncoder(want)
+	enc.Presence = structtools.PointerPresence
+	if err := enc.Encode(stgenPlainItem(v)); err != nil {
+		t.Fatal(err)
+	}
+	got := &bytes.Buffer{}
+	if n, err := v.MarshalBinary(got); err != nil || n != got.Len() {
+		t.Fatal(n, err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("got %x, want %x", got.Bytes(), want.Bytes())
+	}
+
+	var out Item
+	n, err := out.UnmarshalBinary(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain stgenPlainItem
+	dec := structtools.NewDecoder(bytes.NewReader(want.Bytes()))
+	dec.Presence = structtools.PointerPresence
+	if err := dec.Decode(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if n != want.Len() {
+		t.Fatalf("read %d bytes of %d", n, want.Len())
+	}
+	if !reflect.DeepEqual(out, Item(plain)) {
+		t.Fatalf("got %+v, want %+v", out, plain)
+	}
+}
+
+func stgenSampleItem(depth int) (x Item) {
+	x.Sku = "qq"
+	x.Qty = 17
+	x.Price = 18.5
+	x.Parts = make([]Item, 0)
+	if depth < 2 {
+		x.Parts = make([]Item, 2)
+	}
+	for i49 := range x.Parts {
+		x.Parts[i49] = stgenSampleItem(depth + 1)
+	}
+	if depth < 2 {
+		x.Next = new(Item)
+		(*x.Next) = stgenSampleItem(depth + 1)
+	}
+	return x
+}
+
+// stgenPlainOrder is marshaled by the Encoder using reflection
+type stgenPlainOrder Order
+
+func TestStructtoolsOrder(t *testing.T) {
+	v := stgenSampleOrder(0)
+	want := &bytes.Buffer{}
+	enc := structtools.NewEncoder(want)
+	enc.Presence = structtools.PointerPresence
+	if err := enc.Encode(stgenPlainOrder(v)); err != nil {
+		t.Fatal(err)
+	}
+	got := &bytes.Buffer{}
+	if n, err := v.MarshalBinary(got); err != nil || n != got.Len() {
+		t.Fatal(n, err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("got %x, want %x", got.Bytes(), want.Bytes())
+	}
+
+	var out Order
+	n, err := out.UnmarshalBinary(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain stgenPlainOrder
+	dec := structtools.NewDecoder(bytes.NewReader(want.Bytes()))
+	dec.Presence = structtools.PointerPresence
+	if err := dec.Decode(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if n != want.Len() {
+		t.Fatalf("read %d bytes of %d", n, want.Len())
+	}
+	if !reflect.DeepEqual(out, Order(plain)) {
+		t.Fatalf("got %+v, want %+v", out, plain)
+	}
+}
+
+func stgenSampleOrder(depth int) (x Order) {
+	x.First = 22
+	x.ID = 23
+	x.Items = make([]Item, 0)
+	if depth < 2 {
+		x.Items = make([]Item, 2)
+	}
+	for i54 := range x.Items {
+		x.Items[i54] = stgenSampleItem(depth + 1)
+	}
+	x.Note = new(string)
+	(*x.Note) = "bb"
+	x.Tags = make(map[string]int16)
+	{
+		var k58 string
+		k58 = "bb"
+		var e59 int16
+		e59 = 2
+		x.Tags[k58] = e59
+	}
+	{
+		var k62 string
+		k62 = "ff"
+		var e63 int16
+		e63 = 6
+		x.Tags[k62] = e63
+	}
+	x.Code = "hh"
+	x.Flags.Paid = true
+	x.Flags.Status = 1
+	x.Flags.Delta = -1
+	x.Name = "jj"
+	x.Label = "kk"
+	x.Raw = make([]byte, 0)
+	x.Raw = make([]byte, 2)
+	for i71 := range x.Raw {
+		x.Raw[i71] = 13
+	}
+	x.Key = make([]byte, 0)
+	x.Key = make([]byte, 2)
+	for i74 := range x.Key {
+		x.Key[i74] = 16
+	}
+	for i77 := range x.Sum {
+		x.Sum[i77] = 19
+	}
+	for i80 := range x.Parts {
+		x.Parts[i80] = 22 + 1i
+	}
+	x.Scores = make(map[Kind][]int32)
+	{
+		var k83 Kind
+		k83 = 26
+		var e84 []int32
+		e84 = make([]int32, 0)
+		e84 = make([]int32, 2)
+		for i87 := range e84 {
+			e84[i87] = 29
+		}
+		x.Scores[k83] = e84
+	}
+	{
+		var k89 Kind
+		k89 = 2
+		var e90 []int32
+		e90 = make([]int32, 0)
+		e90 = make([]int32, 2)
+		for i93 := range e90 {
+			e90[i93] = 5
+		}
+		x.Scores[k89] = e90
+	}
+	x.Ratio = 6.5
+	if depth < 2 {
+		x.Record = new(Record)
+		(*x.Record) = stgenSampleRecord(depth + 1)
+	}
+	x.Labels = make(Labels, 0)
+	x.Labels = make(Labels, 2)
+	for i98 := range x.Labels {
+		x.Labels[i98] = "kk"
+	}
+	return x
+}
+
+// stgenPlainRecord is marshaled by the Encoder using reflection
+type stgenPlainRecord Record
+
+func TestStructtoolsRecord(t *testing.T) {
+	v := stgenSampleRecord(0)
+	want := &bytes.Buffer{}
+	enc := structtools.NewEncoder(want)
+	enc.Presence = structtools.PointerPresence
+	if err := enc.Encode(stgenPlainRecord(v)); err != nil {
+		t.Fatal(err)
+	}
+	got := &bytes.Buffer{}
+	if n, err := v.MarshalBinary(got); err != nil || n != got.Len() {
+		t.Fatal(n, err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("got %x, want %x", got.Bytes(), want.Bytes())
+	}
+
+	var out Record
+	n, err := out.UnmarshalBinary(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain stgenPlainRecord
+	dec := structtools.NewDecoder(bytes.NewReader(want.Bytes()))
+	dec.Presence = structtools.PointerPresence
+	if err := dec.Decode(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if n != want.Len() {
+		t.Fatalf("read %d bytes of %d", n, want.Len())
+	}
+	if !reflect.DeepEqual(out, Record(plain)) {
+		t.Fatalf("got %+v, want %+v", out, plain)
+	}
+}
+
+func stgenSampleRecord(depth int) (x Record) {
+	x.A = 11
+	x.B = "mm"
+	x.C = make([]Kind, 0)
+	x.C = make([]Kind, 2)
+	for i103 := range x.C {
+		x.C[i103] = 15
+	}
+	x.D = new(struct {
+		X int32
+		Y int32
+	})
+	(*x.D).X = 18
+	(*x.D).Y = 19
+	return x
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// config holds the settings of a run
+type config struct {
+	types      []string
+	output     string
+	tests      bool
+	tag        string
+	onlyTagged bool
+	opts       options
+}
+
+// presence modes, like the PresenceMode of the structtools package
+const (
+	presenceNone = iota
+	presencePointer
+	presenceNil
+)
+
+var presenceModes = map[string]int{"none": presenceNone, "pointer": presencePointer, "nil": presenceNil}
+
+// lenWidths maps the length prefix widths to
+// the width argument of the generated helpers
+var lenWidths = map[string]int{"u8": 1, "u16": 2, "u32": 4, "u64": 8, "varint": 0}
+
+// timeFormats are the values of the "time" tag option and
+// if code can be generated for them
+var timeFormats = map[string]bool{"binary": true, "unixnano": false, "unixzone": false}
+
+// options are the settings a value is written with,
+// the codecOptions of the structtools package
+type options struct {
+	le       bool
+	presence int
+	varint   bool
+	lenWidth string
+	time     string
+	// only set by the "size", "pad" and "cstr" tag
+	// options, never inherited by elements
+	size int
+	pad  byte
+	cstr bool
+}
+
+// elem returns the options for the elements of a value
+func (o options) elem() options {
+	o.size, o.pad, o.cstr = 0, 0, false
+	return o
+}
+
+func (o options) byteOrder() string {
+	if o.le {
+		return "binary.LittleEndian"
+	}
+	return "binary.BigEndian"
+}
+
+// lenArgs are the width and byte order arguments of the
+// helpers that write and read length prefixes
+func (o options) lenArgs() string {
+	w := o.lenWidth
+	if w == "" {
+		w = "u32"
+		if o.varint {
+			w = "varint"
+		}
+	}
+	return strconv.Itoa(lenWidths[w]) + ", " + o.byteOrder()
+}
+
+// generator writes the code for the types of a package
+type generator struct {
+	cfg config
+	pkg *types.Package
+	// first error found type checking the package
+	typeErr error
+	// types with generated methods
+	named map[*types.Named]bool
+	// imports of the file being generated, by path
+	imports map[string]string
+	// named types being marshaled inline, to catch recursive types
+	inline []*types.Named
+	// counter for the names of temporary variables and sample values
+	tmp int
+}
+
+// generate returns the source of the methods and their tests
+// for the package in dir. args is written in the header
+func generate(dir string, cfg config, args string) ([]byte, []byte, error) {
+	g := &generator{cfg: cfg, named: make(map[*types.Named]bool)}
+	if err := g.load(dir); err != nil {
+		return nil, nil, err
+	}
+	named, err := g.selectTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, n := range named {
+		g.named[n] = true
+	}
+
+	header := fmt.Sprintf("// Code generated by \"%s\"; DO NOT EDIT.\n\n", strings.TrimSpace("structtools-gen "+args))
+	body := &bytes.Buffer{}
+	g.imports = map[string]string{"encoding/binary": "binary", "bytes": "bytes", "fmt": "fmt",
+		"io": "io", "math": "math", "sort": "sort", "strings": "strings"}
+	for _, n := range named {
+		if err := g.methods(body, n); err != nil {
+			return nil, nil, err
+		}
+	}
+	body.WriteString(helpers)
+	src, err := g.file(header, body.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body.Reset()
+	g.imports = map[string]string{"bytes": "bytes", "reflect": "reflect", "testing": "testing",
+		"github.com/heliorosa/structtools": "structtools"}
+	if cfg.opts.le {
+		g.imports["encoding/binary"] = "binary"
+	}
+	for _, n := range named {
+		g.test(body, n)
+	}
+	testSrc, err := g.file(header, body.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, testSrc, nil
+}
+
+// load parses and type checks the package in dir, without the output file
+func (g *generator) load(dir string) error {
+	bp, err := build.ImportDir(dir, 0)
+	if err != nil {
+		return err
+	}
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, name := range bp.GoFiles {
+		if name == g.cfg.output {
+			continue
+		}
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, 0)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		// the package may use the methods that are
+		// about to be generated, so errors are expected
+		Error: func(err error) {
+			if g.typeErr == nil {
+				g.typeErr = err
+			}
+		},
+	}
+	g.pkg, _ = conf.Check(bp.ImportPath, fset, files, nil)
+	return nil
+}
+
+// selectTypes returns the types to generate methods for
+func (g *generator) selectTypes() ([]*types.Named, error) {
+	scope := g.pkg.Scope()
+	names, explicit := g.cfg.types, len(g.cfg.types) > 0
+	if !explicit {
+		names = scope.Names()
+	}
+	var named []*types.Named
+	for _, name := range names {
+		obj, _ := scope.Lookup(name).(*types.TypeName)
+		if obj == nil {
+			if explicit {
+				return nil, fmt.Errorf("type %s not found", name)
+			}
+			continue
+		}
+		n, _ := obj.Type().(*types.Named)
+		var reason string
+		switch {
+		case n == nil || obj.IsAlias():
+			reason = "isn't a defined type"
+		case !isStruct(n):
+			reason = "isn't a struct"
+		case n.TypeParams().Len() > 0:
+			reason = "is generic"
+		case hasMethod(n, "MarshalBinary") || hasMethod(n, "UnmarshalBinary"):
+			reason = "already has MarshalBinary or UnmarshalBinary methods"
+		}
+		if reason != "" {
+			if explicit {
+				return nil, fmt.Errorf("type %s %s", name, reason)
+			}
+			continue
+		}
+		named = append(named, n)
+	}
+	if len(named) == 0 {
+		return nil, fmt.Errorf("no struct types found in %s", g.pkg.Path())
+	}
+	return named, nil
+}
+
+func isStruct(t types.Type) bool {
+	_, ok := t.Underlying().(*types.Struct)
+	return ok
+}
+
+// hasMethod reports if t or *t has a method called name
+func hasMethod(t types.Type, name string) bool {
+	return types.NewMethodSet(types.NewPointer(t)).Lookup(nil, name) != nil
+}
+
+// file formats a generated file
+func (g *generator) file(header string, body []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%spackage %s\n\nimport (\n", header, g.pkg.Name())
+	paths := make([]string, 0, len(g.imports))
+	for p := range g.imports {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if name := g.imports[p]; name != path.Base(p) {
+			fmt.Fprintf(b, "%s ", name)
+		}
+		fmt.Fprintf(b, "%q\n", p)
+	}
+	b.WriteString(")\n\n")
+	b.Write(body)
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code: %v", err)
+	}
+	return src, nil
+}
+
+// typeName is the name of t in the generated code
+func (g *generator) typeName(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string {
+		if p == g.pkg {
+			return ""
+		}
+		g.imports[p.Path()] = p.Name()
+		return p.Name()
+	})
+}
+
+// reflectName is the name of t in the errors of the structtools package
+func reflectName(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string { return p.Name() })
+}
+
+// convert converts the expression v of type t to the basic type to
+func convert(to, v string, t types.Type) string {
+	if b, ok := t.(*types.Basic); ok && b.Name() == to {
+		return v
+	}
+	return to + "(" + v + ")"
+}
+
+// temp returns a new name for a temporary variable
+func (g *generator) temp(prefix string) string {
+	g.tmp++
+	return prefix + strconv.Itoa(g.tmp)
+}
+
+// signatures of the methods of the marshaler interfaces
+const (
+	marshalerSig         = "(io.Writer) (int, error)"
+	unmarshalerSig       = "(io.Reader) (int, error)"
+	binaryMarshalerSig   = "() ([]byte, error)"
+	binaryUnmarshalerSig = "([]byte) (error)"
+)
+
+// methodSig returns the signature of the method name of t,
+// or of *t if ptr is set. Types with generated methods have them
+func (g *generator) methodSig(t types.Type, name string, ptr bool) string {
+	if n, ok := t.(*types.Named); ok && g.named[n] {
+		switch {
+		case name == "MarshalBinary":
+			return marshalerSig
+		case name == "UnmarshalBinary" && ptr:
+			return unmarshalerSig
+		}
+		return ""
+	}
+	if ptr {
+		t = types.NewPointer(t)
+	}
+	sel := types.NewMethodSet(t).Lookup(nil, name)
+	if sel == nil {
+		return ""
+	}
+	sig := sel.Type().(*types.Signature)
+	tuple := func(t *types.Tuple) string {
+		s := make([]string, t.Len())
+		for i := range s {
+			s[i] = t.At(i).Type().String()
+		}
+		return strings.Join(s, ", ")
+	}
+	return "(" + tuple(sig.Params()) + ") (" + tuple(sig.Results()) + ")"
+}
+
+// isMarshaler reports if t or *t implements Marshaler
+func (g *generator) isMarshaler(t types.Type) bool {
+	return g.methodSig(t, "MarshalBinary", true) == marshalerSig
+}
+
+// isUnmarshaler reports if *t implements Unmarshaler
+func (g *generator) isUnmarshaler(t types.Type) bool {
+	return g.methodSig(t, "UnmarshalBinary", true) == unmarshalerSig
+}
+
+// isBinaryMarshaler reports if *t implements encoding.BinaryMarshaler
+// and encoding.BinaryUnmarshaler
+func (g *generator) isBinaryMarshaler(t types.Type) bool {
+	return g.methodSig(t, "MarshalBinary", true) == binaryMarshalerSig &&
+		g.methodSig(t, "UnmarshalBinary", true) == binaryUnmarshalerSig
+}
+
+// hasMarshaler reports if values of type t marshal themselves
+func (g *generator) hasMarshaler(t types.Type) bool {
+	return g.isMarshaler(t) || g.isBinaryMarshaler(t)
+}
+
+// isPaddedBytes reports if the slice s is padded like a string
+// when its size is fixed
+func (g *generator) isPaddedBytes(s *types.Slice) bool {
+	return isUint8(s.Elem()) && !g.hasMarshaler(s.Elem()) && !g.isUnmarshaler(s.Elem())
+}
+
+// isByte reports if t is byte or uint8, not a named type
+func isByte(t types.Type) bool {
+	b, ok := t.(*types.Basic)
+	return ok && b.Kind() == types.Uint8
+}
+
+// unsupported returns an error if values of type t can't be handled
+func (g *generator) unsupported(t types.Type, o options) error {
+	if isNamed(t, "time", "Time") && o.time != "" && !timeFormats[o.time] {
+		return fmt.Errorf("can't generate code for the %s format of time.Time", o.time)
+	}
+	if isNamed(t, "math/big", "Int") || isNamed(t, "math/big", "Rat") || isNamed(t, "math/big", "Float") {
+		return fmt.Errorf("can't generate code for %s, math/big numbers aren't supported", reflectName(t))
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch u.Kind() {
+		case types.Invalid:
+			return fmt.Errorf("invalid type: %v", g.typeErr)
+		case types.Uintptr, types.UnsafePointer:
+			return fmt.Errorf("can't handle %s", reflectName(t))
+		}
+	case *types.Interface:
+		return fmt.Errorf("can't generate code for %s, interfaces need the registry of the Encoder", reflectName(t))
+	case *types.Chan, *types.Signature:
+		return fmt.Errorf("can't handle %s", reflectName(t))
+	}
+	return nil
+}
+
+// isNamed reports if t is the type name of the package path
+func isNamed(t types.Type, path, name string) bool {
+	n, ok := t.(*types.Named)
+	return ok && n.Obj().Pkg() != nil && n.Obj().Pkg().Path() == path && n.Obj().Name() == name
+}
+
+// enter is called before marshaling a named type inline. Recursive
+// types can only be marshaled with generated methods
+func (g *generator) enter(t types.Type) error {
+	n, ok := t.(*types.Named)
+	if !ok {
+		return nil
+	}
+	for _, in := range g.inline {
+		if in == n {
+			if n.Obj().Pkg() == g.pkg {
+				return fmt.Errorf("recursive type %s needs generated methods", n.Obj().Name())
+			}
+			return fmt.Errorf("can't generate code for recursive type %s", reflectName(t))
+		}
+	}
+	g.inline = append(g.inline, n)
+	return nil
+}
+
+func (g *generator) leave(t types.Type) {
+	if _, ok := t.(*types.Named); ok {
+		g.inline = g.inline[:len(g.inline)-1]
+	}
+}
+
+// field is a struct field that is marshaled
+type field struct {
+	name string
+	typ  types.Type
+	tag  fieldTag
+	opts options
+	// set if the field starts a group of bit-fields,
+	// with every field in the group
+	group []field
+}
+
+// fields returns the fields of the struct t in the order they're
+// written, like the fields method of the planBuilder does
+func (g *generator) fields(t types.Type, st *types.Struct, o options) ([]field, error) {
+	var fields []field
+	for i := 0; i < st.NumFields(); i++ {
+		v := st.Field(i)
+		if !v.Exported() {
+			continue
+		}
+		tag := reflect.StructTag(st.Tag(i)).Get(g.cfg.tag)
+		if g.cfg.onlyTagged && (tag == "" || tag == "-") {
+			continue
+		}
+		ft, err := parseFieldTag(tag, g.cfg.tag == "bin")
+		if err != nil {
+			return nil, fmt.Errorf("tag of %s.%s: %s", reflectName(t), v.Name(), err)
+		}
+		if ft.omit {
+			continue
+		}
+		if err := ft.check(v.Type()); err != nil {
+			return nil, fmt.Errorf("tag of %s.%s: %s", reflectName(t), v.Name(), err)
+		}
+		fields = append(fields, field{name: v.Name(), typ: v.Type(), tag: ft, opts: ft.apply(o)})
+	}
+	if err := checkFieldIDs(t, fields); err != nil {
+		return nil, err
+	}
+	sort.Stable(fieldsByOrder(fields))
+	return groupBits(fields), nil
+}
+
+type fieldsByOrder []field
+
+func (f fieldsByOrder) Len() int           { return len(f) }
+func (f fieldsByOrder) Less(i, j int) bool { return f[i].tag.order < f[j].tag.order }
+func (f fieldsByOrder) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// checkFieldIDs checks that every field has a different id,
+// or that none of them has one
+func checkFieldIDs(t types.Type, fields []field) error {
+	ids := make(map[int]string)
+	for _, f := range fields {
+		if f.tag.id == 0 {
+			continue
+		}
+		if other, ok := ids[f.tag.id]; ok {
+			return fmt.Errorf("fields %s.%s and %s.%s have the same id %d", reflectName(t), other, reflectName(t), f.name, f.tag.id)
+		}
+		ids[f.tag.id] = f.name
+	}
+	if len(ids) > 0 && len(ids) < len(fields) {
+		for _, f := range fields {
+			if f.tag.id == 0 {
+				return fmt.Errorf("field %s.%s has no id", reflectName(t), f.name)
+			}
+		}
+	}
+	return nil
+}
+
+func hasFieldIDs(fields []field) bool {
+	return len(fields) > 0 && fields[0].tag.id > 0
+}
+
+// groupBits replaces each run of bit-fields with the same bit
+// order with its first field, holding the whole group
+func groupBits(fields []field) []field {
+	var out []field
+	for _, f := range fields {
+		if f.tag.bits == 0 {
+			out = append(out, f)
+			continue
+		}
+		if n := len(out); n > 0 && out[n-1].group != nil && out[n-1].tag.lsb == f.tag.lsb {
+			out[n-1].group = append(out[n-1].group, f)
+			continue
+		}
+		f.group = []field{f}
+		out = append(out, f)
+	}
+	return out
+}
+
+// groupSize is the number of bytes of a group of bit-fields
+func groupSize(group []field) int {
+	n := 0
+	for _, f := range group {
+		n += f.tag.bits
+	}
+	return (n + 7) / 8
+}
+
+// isSigned reports if the underlying type of t is a signed integer
+func isSigned(t types.Type) bool {
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsInteger != 0 && b.Info()&types.IsUnsigned == 0
+}
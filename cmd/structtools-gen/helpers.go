@@ -0,0 +1,375 @@
+package main
+
+// helpers are written once to each generated file. They mirror
+// the Encoder and Decoder methods of the structtools package
+const helpers = `// stgenBuffer is the io.Writer given to custom marshalers
+type stgenBuffer []byte
+
+func (b *stgenBuffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+// stgenPutLen appends the length prefix of a string, slice or map.
+// A width of 0 is a varint
+func stgenPutLen(b []byte, n int, width int, bo binary.AppendByteOrder) ([]byte, error) {
+	switch width {
+	case 0:
+		return binary.AppendUvarint(b, uint64(n)), nil
+	case 1:
+		if n > math.MaxUint8 {
+			return b, fmt.Errorf("length %d doesn't fit in a uint8 prefix", n)
+		}
+		return append(b, byte(n)), nil
+	case 2:
+		if n > math.MaxUint16 {
+			return b, fmt.Errorf("length %d doesn't fit in a uint16 prefix", n)
+		}
+		return bo.AppendUint16(b, uint16(n)), nil
+	case 8:
+		return bo.AppendUint64(b, uint64(n)), nil
+	}
+	if uint64(n) > math.MaxUint32 {
+		return b, fmt.Errorf("length %d doesn't fit in a uint32 prefix", n)
+	}
+	return bo.AppendUint32(b, uint32(n)), nil
+}
+
+// stgenPutPadded appends s padded to size
+func stgenPutPadded(b []byte, s string, size int, pad byte, cstr bool) ([]byte, error) {
+	max := size
+	if cstr {
+		// room for the NUL
+		max--
+		if strings.IndexByte(s, 0) >= 0 {
+			return b, fmt.Errorf("C string contains a NUL byte")
+		}
+	}
+	if len(s) > max {
+		return b, fmt.Errorf("%d bytes don't fit in size %d", len(s), size)
+	}
+	n := len(b) + size
+	b = append(b, s...)
+	if cstr {
+		b = append(b, 0)
+	}
+	for len(b) < n {
+		b = append(b, pad)
+	}
+	return b, nil
+}
+
+// stgenPutCString appends s followed by a NUL
+func stgenPutCString(b []byte, s string) ([]byte, error) {
+	if strings.IndexByte(s, 0) >= 0 {
+		return b, fmt.Errorf("C string contains a NUL byte")
+	}
+	return append(append(b, s...), 0), nil
+}
+
+func stgenPutBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// stgenPutBits sets bits bits of p at the bit position pos to n
+func stgenPutBits(p []byte, pos, bits uint, n uint64, lsb bool) {
+	for i := uint(0); i < bits; i++ {
+		q := pos + i
+		if lsb {
+			p[q/8] |= byte(n>>i&1) << (q % 8)
+		} else {
+			p[q/8] |= byte(n>>(bits-1-i)&1) << (7 - q%8)
+		}
+	}
+}
+
+// stgenGetBits returns the bits bits of p at the bit position pos
+func stgenGetBits(p []byte, pos, bits uint, lsb bool) uint64 {
+	var n uint64
+	for i := uint(0); i < bits; i++ {
+		q := pos + i
+		if lsb {
+			n |= uint64(p[q/8]>>(q%8)&1) << i
+		} else {
+			n |= uint64(p[q/8]>>(7-q%8)&1) << (bits - 1 - i)
+		}
+	}
+	return n
+}
+
+// stgenInsertLen inserts the length of b[pos:] at pos, as a varint
+func stgenInsertLen(b []byte, pos int) []byte {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(b)-pos))
+	b = append(b, l[:n]...)
+	copy(b[pos+n:], b[pos:len(b)-n])
+	copy(b[pos:], l[:n])
+	return b
+}
+
+// stgenKeys sorts the keys of a map by their encoded bytes
+type stgenKeys struct {
+	order   []int
+	encoded [][]byte
+}
+
+func (k *stgenKeys) Len() int           { return len(k.order) }
+func (k *stgenKeys) Less(i, j int) bool { return bytes.Compare(k.encoded[i], k.encoded[j]) < 0 }
+func (k *stgenKeys) Swap(i, j int) {
+	k.order[i], k.order[j] = k.order[j], k.order[i]
+	k.encoded[i], k.encoded[j] = k.encoded[j], k.encoded[i]
+}
+
+// stgenSortKeys returns the order of the keys encoded in kb,
+// where key i ends at ends[i]
+func stgenSortKeys(kb []byte, ends []int) []int {
+	k := &stgenKeys{order: make([]int, len(ends)), encoded: make([][]byte, len(ends))}
+	for i := range ends {
+		k.order[i], k.encoded[i] = i, stgenKey(kb, ends, i)
+	}
+	sort.Sort(k)
+	return k.order
+}
+
+// stgenKey returns key i of the keys encoded in kb
+func stgenKey(kb []byte, ends []int, i int) []byte {
+	if i == 0 {
+		return kb[:ends[0]]
+	}
+	return kb[ends[i-1]:ends[i]]
+}
+
+// stgenChunk is the most allocated for a slice before reading
+// its elements, so corrupted lengths fail before allocating them
+const stgenChunk = 1 << 16
+
+func stgenCap(n int) int {
+	if n > stgenChunk {
+		return stgenChunk
+	}
+	return n
+}
+
+// stgenReader counts the bytes read from r
+type stgenReader struct {
+	r   io.Reader
+	n   int
+	buf [16]byte
+}
+
+func (d *stgenReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.n += n
+	return n, err
+}
+
+// read returns the next n bytes. Unless n is large, they're
+// only valid until the next read
+func (d *stgenReader) read(n int) ([]byte, error) {
+	if n > len(d.buf) {
+		return d.bytes(n)
+	}
+	p := d.buf[:n]
+	if _, err := io.ReadFull(d, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// bytes returns the next n bytes in a new slice
+func (d *stgenReader) bytes(n int) ([]byte, error) {
+	p := make([]byte, 0, stgenCap(n))
+	for len(p) < n {
+		c := stgenCap(n - len(p))
+		p = append(p, make([]byte, c)...)
+		if _, err := io.ReadFull(d, p[len(p)-c:]); err != nil {
+			if err == io.EOF && len(p) > c {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (d *stgenReader) uint8() (uint8, error) {
+	p, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+func (d *stgenReader) uint16(bo binary.ByteOrder) (uint16, error) {
+	p, err := d.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint16(p), nil
+}
+
+func (d *stgenReader) uint32(bo binary.ByteOrder) (uint32, error) {
+	p, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint32(p), nil
+}
+
+func (d *stgenReader) uint64(bo binary.ByteOrder) (uint64, error) {
+	p, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint64(p), nil
+}
+
+func (d *stgenReader) uvarint() (uint64, error) {
+	var (
+		n uint64
+		s uint
+	)
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b, err := d.uint8()
+		if err != nil {
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				return 0, fmt.Errorf("varint overflows a 64-bit integer")
+			}
+			return n | uint64(b)<<s, nil
+		}
+		n |= uint64(b&0x7f) << s
+		s += 7
+	}
+	return 0, fmt.Errorf("varint overflows a 64-bit integer")
+}
+
+func (d *stgenReader) varint() (int64, error) {
+	un, err := d.uvarint()
+	n := int64(un >> 1)
+	if un&1 != 0 {
+		n = ^n
+	}
+	return n, err
+}
+
+// length reads the length prefix of a string, slice or map
+func (d *stgenReader) length(width int, bo binary.ByteOrder) (int, error) {
+	var (
+		n   uint64
+		err error
+	)
+	switch width {
+	case 0:
+		n, err = d.uvarint()
+	case 1:
+		var n8 uint8
+		n8, err = d.uint8()
+		n = uint64(n8)
+	case 2:
+		var n16 uint16
+		n16, err = d.uint16(bo)
+		n = uint64(n16)
+	case 8:
+		n, err = d.uint64(bo)
+	default:
+		var n32 uint32
+		n32, err = d.uint32(bo)
+		n = uint64(n32)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(int(^uint(0)>>1)) {
+		return 0, fmt.Errorf("length %d overflows an int", n)
+	}
+	return int(n), nil
+}
+
+// padded reads size bytes and trims the padding
+func (d *stgenReader) padded(size int, pad byte, cstr bool) ([]byte, error) {
+	p, err := d.read(size)
+	if err != nil {
+		return nil, err
+	}
+	if cstr {
+		if i := bytes.IndexByte(p, 0); i >= 0 {
+			return p[:i], nil
+		}
+		return nil, fmt.Errorf("C string isn't NUL terminated")
+	}
+	return bytes.TrimRight(p, string(pad)), nil
+}
+
+// cstring reads a NUL terminated string, without the NUL
+func (d *stgenReader) cstring() ([]byte, error) {
+	var s []byte
+	for {
+		b, err := d.uint8()
+		if err != nil {
+			if err == io.EOF && len(s) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if b == 0 {
+			return s, nil
+		}
+		s = append(s, b)
+	}
+}
+
+// presence reads a presence byte
+func (d *stgenReader) presence() (bool, error) {
+	b, err := d.uint8()
+	if err != nil {
+		return false, err
+	}
+	switch b {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid presence byte %d", b)
+}
+
+// fieldLength reads the length of a numbered field
+func (d *stgenReader) fieldLength() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if n > uint64(int(^uint(0)>>1)) {
+		return 0, fmt.Errorf("length %d overflows an int", n)
+	}
+	return int(n), nil
+}
+
+// skipRest skips what's left of a field of n bytes that started at
+// the offset start, a newer version of its type may have written more
+func (d *stgenReader) skipRest(n, start int) error {
+	used := d.n - start
+	if used > n {
+		return fmt.Errorf("value of %d bytes is longer than its length %d", used, n)
+	}
+	if _, err := d.bytes(n - used); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+`
@@ -0,0 +1,130 @@
+// Command structtools-gen generates MarshalBinary and UnmarshalBinary
+// methods for the struct types of a package. The methods implement the
+// Marshaler and Unmarshaler interfaces of the structtools package without
+// reflection, and write the same bytes as an Encoder with the settings
+// given by the flags.
+//
+// Usage:
+//
+//	structtools-gen [flags] [directory]
+//
+// It's meant to be run by go generate, in the directory of the package:
+//
+//	//go:generate structtools-gen -type Order,Item
+//
+// The flags are:
+//
+//	-type T,U     types to generate methods for. By default, every struct
+//	              type that doesn't have MarshalBinary or UnmarshalBinary
+//	              methods yet
+//	-output file  name of the generated file, structtools_gen.go by default
+//	-tests        also generate file_test.go, with tests that check that
+//	              the methods write and read the same bytes as the Encoder
+//	              and the Decoder. On by default
+//	-tag, -only-tagged, -le, -varint, -presence, -len
+//	              the settings of the Encoder/Decoder: the Tag, OnlyTagged,
+//	              ByteOrder, VarInt, Presence and LenPrefix fields
+//
+// Struct tags are read like the Encoder reads them. Struct types with
+// generated methods are marshaled by calling them, other types are
+// marshaled inline. The generated methods always use the settings they
+// were generated with, whatever the settings of the Encoder or Decoder
+// that calls them, and the Limits of the Decoder don't apply to them.
+// Interfaces aren't supported, they need the registry of the Encoder,
+// and neither are the C layout, math/big numbers and the time.Time
+// formats other than TimeBinary.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	typeNames  = flag.String("type", "", "comma separated list of type names")
+	output     = flag.String("output", "structtools_gen.go", "output file name")
+	tests      = flag.Bool("tests", true, "generate round-trip tests")
+	tag        = flag.String("tag", "bin", "tag to look for")
+	onlyTagged = flag.Bool("only-tagged", false, "only marshal tagged fields")
+	le         = flag.Bool("le", false, "little endian byte order")
+	varint     = flag.Bool("varint", false, "write integers and length prefixes as varints")
+	presence   = flag.String("presence", "none", "presence bytes: none, pointer or nil")
+	lenPrefix  = flag.String("len", "", "width of the length prefixes: u8, u16, u32, u64 or varint")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: structtools-gen [flags] [directory]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	dir := "."
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		dir = flag.Arg(0)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err := run(dir, strings.Join(os.Args[1:], " ")); err != nil {
+		fmt.Fprintln(os.Stderr, "structtools-gen:", err)
+		os.Exit(1)
+	}
+}
+
+// run generates the files for the package in dir
+func run(dir, args string) error {
+	cfg, err := newConfig()
+	if err != nil {
+		return err
+	}
+	src, testSrc, err := generate(dir, cfg, args)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, cfg.output)
+	if err := ioutil.WriteFile(name, src, 0644); err != nil {
+		return err
+	}
+	if !cfg.tests {
+		return nil
+	}
+	return ioutil.WriteFile(testFileName(name), testSrc, 0644)
+}
+
+// newConfig builds the config from the flags
+func newConfig() (config, error) {
+	cfg := config{
+		output:     *output,
+		tests:      *tests,
+		tag:        *tag,
+		onlyTagged: *onlyTagged,
+		opts:       options{le: *le, varint: *varint, lenWidth: *lenPrefix},
+	}
+	if *typeNames != "" {
+		cfg.types = strings.Split(*typeNames, ",")
+	}
+	var ok bool
+	if cfg.opts.presence, ok = presenceModes[*presence]; !ok {
+		return cfg, fmt.Errorf("invalid presence %q", *presence)
+	}
+	if _, ok := lenWidths[cfg.opts.lenWidth]; !ok && cfg.opts.lenWidth != "" {
+		return cfg, fmt.Errorf("invalid length prefix %q", cfg.opts.lenWidth)
+	}
+	if !strings.HasSuffix(cfg.output, ".go") || strings.HasSuffix(cfg.output, "_test.go") {
+		return cfg, fmt.Errorf("invalid output file name %q", cfg.output)
+	}
+	return cfg, nil
+}
+
+// testFileName is the name of the file with the tests for name
+func testFileName(name string) string {
+	return strings.TrimSuffix(name, ".go") + "_test.go"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateExample(t *testing.T) {
+	cfg := config{output: "structtools_gen.go", tests: true, tag: "bin", opts: options{presence: presencePointer}}
+	src, testSrc, err := generate("example", cfg, "-presence pointer")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the committed files are regenerated by go generate
+	for name, got := range map[string][]byte{"structtools_gen.go": src, "structtools_gen_test.go": testSrc} {
+		want, err := ioutil.ReadFile(filepath.Join("example", name))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(got, want) {
+			t.Error(name, "is out of date, run go generate in example")
+			return
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		dir   string
+		types []string
+		err   string
+	}{
+		{"iface", nil, "interfaces need the registry"},
+		{"recursive", []string{"Tree"}, "recursive type Node needs generated methods"},
+		{"tag", nil, "tag of tag.Header.Version: bits only applies to bools and integers"},
+		{"tag", []string{"Missing"}, "type Missing not found"},
+		{"builtin", []string{"Amount"}, "big.Int, math/big numbers aren't supported"},
+		{"builtin", []string{"Stamp"}, "unixnano format of time.Time"},
+	} {
+		cfg := config{types: tc.types, output: "structtools_gen.go", tag: "bin"}
+		_, _, err := generate(filepath.Join("testdata", tc.dir), cfg, "")
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Error(tc.dir, "got unexpected error:", err)
+			return
+		}
+	}
+	// with methods for Node, the recursion goes through them
+	cfg := config{types: []string{"Tree", "Node"}, output: "structtools_gen.go", tag: "bin"}
+	if _, _, err := generate(filepath.Join("testdata", "recursive"), cfg, ""); err != nil {
+		t.Error(err)
+		return
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"go/types"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// fieldTag is the parsed tag of a struct field, see
+// the fieldTag type of the structtools package
+type fieldTag struct {
+	name      string
+	byteOrder string
+	varint    bool
+	fixed     bool
+	lenWidth  string
+	size      int
+	pad       byte
+	cstr      bool
+	bits      int
+	lsb       bool
+	omit      bool
+	order     int
+	id        int
+	packed    bool
+	align     int
+	time      string
+}
+
+// parseFieldTag parses tag. Unknown options are errors if strict,
+// otherwise they're ignored: tags other than the one of the package
+// are shared with other packages, like encoding/json
+func parseFieldTag(tag string, strict bool) (fieldTag, error) {
+	parts := strings.Split(tag, ",")
+	ft := fieldTag{name: parts[0]}
+	for _, opt := range parts[1:] {
+		key, val := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			key, val = opt[:i], opt[i+1:]
+		}
+		var err error
+		switch key {
+		case "":
+			continue
+		case "le", "be":
+			ft.byteOrder = key
+		case "varint":
+			ft.varint = true
+		case "fixed":
+			ft.fixed = true
+		case "len":
+			if _, ok := lenWidths[val]; !ok {
+				return ft, fmt.Errorf("invalid length prefix %q", val)
+			}
+			ft.lenWidth = val
+		case "size":
+			if ft.size, err = strconv.Atoi(val); err != nil || ft.size <= 0 {
+				return ft, fmt.Errorf("invalid size %q", val)
+			}
+		case "pad":
+			switch val {
+			case "nul":
+				ft.pad = 0
+			case "space":
+				ft.pad = ' '
+			default:
+				return ft, fmt.Errorf("invalid padding %q", val)
+			}
+		case "cstr":
+			ft.cstr = true
+		case "bits":
+			if ft.bits, err = strconv.Atoi(val); err != nil || ft.bits <= 0 || ft.bits > 64 {
+				return ft, fmt.Errorf("invalid bits %q", val)
+			}
+		case "lsb":
+			ft.lsb = true
+		case "msb":
+			ft.lsb = false
+		case "omit":
+			ft.omit = true
+		case "order":
+			if ft.order, err = strconv.Atoi(val); err != nil {
+				return ft, fmt.Errorf("invalid order %q", val)
+			}
+		case "id":
+			if ft.id, err = strconv.Atoi(val); err != nil || ft.id <= 0 || uint64(ft.id) > math.MaxUint32 {
+				return ft, fmt.Errorf("invalid id %q", val)
+			}
+		case "packed":
+			ft.packed = true
+		case "align":
+			if ft.align, err = strconv.Atoi(val); err != nil || ft.align <= 0 || ft.align&(ft.align-1) != 0 {
+				return ft, fmt.Errorf("invalid alignment %q", val)
+			}
+		case "time":
+			if _, ok := timeFormats[val]; !ok {
+				return ft, fmt.Errorf("invalid time format %q", val)
+			}
+			ft.time = val
+		default:
+			if strict {
+				return ft, fmt.Errorf("unknown option %q", opt)
+			}
+		}
+	}
+	if ft.bits > 0 && (ft.size > 0 || ft.cstr || ft.varint || ft.lenWidth != "") {
+		return ft, fmt.Errorf("bits can't be used with size, cstr, varint or len")
+	}
+	if ft.bits > 0 && (ft.packed || ft.align > 0) {
+		return ft, fmt.Errorf("bits can't be used with packed or align")
+	}
+	if ft.bits > 0 && ft.id > 0 {
+		return ft, fmt.Errorf("bits and id can't be used together")
+	}
+	if ft.varint && ft.fixed {
+		return ft, fmt.Errorf("varint and fixed can't be used together")
+	}
+	return ft, nil
+}
+
+// apply returns o with the options in the tag
+func (ft fieldTag) apply(o options) options {
+	if ft.byteOrder != "" {
+		o.le = ft.byteOrder == "le"
+	}
+	if ft.varint {
+		o.varint = true
+	} else if ft.fixed {
+		o.varint = false
+	}
+	if ft.lenWidth != "" {
+		o.lenWidth = ft.lenWidth
+	}
+	if ft.time != "" {
+		o.time = ft.time
+	}
+	o.size, o.pad, o.cstr = ft.size, ft.pad, ft.cstr
+	return o
+}
+
+// check reports if the options can be used for a field of type t
+func (ft fieldTag) check(t types.Type) error {
+	if ft.bits > 0 {
+		b, _ := t.Underlying().(*types.Basic)
+		switch {
+		case b != nil && b.Kind() == types.Bool:
+			if ft.bits != 1 {
+				return fmt.Errorf("bools only take 1 bit")
+			}
+		case b != nil && isInteger(b):
+			if ft.bits > intBits(b) {
+				return fmt.Errorf("%d bits don't fit in %s", ft.bits, reflectName(t))
+			}
+		default:
+			return fmt.Errorf("bits only applies to bools and integers")
+		}
+	}
+	if ft.time != "" && !reachesTime(t) {
+		return fmt.Errorf("time only applies to times")
+	}
+	u := t.Underlying()
+	for p, ok := u.(*types.Pointer); ok; p, ok = u.(*types.Pointer) {
+		u = p.Elem().Underlying()
+	}
+	b, _ := u.(*types.Basic)
+	isString := b != nil && b.Kind() == types.String
+	s, isSlice := u.(*types.Slice)
+	if ft.size > 0 && !isString && !isSlice {
+		return fmt.Errorf("size only applies to strings and slices")
+	}
+	if ft.cstr && !isString {
+		return fmt.Errorf("cstr only applies to strings")
+	}
+	if ft.pad != 0 && (ft.size == 0 || isSlice && !isUint8(s.Elem())) {
+		return fmt.Errorf("pad only applies to strings and byte slices with a size")
+	}
+	return nil
+}
+
+// reachesTime reports if t is a time.Time, or pointers, arrays, slices
+// or maps of them
+func reachesTime(t types.Type) bool {
+	for {
+		switch u := t.Underlying().(type) {
+		case *types.Pointer:
+			t = u.Elem()
+		case *types.Array:
+			t = u.Elem()
+		case *types.Slice:
+			t = u.Elem()
+		case *types.Map:
+			t = u.Elem()
+		default:
+			return isNamed(t, "time", "Time")
+		}
+	}
+}
+
+// isInteger reports if b is an integer the structtools package handles
+func isInteger(b *types.Basic) bool {
+	return b.Info()&types.IsInteger != 0 && b.Kind() != types.Uintptr
+}
+
+// intBits is the size of the integer b in bits, ints are 64 bits
+func intBits(b *types.Basic) int {
+	switch b.Kind() {
+	case types.Int8, types.Uint8:
+		return 8
+	case types.Int16, types.Uint16:
+		return 16
+	case types.Int32, types.Uint32:
+		return 32
+	}
+	return 64
+}
+
+// isUint8 reports if the underlying type of t is uint8
+func isUint8(t types.Type) bool {
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && b.Kind() == types.Uint8
+}
@@ -0,0 +1,14 @@
+package builtin
+
+import (
+	"math/big"
+	"time"
+)
+
+type Amount struct {
+	Value *big.Int
+}
+
+type Stamp struct {
+	At time.Time `bin:",time=unixnano"`
+}
@@ -0,0 +1,6 @@
+package iface
+
+type Event struct {
+	ID      uint32
+	Payload interface{}
+}
@@ -0,0 +1,10 @@
+package recursive
+
+type Tree struct {
+	Root *Node
+}
+
+type Node struct {
+	Value    int32
+	Children []Node
+}
@@ -0,0 +1,6 @@
+package tag
+
+type Header struct {
+	Magic   uint32
+	Version string `bin:",bits=3"`
+}
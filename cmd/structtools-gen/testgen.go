@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+	"strings"
+)
+
+// test writes the test of the methods of n. A sample value is marshaled
+// with the methods and with an Encoder, through a type with the same
+// fields and no methods, and the output is compared. Then the output
+// is unmarshaled both ways and the values are compared
+func (g *generator) test(w *bytes.Buffer, n *types.Named) {
+	name := n.Obj().Name()
+	fmt.Fprintf(w, `// stgenPlain%[1]s is marshaled by the Encoder using reflection
+type stgenPlain%[1]s %[1]s
+
+func TestStructtools%[1]s(t *testing.T) {
+	v := stgenSample%[1]s(0)
+	want := &bytes.Buffer{}
+	enc := structtools.NewEncoder(want)
+%[2]s	if err := enc.Encode(stgenPlain%[1]s(v)); err != nil {
+		t.Fatal(err)
+	}
+	got := &bytes.Buffer{}
+	if n, err := v.MarshalBinary(got); err != nil || n != got.Len() {
+		t.Fatal(n, err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("got %%x, want %%x", got.Bytes(), want.Bytes())
+	}
+
+	var out %[1]s
+	n, err := out.UnmarshalBinary(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain stgenPlain%[1]s
+	dec := structtools.NewDecoder(bytes.NewReader(want.Bytes()))
+%[3]s	if err := dec.Decode(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if n != want.Len() {
+		t.Fatalf("read %%d bytes of %%d", n, want.Len())
+	}
+	if !reflect.DeepEqual(out, %[1]s(plain)) {
+		t.Fatalf("got %%+v, want %%+v", out, plain)
+	}
+}
+
+func stgenSample%[1]s(depth int) (x %[1]s) {
+`, name, g.settings("enc"), g.settings("dec"))
+	g.sampleFields(w, "x", n, n.Underlying().(*types.Struct), g.cfg.opts)
+	w.WriteString("return x\n}\n\n")
+}
+
+// settings sets the fields of the Encoder or Decoder v
+// to the settings of the generated methods
+func (g *generator) settings(v string) string {
+	s := &strings.Builder{}
+	if g.cfg.tag != "bin" {
+		fmt.Fprintf(s, "%s.Tag = %q\n", v, g.cfg.tag)
+	}
+	if g.cfg.onlyTagged {
+		fmt.Fprintf(s, "%s.OnlyTagged = true\n", v)
+	}
+	o := g.cfg.opts
+	if o.le {
+		fmt.Fprintf(s, "%s.ByteOrder = binary.LittleEndian\n", v)
+	}
+	if o.varint {
+		fmt.Fprintf(s, "%s.VarInt = true\n", v)
+	}
+	switch o.presence {
+	case presencePointer:
+		fmt.Fprintf(s, "%s.Presence = structtools.PointerPresence\n", v)
+	case presenceNil:
+		fmt.Fprintf(s, "%s.Presence = structtools.NilPresence\n", v)
+	}
+	if o.lenWidth != "" {
+		fmt.Fprintf(s, "%s.LenPrefix = structtools.%s\n", v, map[string]string{
+			"u8": "Len8", "u16": "Len16", "u32": "Len32", "u64": "Len64", "varint": "LenVarint",
+		}[o.lenWidth])
+	}
+	return s.String()
+}
+
+// sampleFields sets the fields of the struct v to sample values
+func (g *generator) sampleFields(w *bytes.Buffer, v string, t types.Type, st *types.Struct, o options) {
+	// the fields were checked when generating the methods
+	fields, _ := g.fields(t, st, o)
+	for _, f := range fields {
+		for _, bf := range f.group {
+			switch b := bf.typ.Underlying().(*types.Basic); {
+			case b.Kind() == types.Bool:
+				fmt.Fprintf(w, "%s.%s = true\n", v, bf.name)
+			case isSigned(b):
+				fmt.Fprintf(w, "%s.%s = -1\n", v, bf.name)
+			default:
+				fmt.Fprintf(w, "%s.%s = 1\n", v, bf.name)
+			}
+		}
+		if f.group == nil {
+			g.sample(w, v+"."+f.name, f.typ, f.opts)
+		}
+	}
+}
+
+// sample sets v, of type t, to a value that can be marshaled with the
+// options o. Values of types that marshal themselves are left as they
+// are. Pointers, slices and maps that lead to the types with generated
+// methods stop being filled at some depth, so recursive types end
+func (g *generator) sample(w *bytes.Buffer, v string, t types.Type, o options) {
+	if n, ok := t.(*types.Named); ok && g.named[n] {
+		fmt.Fprintf(w, "%s = stgenSample%s(depth + 1)\n", v, n.Obj().Name())
+		return
+	}
+	if p, ok := t.Underlying().(*types.Pointer); g.hasMarshaler(t) && (!ok || !g.hasMarshaler(p.Elem())) {
+		return
+	}
+	g.tmp++
+	c := g.tmp%30 + 1
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Kind() == types.Bool:
+			fmt.Fprintf(w, "%s = true\n", v)
+		case u.Kind() == types.String:
+			fmt.Fprintf(w, "%s = %q\n", v, g.sampleString(c, o))
+		case u.Info()&types.IsComplex != 0:
+			fmt.Fprintf(w, "%s = %d + 1i\n", v, c)
+		case u.Info()&types.IsFloat != 0:
+			fmt.Fprintf(w, "%s = %d.5\n", v, c)
+		default:
+			fmt.Fprintf(w, "%s = %d\n", v, c)
+		}
+	case *types.Pointer:
+		guard := g.guard(w, u.Elem())
+		fmt.Fprintf(w, "%s = new(%s)\n", v, g.typeName(u.Elem()))
+		g.sample(w, "(*"+v+")", u.Elem(), o)
+		g.endGuard(w, guard)
+	case *types.Struct:
+		g.sampleFields(w, v, t, u, o)
+	case *types.Array:
+		i := g.temp("i")
+		fmt.Fprintf(w, "for %s := range %s {\n", i, v)
+		g.sample(w, v+"["+i+"]", u.Elem(), o.elem())
+		w.WriteString("}\n")
+	case *types.Slice:
+		n := 2
+		if o.size > 0 {
+			n = o.size
+			if g.isPaddedBytes(u) && n > 2 {
+				n = 2
+			}
+		}
+		tn := g.typeName(t)
+		fmt.Fprintf(w, "%s = make(%s, 0)\n", v, tn)
+		guard := o.size == 0 && g.guard(w, u.Elem())
+		fmt.Fprintf(w, "%s = make(%s, %d)\n", v, tn, n)
+		g.endGuard(w, guard)
+		i := g.temp("i")
+		fmt.Fprintf(w, "for %s := range %s {\n", i, v)
+		g.sample(w, v+"["+i+"]", u.Elem(), o.elem())
+		w.WriteString("}\n")
+	case *types.Map:
+		fmt.Fprintf(w, "%s = make(%s)\n", v, g.typeName(t))
+		guard := g.guard(w, u.Key()) || g.guard(w, u.Elem())
+		// two entries, with different keys
+		for j := 0; j < 2; j++ {
+			k, e := g.temp("k"), g.temp("e")
+			fmt.Fprintf(w, "{\nvar %s %s\n", k, g.typeName(u.Key()))
+			g.sample(w, k, u.Key(), o.elem())
+			fmt.Fprintf(w, "var %s %s\n", e, g.typeName(u.Elem()))
+			g.sample(w, e, u.Elem(), o.elem())
+			fmt.Fprintf(w, "%s[%s] = %s\n}\n", v, k, e)
+		}
+		g.endGuard(w, guard)
+	}
+}
+
+// sampleString returns a string that fits the options o
+func (g *generator) sampleString(c int, o options) string {
+	n := 2
+	if o.size > 0 {
+		if max := o.size; o.cstr && max-1 < n {
+			n = max - 1
+		} else if max < n {
+			n = max
+		}
+	}
+	return strings.Repeat(string(rune('a'+c%26)), n)
+}
+
+// guard opens a block that is only run below a certain depth if values
+// of type t can lead to the types with generated methods. It reports
+// if it did, so endGuard closes it
+func (g *generator) guard(w *bytes.Buffer, t types.Type) bool {
+	if !g.reaches(t, make(map[types.Type]bool)) {
+		return false
+	}
+	w.WriteString("if depth < 2 {\n")
+	return true
+}
+
+func (g *generator) endGuard(w *bytes.Buffer, guard bool) {
+	if guard {
+		w.WriteString("}\n")
+	}
+}
+
+// reaches reports if values of type t can contain
+// values of the types with generated methods
+func (g *generator) reaches(t types.Type, seen map[types.Type]bool) bool {
+	if n, ok := t.(*types.Named); ok {
+		if g.named[n] {
+			return true
+		}
+		if seen[n] {
+			return false
+		}
+		seen[n] = true
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Pointer:
+		return g.reaches(u.Elem(), seen)
+	case *types.Array:
+		return g.reaches(u.Elem(), seen)
+	case *types.Slice:
+		return g.reaches(u.Elem(), seen)
+	case *types.Map:
+		return g.reaches(u.Key(), seen) || g.reaches(u.Elem(), seen)
+	case *types.Struct:
+		for i := 0; i < u.NumFields(); i++ {
+			if g.reaches(u.Field(i).Type(), seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
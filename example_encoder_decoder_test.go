@@ -20,7 +20,7 @@ func ExampleEncoderDecoder() {
 		panic(err)
 	}
 	unmarshaled := S{}
-	if err := structtools.NewDecoder(b).Decode(&unmarshaled); err != nil {
+	if err := structtools.NewDecoderWithTags(b, "someTag", true).Decode(&unmarshaled); err != nil {
 		panic(err)
 	}
 	fmt.Printf("original data: %v\n", data)
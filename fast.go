@@ -0,0 +1,379 @@
+package structtools
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// flatLayout describes the values of a type that are only made of
+// numbers and bools, like []float64 or []struct{ X, Y int32 }. Arrays
+// and slices of them are converted in one pass, without reflection,
+// and written or read at once
+type flatLayout struct {
+	runs []flatRun
+	// encoded size
+	size int
+	// size in memory
+	memSize uintptr
+}
+
+// flatRun is a run of n numbers of the same kind, contiguous in memory
+type flatRun struct {
+	offset uintptr
+	kind   reflect.Kind
+	bo     binary.ByteOrder
+	n      int
+}
+
+// maxFlatRuns is the most runs in a flatLayout.
+// Arrays of structs are unrolled, so they can add many
+const maxFlatRuns = 64
+
+// flatLayout returns the layout of the values of type t, or nil if
+// they aren't only made of numbers and bools. Custom marshalers,
+// strings, varints, bit-fields, numbered fields and the C layout are
+// never flat
+func (b *planBuilder) flatLayout(t reflect.Type, o codecOptions) *flatLayout {
+	// the C layout has padding, and ints aren't Go ints
+	if o.layout == CLayout {
+		return nil
+	}
+	runs, ok := b.flatRuns(t, o, 0, nil)
+	if !ok || len(runs) == 0 {
+		return nil
+	}
+	l := &flatLayout{runs: runs, memSize: t.Size()}
+	for _, r := range runs {
+		l.size += r.n * flatSize(r.kind)
+	}
+	// values of zero-length arrays, there's nothing to convert
+	if l.size == 0 {
+		return nil
+	}
+	return l
+}
+
+// flatRuns appends the runs of a value of type t at offset to runs
+func (b *planBuilder) flatRuns(t reflect.Type, o codecOptions, offset uintptr, runs []flatRun) ([]flatRun, bool) {
+	if hasMarshaler(t) || reflect.PtrTo(t).Implements(unmarshalerType) || isBuiltin(t, o) {
+		return nil, false
+	}
+	switch k := t.Kind(); k {
+	case reflect.Bool, reflect.Int8, reflect.Uint8, reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return appendRun(runs, flatRun{offset: offset, kind: k, bo: o.byteOrder, n: 1})
+	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if o.varint {
+			return nil, false
+		}
+		return appendRun(runs, flatRun{offset: offset, kind: k, bo: o.byteOrder, n: 1})
+	case reflect.Array:
+		elem, ok := b.flatRuns(t.Elem(), o.elem(), 0, nil)
+		if !ok {
+			return nil, false
+		}
+		if contiguous(elem, t.Elem().Size()) {
+			r := elem[0]
+			r.offset, r.n = offset, r.n*t.Len()
+			return appendRun(runs, r)
+		}
+		// unrolled
+		for i := 0; i < t.Len(); i++ {
+			for _, r := range elem {
+				r.offset += offset + uintptr(i)*t.Elem().Size()
+				if runs, ok = appendRun(runs, r); !ok {
+					return nil, false
+				}
+			}
+		}
+		return runs, true
+	case reflect.Struct:
+		fields, err := b.fields(t, o)
+		if err != nil || hasFieldIDs(fields) {
+			return nil, false
+		}
+		var ok bool
+		for _, f := range fields {
+			if f.bits != nil {
+				return nil, false
+			}
+			sf := t.Field(f.index)
+			if runs, ok = b.flatRuns(sf.Type, f.tag.apply(o), offset+sf.Offset, runs); !ok {
+				return nil, false
+			}
+		}
+		return runs, true
+	}
+	return nil, false
+}
+
+// appendRun appends r to runs, or extends the last run
+// if r follows it in memory and has the same kind
+func appendRun(runs []flatRun, r flatRun) ([]flatRun, bool) {
+	if l := len(runs); l > 0 {
+		last := &runs[l-1]
+		if last.kind == r.kind && sameByteOrder(last.bo, r.bo) &&
+			last.offset+uintptr(last.n)*flatMemSize(last.kind) == r.offset {
+			last.n += r.n
+			return runs, true
+		}
+	}
+	runs = append(runs, r)
+	return runs, len(runs) <= maxFlatRuns
+}
+
+func sameByteOrder(a, b binary.ByteOrder) bool {
+	return reflect.TypeOf(a) == reflect.TypeOf(b) && reflect.TypeOf(a).Comparable() && a == b
+}
+
+// flatSize is the encoded size of a number of kind k
+func flatSize(k reflect.Kind) int {
+	switch k {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4
+	case reflect.Complex128:
+		return 16
+	}
+	return 8
+}
+
+// flatMemSize is the size in memory of a number of kind k
+func flatMemSize(k reflect.Kind) uintptr {
+	switch k {
+	case reflect.Int, reflect.Uint:
+		return unsafe.Sizeof(int(0))
+	}
+	return uintptr(flatSize(k))
+}
+
+// contiguous reports if runs is a single run that fills
+// values of size bytes, so arrays of them are longer runs
+func contiguous(runs []flatRun, size uintptr) bool {
+	return len(runs) == 1 && runs[0].offset == 0 && uintptr(runs[0].n)*flatMemSize(runs[0].kind) == size
+}
+
+// put converts the n values at p to b
+func (l *flatLayout) put(b []byte, p unsafe.Pointer, n int) {
+	if contiguous(l.runs, l.memSize) {
+		r := l.runs[0]
+		r.n *= n
+		putRun(b, p, r)
+		return
+	}
+	// p is never moved past the values, that's an invalid pointer
+	for i := 0; i < n; i++ {
+		for _, r := range l.runs {
+			b = putRun(b, unsafe.Add(p, uintptr(i)*l.memSize+r.offset), r)
+		}
+	}
+}
+
+// get converts b to the n values at p
+func (l *flatLayout) get(b []byte, p unsafe.Pointer, n int) {
+	if contiguous(l.runs, l.memSize) {
+		r := l.runs[0]
+		r.n *= n
+		getRun(b, p, r)
+		return
+	}
+	for i := 0; i < n; i++ {
+		for _, r := range l.runs {
+			b = getRun(b, unsafe.Add(p, uintptr(i)*l.memSize+r.offset), r)
+		}
+	}
+}
+
+// putRun converts the run r at p to b, and returns the rest of b
+func putRun(b []byte, p unsafe.Pointer, r flatRun) []byte {
+	bo := r.bo
+	switch r.kind {
+	case reflect.Bool:
+		for i, v := range unsafe.Slice((*bool)(p), r.n) {
+			b[i] = 0
+			if v {
+				b[i] = 1
+			}
+		}
+	case reflect.Int8:
+		for i, v := range unsafe.Slice((*int8)(p), r.n) {
+			b[i] = byte(v)
+		}
+	case reflect.Uint8:
+		copy(b, unsafe.Slice((*uint8)(p), r.n))
+	case reflect.Int16:
+		for i, v := range unsafe.Slice((*int16)(p), r.n) {
+			bo.PutUint16(b[2*i:], uint16(v))
+		}
+	case reflect.Uint16:
+		for i, v := range unsafe.Slice((*uint16)(p), r.n) {
+			bo.PutUint16(b[2*i:], v)
+		}
+	case reflect.Int32:
+		for i, v := range unsafe.Slice((*int32)(p), r.n) {
+			bo.PutUint32(b[4*i:], uint32(v))
+		}
+	case reflect.Uint32:
+		for i, v := range unsafe.Slice((*uint32)(p), r.n) {
+			bo.PutUint32(b[4*i:], v)
+		}
+	case reflect.Int64:
+		for i, v := range unsafe.Slice((*int64)(p), r.n) {
+			bo.PutUint64(b[8*i:], uint64(v))
+		}
+	case reflect.Uint64:
+		for i, v := range unsafe.Slice((*uint64)(p), r.n) {
+			bo.PutUint64(b[8*i:], v)
+		}
+	case reflect.Int:
+		for i, v := range unsafe.Slice((*int)(p), r.n) {
+			bo.PutUint64(b[8*i:], uint64(v))
+		}
+	case reflect.Uint:
+		for i, v := range unsafe.Slice((*uint)(p), r.n) {
+			bo.PutUint64(b[8*i:], uint64(v))
+		}
+	case reflect.Float32:
+		for i, v := range unsafe.Slice((*float32)(p), r.n) {
+			bo.PutUint32(b[4*i:], math.Float32bits(v))
+		}
+	case reflect.Float64:
+		for i, v := range unsafe.Slice((*float64)(p), r.n) {
+			bo.PutUint64(b[8*i:], math.Float64bits(v))
+		}
+	case reflect.Complex64:
+		for i, v := range unsafe.Slice((*complex64)(p), r.n) {
+			bo.PutUint32(b[8*i:], math.Float32bits(real(v)))
+			bo.PutUint32(b[8*i+4:], math.Float32bits(imag(v)))
+		}
+	case reflect.Complex128:
+		for i, v := range unsafe.Slice((*complex128)(p), r.n) {
+			bo.PutUint64(b[16*i:], math.Float64bits(real(v)))
+			bo.PutUint64(b[16*i+8:], math.Float64bits(imag(v)))
+		}
+	}
+	return b[r.n*flatSize(r.kind):]
+}
+
+// getRun is the counterpart of putRun
+func getRun(b []byte, p unsafe.Pointer, r flatRun) []byte {
+	bo := r.bo
+	switch r.kind {
+	case reflect.Bool:
+		s := unsafe.Slice((*bool)(p), r.n)
+		for i := range s {
+			s[i] = b[i] != 0
+		}
+	case reflect.Int8:
+		s := unsafe.Slice((*int8)(p), r.n)
+		for i := range s {
+			s[i] = int8(b[i])
+		}
+	case reflect.Uint8:
+		copy(unsafe.Slice((*uint8)(p), r.n), b)
+	case reflect.Int16:
+		s := unsafe.Slice((*int16)(p), r.n)
+		for i := range s {
+			s[i] = int16(bo.Uint16(b[2*i:]))
+		}
+	case reflect.Uint16:
+		s := unsafe.Slice((*uint16)(p), r.n)
+		for i := range s {
+			s[i] = bo.Uint16(b[2*i:])
+		}
+	case reflect.Int32:
+		s := unsafe.Slice((*int32)(p), r.n)
+		for i := range s {
+			s[i] = int32(bo.Uint32(b[4*i:]))
+		}
+	case reflect.Uint32:
+		s := unsafe.Slice((*uint32)(p), r.n)
+		for i := range s {
+			s[i] = bo.Uint32(b[4*i:])
+		}
+	case reflect.Int64:
+		s := unsafe.Slice((*int64)(p), r.n)
+		for i := range s {
+			s[i] = int64(bo.Uint64(b[8*i:]))
+		}
+	case reflect.Uint64:
+		s := unsafe.Slice((*uint64)(p), r.n)
+		for i := range s {
+			s[i] = bo.Uint64(b[8*i:])
+		}
+	case reflect.Int:
+		s := unsafe.Slice((*int)(p), r.n)
+		for i := range s {
+			s[i] = int(bo.Uint64(b[8*i:]))
+		}
+	case reflect.Uint:
+		s := unsafe.Slice((*uint)(p), r.n)
+		for i := range s {
+			s[i] = uint(bo.Uint64(b[8*i:]))
+		}
+	case reflect.Float32:
+		s := unsafe.Slice((*float32)(p), r.n)
+		for i := range s {
+			s[i] = math.Float32frombits(bo.Uint32(b[4*i:]))
+		}
+	case reflect.Float64:
+		s := unsafe.Slice((*float64)(p), r.n)
+		for i := range s {
+			s[i] = math.Float64frombits(bo.Uint64(b[8*i:]))
+		}
+	case reflect.Complex64:
+		s := unsafe.Slice((*complex64)(p), r.n)
+		for i := range s {
+			s[i] = complex(math.Float32frombits(bo.Uint32(b[8*i:])), math.Float32frombits(bo.Uint32(b[8*i+4:])))
+		}
+	case reflect.Complex128:
+		s := unsafe.Slice((*complex128)(p), r.n)
+		for i := range s {
+			s[i] = complex(math.Float64frombits(bo.Uint64(b[16*i:])), math.Float64frombits(bo.Uint64(b[16*i+8:])))
+		}
+	}
+	return b[r.n*flatSize(r.kind):]
+}
+
+// encodeFlat writes the n values at p at once
+func (e *Encoder) encodeFlat(l *flatLayout, p unsafe.Pointer, n int) error {
+	l.put(e.grow(n*l.size), p, n)
+	return e.written()
+}
+
+// decodeFlat reads n values to the array or slice v. They're read in
+// chunks of about readChunk bytes, and slices grow as they arrive, so
+// truncated input fails before allocating for all of them
+func (d *Decoder) decodeFlat(l *flatLayout, v reflect.Value, n int) error {
+	per := readChunk / l.size
+	if per == 0 {
+		per = 1
+	}
+	for i := 0; i < n; i += per {
+		if n-i < per {
+			per = n - i
+		}
+		start := d.r.n
+		b, err := d.read(per * l.size)
+		if err != nil {
+			// the element that was cut
+			j := i + int(d.r.n-start)/l.size
+			return pathError(err, v.Type().Elem(), d.r.n, indexSegment(j))
+		}
+		var p unsafe.Pointer
+		if v.Kind() == reflect.Slice {
+			v.Grow(per)
+			v.SetLen(i + per)
+			p = unsafe.Pointer(v.Pointer())
+		} else {
+			p = unsafe.Pointer(v.UnsafeAddr())
+		}
+		l.get(b, unsafe.Add(p, uintptr(i)*l.memSize), per)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package structtools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type sample struct {
+	T     int64
+	X, Y  float32
+	Ok    bool
+	Axes  [3]int16
+	Level uint8
+	Temp  complex64
+}
+
+func TestFlatSlices(t *testing.T) {
+	in := make([]sample, 1000)
+	for i := range in {
+		in[i] = sample{int64(i), float32(i) / 2, -float32(i), i%2 == 0, [3]int16{1, int16(-i), 3}, uint8(i), complex(1, float32(i))}
+	}
+	for _, bo := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		// the same as encoding/binary, after the length
+		want := &bytes.Buffer{}
+		binary.Write(want, bo, uint32(len(in)))
+		binary.Write(want, bo, in)
+		got := &bytes.Buffer{}
+		enc := NewEncoder(got)
+		enc.ByteOrder = bo
+		if err := enc.Encode(in); err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Error("got different values")
+			return
+		}
+		var out []sample
+		dec := NewDecoder(got)
+		dec.ByteOrder = bo
+		if err := dec.Decode(&out); err != nil {
+			t.Error(err)
+			return
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Error("got different values")
+			return
+		}
+	}
+
+	// longer than a chunk
+	big := make([]float64, readChunk)
+	for i := range big {
+		big[i] = float64(i) * 1.5
+	}
+	b, err := Marshal(big)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var bigOut []float64
+	if _, err := Unmarshal(b, &bigOut); err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(bigOut, big) {
+		t.Error("got different values")
+		return
+	}
+	// cut in the element 3000
+	_, err = Unmarshal(b[:4+3000*8+3], &bigOut)
+	if fe, ok := err.(*FieldError); !ok || fe.Path != "[]float64[3000]" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("got unexpected error:", err)
+		return
+	}
+}
+
+func TestFlatArrays(t *testing.T) {
+	type mixed struct {
+		A [2]uint16 `bin:",le"`
+		B [2]uint16
+		C [2]int `bin:",varint"`
+		D [2]bool
+	}
+	v := mixed{[2]uint16{1, 2}, [2]uint16{3, 4}, [2]int{-1, 300}, [2]bool{true, false}}
+	for _, x := range []interface{}{v, &v} {
+		b, err := Marshal(x)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(b, []byte{1, 0, 2, 0, 0, 3, 0, 4, 1, 0xd8, 4, 1, 0}) {
+			t.Errorf("got different values: %x", b)
+			return
+		}
+	}
+	// bytes other than 0 are true, like for single bools
+	var out mixed
+	if _, err := Unmarshal([]byte{1, 0, 2, 0, 0, 3, 0, 4, 1, 0xd8, 4, 2, 0}, &out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out != v {
+		t.Error("got different values", out)
+		return
+	}
+}
+
+func TestFlatEmpty(t *testing.T) {
+	type empty struct {
+		A [0]int32
+	}
+	for _, v := range []interface{}{make([][0]int32, 3), make([]empty, 3), [2]empty{}} {
+		b, err := Marshal(v)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		out := reflect.New(reflect.TypeOf(v))
+		if _, err := Unmarshal(b, out.Interface()); err != nil {
+			t.Error(err)
+			return
+		}
+		if !reflect.DeepEqual(out.Elem().Interface(), v) {
+			t.Error("got different values", out.Elem())
+			return
+		}
+	}
+}
+
+func BenchmarkMarshalFloats(b *testing.B) {
+	v := make([]float64, 1<<20)
+	buf := make([]byte, 0, 4+8*len(v))
+	b.SetBytes(int64(8 * len(v)))
+	for i := 0; i < b.N; i++ {
+		if _, err := AppendMarshal(buf, v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalFloats(b *testing.B) {
+	data, err := Marshal(make([]float64, 1<<20))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		var v []float64
+		if _, err := Unmarshal(data, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
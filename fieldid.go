@@ -0,0 +1,188 @@
+package structtools
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// hasFieldIDs reports if the struct fields are numbered
+// with the "id" tag option. checkFieldIDs made sure it's
+// all of them or none
+func hasFieldIDs(fields []field) bool {
+	return len(fields) > 0 && fields[0].tag.id > 0
+}
+
+// checkFieldIDs checks that every field has a different id,
+// or that none of them has one
+func checkFieldIDs(t reflect.Type, fields []field) error {
+	ids := make(map[int]string)
+	for _, f := range fields {
+		if f.tag.id == 0 {
+			continue
+		}
+		if other, ok := ids[f.tag.id]; ok {
+			return fmt.Errorf("fields %s.%s and %s.%s have the same id %d", t, other, t, f.name, f.tag.id)
+		}
+		ids[f.tag.id] = f.name
+	}
+	if len(ids) > 0 && len(ids) < len(fields) {
+		for _, f := range fields {
+			if f.tag.id == 0 {
+				return fmt.Errorf("field %s.%s has no id", t, f.name)
+			}
+		}
+	}
+	return nil
+}
+
+// encodeFieldIDs writes the fields of a struct as their
+// id, the length of the value and the value, then a 0 id
+func encodeFieldIDs(fields []field, o codecOptions) encodeFunc {
+	return func(e *Encoder, v reflect.Value) error {
+		// the lengths are inserted in the buffer
+		e.hold++
+		defer func() { e.hold-- }()
+		for _, f := range fields {
+			fv := f.value(v)
+			if isMissing(fv, o) {
+				continue
+			}
+			if err := e.putUvarint(uint64(f.tag.id)); err != nil {
+				return err
+			}
+			start := len(e.buf)
+			if err := f.codec.enc(e, fv); err != nil {
+				return pathError(err, f.typ, e.offset(), f.segment())
+			}
+			e.insertUvarint(start, uint64(len(e.buf)-start))
+		}
+		return e.putUvarint(0)
+	}
+}
+
+// sizeFieldIDs is the sizeFunc of encodeFieldIDs
+func sizeFieldIDs(fields []field, o codecOptions) sizeFunc {
+	return func(v reflect.Value) (int, error) {
+		n := 0
+		for _, f := range fields {
+			fv := f.value(v)
+			if isMissing(fv, o) {
+				continue
+			}
+			fn, err := f.codec.size(fv)
+			if err != nil {
+				return 0, pathError(err, f.typ, -1, f.segment())
+			}
+			n += uvarintSize(uint64(f.tag.id)) + uvarintSize(uint64(fn)) + fn
+		}
+		// the 0 id
+		return n + 1, nil
+	}
+}
+
+// isMissing reports if the field value v is left out of the stream:
+// without presence bytes a nil pointer would be written as nothing,
+// which can't be told from a pointer to an empty value
+func isMissing(v reflect.Value, o codecOptions) bool {
+	return o.presence == NoPresence && v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+// insertUvarint inserts n at the position pos of the buffer
+func (e *Encoder) insertUvarint(pos int, n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(b[:], n)
+	e.buf = append(e.buf, b[:l]...)
+	copy(e.buf[pos+l:], e.buf[pos:len(e.buf)-l])
+	copy(e.buf[pos:], b[:l])
+}
+
+// decodeFieldIDs reads a struct written by encodeFieldIDs. Unknown
+// fields are skipped and missing fields, like nil pointers written
+// without presence, are left as they are
+func decodeFieldIDs(fields []field) decodeFunc {
+	byID := make(map[uint64]*field, len(fields))
+	for i := range fields {
+		byID[uint64(fields[i].tag.id)] = &fields[i]
+	}
+	return func(d *Decoder, v reflect.Value) error {
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		for first := true; ; first = false {
+			id, err := d.uvarint()
+			if err != nil {
+				if err == io.EOF && !first {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			if id == 0 {
+				return nil
+			}
+			n, err := d.fieldLength()
+			if err != nil {
+				return err
+			}
+			f, ok := byID[id]
+			if !ok {
+				if err := d.skip(n); err != nil {
+					return pathError(err, nil, d.r.n, fmt.Sprintf(".#%d", id))
+				}
+				continue
+			}
+			start := d.r.n
+			if err := f.codec.dec(d, f.value(v)); err != nil {
+				return pathError(err, f.typ, d.r.n, f.segment())
+			}
+			if err := d.skipRest(n, start); err != nil {
+				return pathError(err, f.typ, d.r.n, f.segment())
+			}
+		}
+	}
+}
+
+// fieldLength reads the length of a numbered field
+func (d *Decoder) fieldLength() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if n > uint64(maxInt) {
+		return 0, fmt.Errorf("length %d overflows an int", n)
+	}
+	return int(n), nil
+}
+
+// skipRest skips what's left of a field of n bytes that started at
+// the offset start, a newer version of its type may have written more
+func (d *Decoder) skipRest(n int, start int64) error {
+	used := d.r.n - start
+	if used > int64(n) {
+		return fmt.Errorf("value of %d bytes is longer than its length %d", used, n)
+	}
+	return d.skip(n - int(used))
+}
+
+// skip discards n bytes
+func (d *Decoder) skip(n int) error {
+	for n > 0 {
+		c := n
+		if c > readChunk {
+			c = readChunk
+		}
+		if _, err := d.read(c); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package structtools
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type recordV1 struct {
+	A uint16 `bin:",id=1"`
+	B string `bin:",id=2"`
+}
+
+type recordV2 struct {
+	B string  `bin:",id=2"`
+	C []int8  `bin:",id=3"`
+	A uint16  `bin:",id=1"`
+	D *uint32 `bin:",id=4"`
+}
+
+func TestFieldIDs(t *testing.T) {
+	b, err := Marshal(recordV1{5, "hi"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "01"+"02"+"0005"+"02"+"06"+"000000026869"+"00" {
+		t.Error("got different values:", xs)
+		return
+	}
+	// new readers leave missing fields as they are
+	def := uint32(9)
+	v2 := recordV2{D: &def}
+	if _, err := Unmarshal(b, &v2); err != nil {
+		t.Error(err)
+		return
+	}
+	if v2.A != 5 || v2.B != "hi" || v2.C != nil || *v2.D != 9 {
+		t.Error("got different values", v2)
+		return
+	}
+	// old readers skip unknown fields
+	v2.C = []int8{-1, 2}
+	if b, err = Marshal(v2); err != nil {
+		t.Error(err)
+		return
+	}
+	var v1 recordV1
+	if n, err := Unmarshal(b, &v1); err != nil || n != len(b) {
+		t.Error(err, n, len(b))
+		return
+	}
+	if v1 != (recordV1{5, "hi"}) {
+		t.Error("got different values", v1)
+		return
+	}
+
+	// values larger than the buffer of the Encoder
+	buf := &bytes.Buffer{}
+	big := recordV1{1, strings.Repeat("x", 3*flushSize)}
+	if err := NewEncoder(buf).Encode(big); err != nil {
+		t.Error(err)
+		return
+	}
+	v1 = recordV1{}
+	if err := NewDecoder(buf).Decode(&v1); err != nil {
+		t.Error(err)
+		return
+	}
+	if v1 != big {
+		t.Error("got different values")
+		return
+	}
+
+	// and in self-describing streams
+	buf.Reset()
+	enc := NewEncoder(buf)
+	enc.SelfDescribing = true
+	if err := enc.Encode(v2); err != nil {
+		t.Error(err)
+		return
+	}
+	dec := NewDecoder(buf)
+	dec.SelfDescribing = true
+	var g interface{}
+	if err := dec.Decode(&g); err != nil {
+		t.Error(err)
+		return
+	}
+	exp := map[string]interface{}{"A": uint16(5), "B": "hi", "C": []interface{}{int8(-1), int8(2)}, "D": uint32(9)}
+	if !reflect.DeepEqual(g, exp) {
+		t.Error("got different values", g, exp)
+		return
+	}
+}
+
+func TestFieldIDNilPointers(t *testing.T) {
+	// nil pointers are left out without presence bytes
+	v := recordV2{A: 5}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "02"+"04"+"00000000"+"03"+"04"+"00000000"+"01"+"02"+"0005"+"00" {
+		t.Error("got different values:", xs)
+		return
+	}
+	if n, err := Size(v); err != nil || n != len(b) {
+		t.Error("got different sizes:", n, len(b), err)
+		return
+	}
+	var out recordV2
+	if _, err := Unmarshal(b, &out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out.A != 5 || out.D != nil {
+		t.Error("got different values", out)
+		return
+	}
+
+	// and written with them
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, Presence: PointerPresence}
+	if b, err = enc.Append(nil, v); err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); !strings.HasSuffix(xs, "04"+"01"+"00"+"00") {
+		t.Error("got different values:", xs)
+		return
+	}
+}
+
+func TestFieldIDErrors(t *testing.T) {
+	type mixed struct {
+		A uint8 `bin:",id=1"`
+		B uint8
+	}
+	type duplicated struct {
+		A uint8 `bin:",id=1"`
+		B uint8 `bin:",id=1"`
+	}
+	type packed struct {
+		A uint8 `bin:",id=1,bits=3"`
+	}
+	for _, v := range []interface{}{mixed{}, duplicated{}, packed{}} {
+		if _, err := Marshal(v); err == nil {
+			t.Errorf("expecting an error for %T", v)
+			return
+		}
+	}
+	for _, h := range []string{
+		// A is longer than its length
+		"01" + "01" + "0005" + "00",
+		// the length of an unknown field goes past the end
+		"07" + "05" + "0000",
+		// no end
+		"01" + "02" + "0005",
+	} {
+		b, _ := hex.DecodeString(h)
+		if _, err := Unmarshal(b, &recordV1{}); err == nil {
+			t.Error("expecting an error for", h)
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package structtools
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// structFields returns the fields of the struct t like fields does,
+// and the padding after the last one. In the C layout, the padding
+// before each field is set
+func (b *planBuilder) structFields(t reflect.Type, o codecOptions) ([]field, int, error) {
+	fields, err := b.fields(t, o)
+	if err != nil || o.layout != CLayout {
+		return fields, 0, err
+	}
+	tail, err := b.padFields(t, o, fields)
+	return fields, tail, err
+}
+
+// padFields sets the padding before the fields of the struct t
+// in the C layout, and returns the padding after the last one
+func (b *planBuilder) padFields(t reflect.Type, o codecOptions, fields []field) (int, error) {
+	if hasFieldIDs(fields) {
+		return 0, fmt.Errorf("numbered fields of %s can't be laid out like C", t)
+	}
+	off, align := 0, 1
+	for i := range fields {
+		f := &fields[i]
+		if f.bits != nil {
+			return 0, fmt.Errorf("bit-fields of %s can't be laid out like C", t)
+		}
+		// fixed is -1 for types that contain themselves
+		size := f.codec.fixed
+		if size < 0 {
+			return 0, fmt.Errorf("field %s.%s has no fixed size, it can't be laid out like C", t, f.name)
+		}
+		a := b.fieldAlign(f, o)
+		f.pad = padding(off, a)
+		off += f.pad + size
+		if a > align {
+			align = a
+		}
+	}
+	return padding(off, align), nil
+}
+
+// fieldAlign returns the alignment of the field f in the C layout
+func (b *planBuilder) fieldAlign(f *field, o codecOptions) int {
+	switch {
+	case f.tag.align > 0:
+		return f.tag.align
+	case f.tag.packed:
+		return 1
+	}
+	return b.alignOf(f.typ, f.tag.apply(o))
+}
+
+// alignOf returns the alignment of the values of type t in the C
+// layout, the size of numbers. Bytes and strings aren't aligned, and arrays and structs are aligned like their elements.
+// Times are aligned like the int64 they start with
+func (b *planBuilder) alignOf(t reflect.Type, o codecOptions) int {
+	if t == timeType && isBuiltin(t, o) {
+		return 8
+	}
+	switch t.Kind() {
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int, reflect.Int32, reflect.Uint, reflect.Uint32, reflect.Float32, reflect.Complex64:
+		return 4
+	case reflect.Int64, reflect.Uint64, reflect.Float64, reflect.Complex128:
+		return 8
+	case reflect.Array:
+		return b.alignOf(t.Elem(), o.elem())
+	case reflect.Slice:
+		if !isPaddedBytes(t) {
+			return b.alignOf(t.Elem(), o.elem())
+		}
+	case reflect.Struct:
+		fields, err := b.fields(t, o)
+		if err != nil {
+			return 1
+		}
+		align := 1
+		for i := range fields {
+			if a := b.fieldAlign(&fields[i], o); a > align {
+				align = a
+			}
+		}
+		return align
+	}
+	return 1
+}
+
+// padding returns the bytes needed after off to align it to a
+func padding(off, a int) int {
+	return (a - off%a) % a
+}
+
+// putZeros writes n zeros, the padding of the C layout
+func (e *Encoder) putZeros(n int) error {
+	b := e.grow(n)
+	for i := range b {
+		b[i] = 0
+	}
+	return e.written()
+}
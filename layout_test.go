@@ -0,0 +1,147 @@
+package structtools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type cPoint struct {
+	X uint8
+	Y uint16
+}
+
+type cHeader struct {
+	A uint8
+	B uint32
+	C uint16
+	D int
+	E [3]uint8
+	F float64
+	G cPoint
+	H [2]cPoint
+}
+
+func TestCLayout(t *testing.T) {
+	v := cHeader{1, 2, 3, -4, [3]uint8{5, 6, 7}, 0.5, cPoint{8, 9}, [2]cPoint{{10, 11}, {12, 13}}}
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	enc.ByteOrder, enc.Layout = binary.LittleEndian, CLayout
+	if err := enc.Encode(v); err != nil {
+		t.Error(err)
+		return
+	}
+	exp := strings.Join([]string{
+		"01" + "000000",
+		"02000000",
+		"0300" + "0000",
+		"fcffffff",
+		"050607" + "0000000000",
+		"000000000000e03f",
+		"08" + "00" + "0900",
+		"0a" + "00" + "0b00" + "0c" + "00" + "0d00",
+		// up to the alignment of F
+		"00000000",
+	}, "")
+	if xs := hex.EncodeToString(buf.Bytes()); xs != exp {
+		t.Error("got different values:", xs)
+		return
+	}
+	if n, err := enc.Size(v); err != nil || n != buf.Len() {
+		t.Error("got different sizes:", n, err)
+		return
+	}
+
+	var out cHeader
+	dec := NewDecoder(buf)
+	dec.ByteOrder, dec.Layout = binary.LittleEndian, CLayout
+	if err := dec.Decode(&out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out != v {
+		t.Error("got different values", out)
+		return
+	}
+	if buf.Len() != 0 {
+		t.Error("got bytes left:", buf.Len())
+		return
+	}
+}
+
+func TestCLayoutTags(t *testing.T) {
+	type rec struct {
+		A uint8
+		B uint32 `bin:",packed"`
+		C uint8
+		D uint16 `bin:",align=8"`
+		E cPoint `bin:",packed"`
+		F string `bin:",size=3"`
+		G uint16 `bin:",le"`
+	}
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, Layout: CLayout}
+	b, err := enc.Append(nil, rec{1, 2, 3, 4, cPoint{5, 6}, "ab", 8})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	exp := strings.Join([]string{
+		"01",
+		"00000002",
+		"03",
+		"0000" + "0004",
+		// packed fields keep their own padding
+		"05" + "00" + "0006",
+		"616200",
+		"00" + "0800",
+		// aligned to 8 by D
+		"00000000",
+	}, "")
+	if xs := hex.EncodeToString(b); xs != exp {
+		t.Error("got different values:", xs)
+		return
+	}
+	if n, ok := FixedSize(reflect.TypeOf(rec{})); !ok || n >= len(b) {
+		t.Error("the packed layout must be smaller:", n, ok)
+		return
+	}
+}
+
+func TestCLayoutErrors(t *testing.T) {
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, Layout: CLayout}
+	for _, v := range []interface{}{
+		struct{ S string }{},
+		struct{ P *uint8 }{},
+		struct {
+			A uint8 `bin:",id=1"`
+		}{},
+		struct {
+			A int32 `bin:",varint"`
+		}{},
+		struct{ A int }{1 << 40},
+		struct{ A uint }{1 << 40},
+		struct {
+			A uint32 `bin:",bits=3"`
+			B uint8
+		}{},
+	} {
+		if _, err := enc.Append(nil, v); err == nil {
+			t.Error("expecting an error", v)
+			return
+		}
+	}
+	enc.SelfDescribing = true
+	if _, err := enc.Append(nil, cPoint{}); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+	for _, tag := range []string{",align=3", ",align=0", ",bits=1,packed"} {
+		if _, err := parseFieldTag(tag, true); err == nil {
+			t.Error("expecting an error", tag)
+			return
+		}
+	}
+}
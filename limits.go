@@ -0,0 +1,85 @@
+package structtools
+
+import "fmt"
+
+// Limits bounds the resources a Decoder uses for a single call to
+// Decode. They're checked before allocating, so hostile input can't
+// make the Decoder allocate more than allowed. Zero means no limit.
+type Limits struct {
+	// bytes in a single string or slice
+	MaxBytes int64
+	// elements in a single slice or map
+	MaxElements int
+	// bytes allocated for strings, slices, maps and pointers
+	MaxAlloc int64
+	// nesting depth of pointers, structs, arrays, slices and maps
+	MaxDepth int
+}
+
+// LimitError is returned by the Decoder, wrapped in a *FieldError,
+// when the input exceeds one of its Limits
+type LimitError struct {
+	// name of the limit, e.g. "MaxBytes"
+	Limit string
+	// value the input asked for
+	Value int64
+	// value of the limit
+	Max int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeded: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// alloc accounts for n bytes about to be allocated
+func (d *Decoder) alloc(n int64) error {
+	if max := d.Limits.MaxAlloc; max > 0 && n > max-d.allocated {
+		// d.allocated+n may overflow
+		total := maxInt64
+		if n <= maxInt64-d.allocated {
+			total = d.allocated + n
+		}
+		return &LimitError{Limit: "MaxAlloc", Value: total, Max: max}
+	}
+	d.allocated += n
+	return nil
+}
+
+// allocBytes checks a string or byte slice of n bytes
+func (d *Decoder) allocBytes(n int) error {
+	if max := d.Limits.MaxBytes; max > 0 && int64(n) > max {
+		return &LimitError{Limit: "MaxBytes", Value: int64(n), Max: max}
+	}
+	return d.alloc(int64(n))
+}
+
+// allocElements checks a slice or map of n elements of size bytes each
+func (d *Decoder) allocElements(n int, size uintptr) error {
+	if max := d.Limits.MaxElements; max > 0 && n > max {
+		return &LimitError{Limit: "MaxElements", Value: int64(n), Max: int64(max)}
+	}
+	total := int64(n) * int64(size)
+	if size != 0 && total/int64(size) != int64(n) {
+		// overflow
+		total = maxInt64
+	}
+	if max := d.Limits.MaxBytes; max > 0 && total > max {
+		return &LimitError{Limit: "MaxBytes", Value: total, Max: max}
+	}
+	return d.alloc(total)
+}
+
+const maxInt64 = int64(^uint64(0) >> 1)
+
+// enter is called when decoding a nested value,
+// leave must be called when it's done
+func (d *Decoder) enter() error {
+	d.depth++
+	if max := d.Limits.MaxDepth; max > 0 && d.depth > max {
+		d.depth--
+		return &LimitError{Limit: "MaxDepth", Value: int64(d.depth + 1), Max: int64(max)}
+	}
+	return nil
+}
+
+func (d *Decoder) leave() { d.depth-- }
@@ -0,0 +1,78 @@
+package structtools
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	type rec struct {
+		S string
+		L []uint32
+		M map[uint8]uint8
+	}
+	tests := []struct {
+		limits Limits
+		hex    string
+		limit  string
+	}{
+		// a 4 GiB string in a 10 bytes payload
+		{Limits{MaxBytes: 1024}, "ffffffff" + "000000", "MaxBytes"},
+		{Limits{MaxBytes: 8}, "00000000" + "00000003", "MaxBytes"},
+		{Limits{MaxElements: 2}, "00000000" + "00000003", "MaxElements"},
+		{Limits{MaxElements: 2}, "00000000" + "00000000" + "00000003", "MaxElements"},
+		{Limits{MaxAlloc: 10}, "00000006" + "616263646566" + "00000002", "MaxAlloc"},
+		{Limits{MaxDepth: 1}, "00000000" + "00000001", "MaxDepth"},
+	}
+	for i, test := range tests {
+		b, _ := hex.DecodeString(test.hex)
+		dec := NewDecoder(bytes.NewReader(b))
+		dec.Limits = test.limits
+		err := dec.Decode(&rec{})
+		fe, ok := err.(*FieldError)
+		if !ok {
+			t.Errorf("test %d: expecting a *FieldError, got: %v", i, err)
+			return
+		}
+		if le, ok := fe.Err.(*LimitError); !ok || le.Limit != test.limit {
+			t.Errorf("test %d: expecting a %s *LimitError, got: %v", i, test.limit, err)
+			return
+		}
+	}
+
+	// within the limits
+	b, _ := hex.DecodeString("00000001" + "61" + "00000001" + "00000002" + "00000001" + "0304")
+	dec := NewDecoder(bytes.NewReader(b))
+	dec.Limits = Limits{MaxBytes: 4, MaxElements: 1, MaxAlloc: 16, MaxDepth: 2}
+	var out rec
+	if err := dec.Decode(&out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out.S != "a" || len(out.L) != 1 || out.L[0] != 2 || out.M[3] != 4 {
+		t.Error("got different values", out)
+		return
+	}
+
+	// the total would overflow
+	dec = NewBytesDecoder(nil)
+	dec.Limits = Limits{MaxAlloc: maxInt64}
+	if err := dec.alloc(maxInt64); err != nil {
+		t.Error(err)
+		return
+	}
+	err := dec.alloc(maxInt64)
+	if le, ok := err.(*LimitError); !ok || le.Value != maxInt64 {
+		t.Error("expecting a MaxAlloc *LimitError, got:", err)
+		return
+	}
+}
+
+func TestReadNUntrustedLength(t *testing.T) {
+	// the length is huge, but there's little data
+	if _, err := readN(bytes.NewReader(make([]byte, 10)), 1<<30); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
@@ -0,0 +1,1043 @@
+package structtools
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// encodeFunc writes v to the encoder
+type encodeFunc func(e *Encoder, v reflect.Value) error
+
+// decodeFunc reads into v, which must be settable
+type decodeFunc func(d *Decoder, v reflect.Value) error
+
+// codec is the compiled plan for a type. Plans for recursive types
+// reference each other through *codec, so enc and dec must only be
+// read when the plan is executed, never while it's being built.
+type codec struct {
+	enc  encodeFunc
+	dec  decodeFunc
+	size sizeFunc
+	// size of every value, or -1 if it depends on the value. It's
+	// -1 while the plan is being built, types that reach themselves
+	// can't have a fixed size
+	fixed int
+	// set if the values are only made of numbers and bools
+	flat *flatLayout
+}
+
+// codecOptions holds every Encoder/Decoder setting that changes
+// the shape of a compiled plan
+type codecOptions struct {
+	tag        string
+	onlyTagged bool
+	byteOrder  binary.ByteOrder
+	presence   PresenceMode
+	varint     bool
+	lenWidth   LenWidth
+	layout     LayoutMode
+	timeFormat TimeFormat
+	// only set by the "size", "pad" and "cstr" tag
+	// options, never inherited by elements
+	size int
+	pad  byte
+	cstr bool
+}
+
+// elem returns the options for the elements of a value
+func (o codecOptions) elem() codecOptions {
+	o.size, o.pad, o.cstr = 0, 0, false
+	return o
+}
+
+// lenPrefix resolves LenDefault
+func (o codecOptions) lenPrefix() LenWidth {
+	if o.lenWidth != LenDefault {
+		return o.lenWidth
+	}
+	if o.varint {
+		return LenVarint
+	}
+	return Len32
+}
+
+// cacheable reports if the options can be used as a map key
+func (o codecOptions) cacheable() bool {
+	return o.byteOrder == nil || reflect.TypeOf(o.byteOrder).Comparable()
+}
+
+type planKey struct {
+	typ  reflect.Type
+	opts codecOptions
+}
+
+// compiled plans, shared by every Encoder and Decoder
+var plans = struct {
+	sync.RWMutex
+	m map[planKey]*codec
+}{m: make(map[planKey]*codec)}
+
+func cachedCodec(k planKey) *codec {
+	plans.RLock()
+	c := plans.m[k]
+	plans.RUnlock()
+	return c
+}
+
+// codecFor returns the plan for t, compiling it if needed
+func codecFor(t reflect.Type, opts codecOptions) *codec {
+	if !opts.cacheable() {
+		return newPlanBuilder().codec(t, opts)
+	}
+	if c := cachedCodec(planKey{t, opts}); c != nil {
+		return c
+	}
+	b := newPlanBuilder()
+	c := b.codec(t, opts)
+	plans.Lock()
+	for k, bc := range b.building {
+		if _, ok := plans.m[k]; !ok {
+			plans.m[k] = bc
+		}
+	}
+	plans.Unlock()
+	return c
+}
+
+// planBuilder compiles the plans for a type and every type it reaches.
+// Struct tags can change the options used for a field, so the same
+// type can be compiled with different options.
+type planBuilder struct {
+	building map[planKey]*codec
+}
+
+func newPlanBuilder() *planBuilder {
+	return &planBuilder{building: make(map[planKey]*codec)}
+}
+
+func (b *planBuilder) codec(t reflect.Type, o codecOptions) *codec {
+	k := planKey{t, o}
+	if !o.cacheable() {
+		// the plan isn't cached, so the key is only used while building
+		// it, and it can only have one byte order that isn't comparable
+		k.opts.byteOrder = nil
+	} else if c := cachedCodec(k); c != nil {
+		return c
+	}
+	if c, ok := b.building[k]; ok {
+		return c
+	}
+	c := &codec{fixed: -1}
+	b.building[k] = c
+	if bc := builtinCodec(t, o); bc != nil {
+		*c = *bc
+		return c
+	}
+	c.flat = b.flatLayout(t, o)
+	c.enc = b.encoder(t, o)
+	c.dec = b.decoder(t, o)
+	fixed := b.fixedSize(t, o)
+	c.size = b.sizer(t, o, fixed)
+	c.fixed = fixed
+	return c
+}
+
+var (
+	marshalerType         = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType       = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// isMarshaler reports if t or *t implements Marshaler
+func isMarshaler(t reflect.Type) bool {
+	return t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType)
+}
+
+// isBinaryMarshaler reports if *t implements encoding.BinaryMarshaler
+// and encoding.BinaryUnmarshaler. Implementing only one of them isn't
+// enough, values couldn't be decoded the way they were encoded.
+func isBinaryMarshaler(t reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	return pt.Implements(binaryMarshalerType) && pt.Implements(binaryUnmarshalerType)
+}
+
+// hasMarshaler reports if values of type t marshal themselves
+func hasMarshaler(t reflect.Type) bool {
+	return isMarshaler(t) || isBinaryMarshaler(t)
+}
+
+// marshaler returns v, or a pointer to v if the marshaler methods
+// of its type have a pointer receiver. If v isn't addressable, the
+// pointer is to a copy of v.
+func marshaler(v reflect.Value, ptrReceiver bool) interface{} {
+	if !ptrReceiver {
+		return v.Interface()
+	}
+	if v.CanAddr() {
+		return v.Addr().Interface()
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p.Interface()
+}
+
+// isBasic reports if t is handled as a primitive. Named types
+// are handled exactly like their underlying type.
+func isBasic(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	}
+	return false
+}
+
+func forbiddenKindError(k reflect.Kind) error { return fmt.Errorf("can't handle %s", k.String()) }
+
+// pathError prefixes the path of err with seg. If err isn't a
+// *FieldError yet, a value of type t failed at the given offset.
+func pathError(err error, t reflect.Type, offset int64, seg string) error {
+	fe, ok := err.(*FieldError)
+	if !ok {
+		fe = &FieldError{Type: t, Offset: offset, Err: err}
+	}
+	fe.Path = seg + fe.Path
+	return fe
+}
+
+func indexSegment(i int) string { return "[" + strconv.Itoa(i) + "]" }
+
+func keySegment(k reflect.Value) string { return fmt.Sprintf("[%v]", k.Interface()) }
+
+func (b *planBuilder) encoder(t reflect.Type, o codecOptions) encodeFunc {
+	k := t.Kind()
+	if isForbiddenKind(k) != reflect.Invalid {
+		return func(*Encoder, reflect.Value) error { return forbiddenKindError(k) }
+	}
+
+	// got a marshaler. A pointer to a value marshaler is handled below
+	// so a nil pointer is skipped instead of being dereferenced
+	if hasMarshaler(t) && (k != reflect.Ptr || !hasMarshaler(t.Elem())) {
+		if isMarshaler(t) {
+			ptrReceiver := !t.Implements(marshalerType)
+			return func(e *Encoder, v reflect.Value) error {
+				_, err := marshaler(v, ptrReceiver).(Marshaler).MarshalBinary((*bufWriter)(e))
+				return err
+			}
+		}
+		// encoding.BinaryMarshaler, written as a length prefixed blob
+		ptrReceiver := !t.Implements(binaryMarshalerType)
+		return func(e *Encoder, v reflect.Value) error {
+			b, err := marshaler(v, ptrReceiver).(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := e.putLen(o, len(b)); err != nil {
+				return err
+			}
+			return e.write(b)
+		}
+	}
+
+	if isBasic(t) {
+		return b.basicEncoder(t, o)
+	}
+
+	switch k {
+	case reflect.Interface:
+		// the value is preceded by its registered name
+		o := o.elem()
+		return func(e *Encoder, v reflect.Value) error { return encodeInterface(e, o, v) }
+	case reflect.Ptr:
+		elem := b.codec(t.Elem(), o)
+		if o.presence != NoPresence {
+			return func(e *Encoder, v reflect.Value) error {
+				if err := e.putPresence(!v.IsNil()); err != nil || v.IsNil() {
+					return err
+				}
+				return elem.enc(e, v.Elem())
+			}
+		}
+		return func(e *Encoder, v reflect.Value) error {
+			// anything to marshal
+			if v.IsNil() {
+				return nil
+			}
+			return elem.enc(e, v.Elem())
+		}
+	case reflect.Struct:
+		fields, tail, err := b.structFields(t, o)
+		if err != nil {
+			return func(*Encoder, reflect.Value) error { return err }
+		}
+		if hasFieldIDs(fields) {
+			return encodeFieldIDs(fields, o)
+		}
+		return func(e *Encoder, v reflect.Value) error {
+			for _, f := range fields {
+				if f.pad > 0 {
+					if err := e.putZeros(f.pad); err != nil {
+						return err
+					}
+				}
+				if err := f.codec.enc(e, f.value(v)); err != nil {
+					return pathError(err, f.typ, e.offset(), f.segment())
+				}
+			}
+			if tail > 0 {
+				return e.putZeros(tail)
+			}
+			return nil
+		}
+	case reflect.Array:
+		elem := b.codec(t.Elem(), o.elem())
+		return func(e *Encoder, v reflect.Value) error {
+			if elem.flat != nil && v.CanAddr() {
+				return e.encodeFlat(elem.flat, unsafe.Pointer(v.UnsafeAddr()), v.Len())
+			}
+			for i := 0; i < v.Len(); i++ {
+				if err := elem.enc(e, v.Index(i)); err != nil {
+					return pathError(err, t.Elem(), e.offset(), indexSegment(i))
+				}
+			}
+			return nil
+		}
+	case reflect.Slice:
+		if o.size > 0 && isPaddedBytes(t) {
+			return b.markNilEncoder(o, func(e *Encoder, v reflect.Value) error { return e.putPadded(o, v.Bytes()) })
+		}
+		if isPaddedBytes(t) {
+			// the same as encoding byte by byte
+			return b.markNilEncoder(o, func(e *Encoder, v reflect.Value) error {
+				if err := e.putLenOrSize(o, v.Len()); err != nil {
+					return err
+				}
+				return e.write(v.Bytes())
+			})
+		}
+		elem := b.codec(t.Elem(), o.elem())
+		return b.markNilEncoder(o, func(e *Encoder, v reflect.Value) error {
+			if err := e.putLenOrSize(o, v.Len()); err != nil {
+				return err
+			}
+			if elem.flat != nil {
+				return e.encodeFlat(elem.flat, unsafe.Pointer(v.Pointer()), v.Len())
+			}
+			for i := 0; i < v.Len(); i++ {
+				if err := elem.enc(e, v.Index(i)); err != nil {
+					return pathError(err, t.Elem(), e.offset(), indexSegment(i))
+				}
+			}
+			return nil
+		})
+	case reflect.Map:
+		key, elem := b.codec(t.Key(), o.elem()), b.codec(t.Elem(), o.elem())
+		return b.markNilEncoder(o, func(e *Encoder, v reflect.Value) error {
+			if err := e.putLen(o, v.Len()); err != nil {
+				return err
+			}
+			if !e.UnsortedMaps {
+				return encodeSortedMap(e, key, elem, v)
+			}
+			for _, k := range v.MapKeys() {
+				if err := key.enc(e, k); err != nil {
+					return pathError(err, t.Key(), e.offset(), keySegment(k))
+				}
+				if err := elem.enc(e, v.MapIndex(k)); err != nil {
+					return pathError(err, t.Elem(), e.offset(), keySegment(k))
+				}
+			}
+			return nil
+		})
+	}
+	// nothing we know how to write
+	return func(*Encoder, reflect.Value) error { return nil }
+}
+
+func (b *planBuilder) basicEncoder(t reflect.Type, o codecOptions) encodeFunc {
+	if o.varint {
+		switch t.Kind() {
+		case reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+			return func(e *Encoder, v reflect.Value) error { return e.putVarint(v.Int()) }
+		case reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+			return func(e *Encoder, v reflect.Value) error { return e.putUvarint(v.Uint()) }
+		}
+	}
+	bo := o.byteOrder
+	if o.layout == CLayout {
+		// C int and unsigned int
+		switch t.Kind() {
+		case reflect.Int:
+			return func(e *Encoder, v reflect.Value) error {
+				n := v.Int()
+				if n < math.MinInt32 || n > math.MaxInt32 {
+					return fmt.Errorf("%d overflows a C int", n)
+				}
+				return e.putUint32(bo, uint32(n))
+			}
+		case reflect.Uint:
+			return func(e *Encoder, v reflect.Value) error {
+				n := v.Uint()
+				if n > math.MaxUint32 {
+					return fmt.Errorf("%d overflows a C unsigned int", n)
+				}
+				return e.putUint32(bo, uint32(n))
+			}
+		}
+	}
+	switch t.Kind() {
+	// ints
+	case reflect.Int8:
+		return func(e *Encoder, v reflect.Value) error { return e.writeByte(byte(v.Int())) }
+	case reflect.Uint8:
+		return func(e *Encoder, v reflect.Value) error { return e.writeByte(byte(v.Uint())) }
+	case reflect.Uint16:
+		return func(e *Encoder, v reflect.Value) error { return e.putUint16(bo, uint16(v.Uint())) }
+	case reflect.Uint32:
+		return func(e *Encoder, v reflect.Value) error { return e.putUint32(bo, uint32(v.Uint())) }
+	case reflect.Uint64, reflect.Uint:
+		return func(e *Encoder, v reflect.Value) error { return e.putUint64(bo, v.Uint()) }
+	case reflect.Int16:
+		return func(e *Encoder, v reflect.Value) error { return e.putUint16(bo, uint16(v.Int())) }
+	case reflect.Int32:
+		return func(e *Encoder, v reflect.Value) error { return e.putUint32(bo, uint32(v.Int())) }
+	case reflect.Int64, reflect.Int:
+		return func(e *Encoder, v reflect.Value) error { return e.putUint64(bo, uint64(v.Int())) }
+	// floats
+	case reflect.Float32:
+		return func(e *Encoder, v reflect.Value) error {
+			return e.putUint32(bo, math.Float32bits(float32(v.Float())))
+		}
+	case reflect.Float64:
+		return func(e *Encoder, v reflect.Value) error { return e.putUint64(bo, math.Float64bits(v.Float())) }
+	// complexes
+	case reflect.Complex64:
+		return func(e *Encoder, v reflect.Value) error {
+			c := v.Complex()
+			b := e.grow(8)
+			bo.PutUint32(b, math.Float32bits(float32(real(c))))
+			bo.PutUint32(b[4:], math.Float32bits(float32(imag(c))))
+			return e.written()
+		}
+	case reflect.Complex128:
+		return func(e *Encoder, v reflect.Value) error {
+			c := v.Complex()
+			b := e.grow(16)
+			bo.PutUint64(b, math.Float64bits(real(c)))
+			bo.PutUint64(b[8:], math.Float64bits(imag(c)))
+			return e.written()
+		}
+	// bools
+	case reflect.Bool:
+		return func(e *Encoder, v reflect.Value) error {
+			var bb byte
+			if v.Bool() {
+				bb = 1
+			}
+			return e.writeByte(bb)
+		}
+	// strings
+	case reflect.String:
+		switch {
+		case o.cstr && o.size == 0:
+			return func(e *Encoder, v reflect.Value) error { return e.putCString(v.String()) }
+		case o.size > 0:
+			return func(e *Encoder, v reflect.Value) error { return e.putPadded(o, []byte(v.String())) }
+		}
+		return func(e *Encoder, v reflect.Value) error {
+			s := v.String()
+			if err := e.putLen(o, len(s)); err != nil {
+				return err
+			}
+			return e.writeString(s)
+		}
+	}
+	return func(*Encoder, reflect.Value) error { return nil }
+}
+
+func (b *planBuilder) decoder(t reflect.Type, o codecOptions) decodeFunc {
+	k := t.Kind()
+	if isForbiddenKind(k) != reflect.Invalid {
+		return func(*Decoder, reflect.Value) error { return forbiddenKindError(k) }
+	}
+
+	// got a unmarshaler
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return func(d *Decoder, v reflect.Value) error {
+			_, err := v.Addr().Interface().(Unmarshaler).UnmarshalBinary(d.r)
+			return err
+		}
+	}
+	if isBinaryMarshaler(t) {
+		return func(d *Decoder, v reflect.Value) error {
+			sz, err := d.length(o)
+			if err != nil {
+				return err
+			}
+			if err := d.allocBytes(sz); err != nil {
+				return err
+			}
+			b, err := d.read(sz)
+			if err != nil {
+				return err
+			}
+			return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+		}
+	}
+
+	if isBasic(t) {
+		return b.basicDecoder(t, o)
+	}
+
+	switch k {
+	case reflect.Interface:
+		o := o.elem()
+		return func(d *Decoder, v reflect.Value) error { return decodeInterface(d, o, v) }
+	case reflect.Ptr:
+		elem := b.codec(t.Elem(), o)
+		presence := o.presence != NoPresence
+		return func(d *Decoder, v reflect.Value) error {
+			if presence {
+				if ok, err := d.presence(); err != nil {
+					return err
+				} else if !ok {
+					v.Set(reflect.Zero(t))
+					return nil
+				}
+			}
+			if err := d.enter(); err != nil {
+				return err
+			}
+			defer d.leave()
+			if v.IsNil() {
+				if err := d.alloc(int64(t.Elem().Size())); err != nil {
+					return err
+				}
+				v.Set(reflect.New(t.Elem()))
+			}
+			return elem.dec(d, v.Elem())
+		}
+	case reflect.Struct:
+		fields, tail, err := b.structFields(t, o)
+		if err != nil {
+			return func(*Decoder, reflect.Value) error { return err }
+		}
+		if hasFieldIDs(fields) {
+			return decodeFieldIDs(fields)
+		}
+		return func(d *Decoder, v reflect.Value) error {
+			if err := d.enter(); err != nil {
+				return err
+			}
+			defer d.leave()
+			for _, f := range fields {
+				// the padding isn't checked
+				if err := d.skip(f.pad); err != nil {
+					return pathError(err, f.typ, d.r.n, f.segment())
+				}
+				if err := f.codec.dec(d, f.value(v)); err != nil {
+					return pathError(err, f.typ, d.r.n, f.segment())
+				}
+			}
+			return d.skip(tail)
+		}
+	case reflect.Array:
+		elem := b.codec(t.Elem(), o.elem())
+		return func(d *Decoder, v reflect.Value) error {
+			if err := d.enter(); err != nil {
+				return err
+			}
+			defer d.leave()
+			if elem.flat != nil {
+				return d.decodeFlat(elem.flat, v, v.Len())
+			}
+			for i := 0; i < v.Len(); i++ {
+				if err := elem.dec(d, v.Index(i)); err != nil {
+					return pathError(err, t.Elem(), d.r.n, indexSegment(i))
+				}
+			}
+			return nil
+		}
+	case reflect.Slice:
+		if o.size > 0 && isPaddedBytes(t) {
+			return b.markNilDecoder(t, o, func(d *Decoder, v reflect.Value) error {
+				b, err := d.padded(o)
+				if err != nil {
+					return err
+				}
+				if !d.aliasing(AliasBytes) {
+					// b is part of the input or the buffer of the Decoder
+					b = append([]byte{}, b...)
+				}
+				v.SetBytes(b)
+				return nil
+			})
+		}
+		if isPaddedBytes(t) {
+			return b.markNilDecoder(t, o, func(d *Decoder, v reflect.Value) error {
+				sz, err := d.lengthOrSize(o)
+				if err != nil {
+					return err
+				}
+				if err := d.allocElements(sz, 1); err != nil {
+					return err
+				}
+				b, err := d.bytes(sz)
+				if err != nil {
+					return err
+				}
+				v.SetBytes(b)
+				return nil
+			})
+		}
+		elem := b.codec(t.Elem(), o.elem())
+		return b.markNilDecoder(t, o, func(d *Decoder, v reflect.Value) error {
+			sz, err := d.lengthOrSize(o)
+			if err != nil {
+				return err
+			}
+			if err := d.allocElements(sz, t.Elem().Size()); err != nil {
+				return err
+			}
+			if err := d.enter(); err != nil {
+				return err
+			}
+			defer d.leave()
+			v.Set(reflect.MakeSlice(t, 0, 0))
+			if elem.flat != nil {
+				return d.decodeFlat(elem.flat, v, sz)
+			}
+			for i := 0; i < sz; i++ {
+				ev := reflect.New(t.Elem()).Elem()
+				if err := elem.dec(d, ev); err != nil {
+					return pathError(err, t.Elem(), d.r.n, indexSegment(i))
+				}
+				v.Set(reflect.Append(v, ev))
+			}
+			return nil
+		})
+	case reflect.Map:
+		key, elem := b.codec(t.Key(), o.elem()), b.codec(t.Elem(), o.elem())
+		return b.markNilDecoder(t, o, func(d *Decoder, v reflect.Value) error {
+			sz, err := d.length(o)
+			if err != nil {
+				return err
+			}
+			if err := d.allocElements(sz, t.Key().Size()+t.Elem().Size()); err != nil {
+				return err
+			}
+			if err := d.enter(); err != nil {
+				return err
+			}
+			defer d.leave()
+			v.Set(reflect.MakeMap(t))
+			for i := 0; i < sz; i++ {
+				kv := reflect.New(t.Key()).Elem()
+				ev := reflect.New(t.Elem()).Elem()
+				if err := key.dec(d, kv); err != nil {
+					return pathError(err, t.Key(), d.r.n, indexSegment(i))
+				}
+				if kv.Kind() == reflect.Interface && !kv.IsNil() && !kv.Elem().Type().Comparable() {
+					return pathError(fmt.Errorf("%s can't be a map key", kv.Elem().Type()), t.Key(), d.r.n, indexSegment(i))
+				}
+				if err := elem.dec(d, ev); err != nil {
+					return pathError(err, t.Elem(), d.r.n, keySegment(kv))
+				}
+				v.SetMapIndex(kv, ev)
+			}
+			return nil
+		})
+	}
+	// nothing we know how to read
+	return func(*Decoder, reflect.Value) error { return nil }
+}
+
+// mapEntries sorts the keys of a map by their encoded bytes
+type mapEntries struct {
+	keys    []reflect.Value
+	encoded [][]byte
+}
+
+func (m *mapEntries) Len() int           { return len(m.keys) }
+func (m *mapEntries) Less(i, j int) bool { return bytes.Compare(m.encoded[i], m.encoded[j]) < 0 }
+func (m *mapEntries) Swap(i, j int) {
+	m.keys[i], m.keys[j] = m.keys[j], m.keys[i]
+	m.encoded[i], m.encoded[j] = m.encoded[j], m.encoded[i]
+}
+
+// encodeSortedMap writes the entries of the map v ordered by their
+// encoded keys, so the same map is always marshaled to the same bytes
+func encodeSortedMap(e *Encoder, key, elem *codec, v reflect.Value) error {
+	t := v.Type()
+	// marshal the keys with the same settings
+	ke := *e
+	ke.w, ke.buf, ke.start, ke.n = nil, nil, 0, e.offset()
+	entries := &mapEntries{keys: v.MapKeys()}
+	ends := make([]int, len(entries.keys))
+	for i, k := range entries.keys {
+		if err := key.enc(&ke, k); err != nil {
+			return pathError(err, t.Key(), ke.offset(), keySegment(k))
+		}
+		ends[i] = len(ke.buf)
+	}
+	entries.encoded = make([][]byte, len(entries.keys))
+	start := 0
+	for i, end := range ends {
+		entries.encoded[i] = ke.buf[start:end]
+		start = end
+	}
+	sort.Sort(entries)
+	for i, k := range entries.keys {
+		if err := e.write(entries.encoded[i]); err != nil {
+			return pathError(err, t.Key(), e.offset(), keySegment(k))
+		}
+		if err := elem.enc(e, v.MapIndex(k)); err != nil {
+			return pathError(err, t.Elem(), e.offset(), keySegment(k))
+		}
+	}
+	return nil
+}
+
+// isPaddedBytes reports if t is a byte slice that is padded
+// like a string when its size is fixed
+func isPaddedBytes(t reflect.Type) bool {
+	return t.Elem().Kind() == reflect.Uint8 && !hasMarshaler(t.Elem()) &&
+		!reflect.PtrTo(t.Elem()).Implements(unmarshalerType)
+}
+
+// markNilEncoder prefixes slices and maps with a presence byte
+// when the options ask for it
+func (b *planBuilder) markNilEncoder(o codecOptions, enc encodeFunc) encodeFunc {
+	if o.presence != NilPresence {
+		return enc
+	}
+	return func(e *Encoder, v reflect.Value) error {
+		if err := e.putPresence(!v.IsNil()); err != nil || v.IsNil() {
+			return err
+		}
+		return enc(e, v)
+	}
+}
+
+// markNilDecoder is the counterpart of markNilEncoder
+func (b *planBuilder) markNilDecoder(t reflect.Type, o codecOptions, dec decodeFunc) decodeFunc {
+	if o.presence != NilPresence {
+		return dec
+	}
+	return func(d *Decoder, v reflect.Value) error {
+		if ok, err := d.presence(); err != nil {
+			return err
+		} else if !ok {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		return dec(d, v)
+	}
+}
+
+func (b *planBuilder) basicDecoder(t reflect.Type, o codecOptions) decodeFunc {
+	if o.varint {
+		switch t.Kind() {
+		case reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+			return func(d *Decoder, v reflect.Value) error {
+				n, err := d.varint()
+				if err != nil {
+					return err
+				}
+				if v.OverflowInt(n) {
+					return fmt.Errorf("%d overflows %s", n, t)
+				}
+				v.SetInt(n)
+				return nil
+			}
+		case reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+			return func(d *Decoder, v reflect.Value) error {
+				n, err := d.uvarint()
+				if err != nil {
+					return err
+				}
+				if v.OverflowUint(n) {
+					return fmt.Errorf("%d overflows %s", n, t)
+				}
+				v.SetUint(n)
+				return nil
+			}
+		}
+	}
+	bo := o.byteOrder
+	if o.layout == CLayout {
+		switch t.Kind() {
+		case reflect.Int:
+			return func(d *Decoder, v reflect.Value) error {
+				n, err := d.uint32(bo)
+				if err != nil {
+					return err
+				}
+				v.SetInt(int64(int32(n)))
+				return nil
+			}
+		case reflect.Uint:
+			return func(d *Decoder, v reflect.Value) error {
+				n, err := d.uint32(bo)
+				if err != nil {
+					return err
+				}
+				v.SetUint(uint64(n))
+				return nil
+			}
+		}
+	}
+	switch t.Kind() {
+	// ints
+	case reflect.Uint8:
+		return func(d *Decoder, v reflect.Value) error {
+			b, err := d.read(1)
+			if err != nil {
+				return err
+			}
+			v.SetUint(uint64(b[0]))
+			return nil
+		}
+	case reflect.Uint16:
+		return func(d *Decoder, v reflect.Value) error {
+			b, err := d.read(2)
+			if err != nil {
+				return err
+			}
+			v.SetUint(uint64(bo.Uint16(b)))
+			return nil
+		}
+	case reflect.Uint32:
+		return func(d *Decoder, v reflect.Value) error {
+			n, err := d.uint32(bo)
+			if err != nil {
+				return err
+			}
+			v.SetUint(uint64(n))
+			return nil
+		}
+	case reflect.Uint64, reflect.Uint:
+		return func(d *Decoder, v reflect.Value) error {
+			n, err := d.uint64(bo)
+			if err != nil {
+				return err
+			}
+			v.SetUint(n)
+			return nil
+		}
+	case reflect.Int8:
+		return func(d *Decoder, v reflect.Value) error {
+			b, err := d.read(1)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(int8(b[0])))
+			return nil
+		}
+	case reflect.Int16:
+		return func(d *Decoder, v reflect.Value) error {
+			b, err := d.read(2)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(int16(bo.Uint16(b))))
+			return nil
+		}
+	case reflect.Int32:
+		return func(d *Decoder, v reflect.Value) error {
+			n, err := d.uint32(bo)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(int32(n)))
+			return nil
+		}
+	case reflect.Int64, reflect.Int:
+		return func(d *Decoder, v reflect.Value) error {
+			n, err := d.uint64(bo)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(n))
+			return nil
+		}
+	// floats
+	case reflect.Float32:
+		return func(d *Decoder, v reflect.Value) error {
+			n, err := d.uint32(bo)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(float64(math.Float32frombits(n)))
+			return nil
+		}
+	case reflect.Float64:
+		return func(d *Decoder, v reflect.Value) error {
+			n, err := d.uint64(bo)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(math.Float64frombits(n))
+			return nil
+		}
+	// complexes
+	case reflect.Complex64:
+		return func(d *Decoder, v reflect.Value) error {
+			b, err := d.read(8)
+			if err != nil {
+				return err
+			}
+			v.SetComplex(complex128(complex(
+				math.Float32frombits(bo.Uint32(b)),
+				math.Float32frombits(bo.Uint32(b[4:])),
+			)))
+			return nil
+		}
+	case reflect.Complex128:
+		return func(d *Decoder, v reflect.Value) error {
+			b, err := d.read(16)
+			if err != nil {
+				return err
+			}
+			v.SetComplex(complex(
+				math.Float64frombits(bo.Uint64(b)),
+				math.Float64frombits(bo.Uint64(b[8:])),
+			))
+			return nil
+		}
+	// bools
+	case reflect.Bool:
+		return func(d *Decoder, v reflect.Value) error {
+			b, err := d.read(1)
+			if err != nil {
+				return err
+			}
+			v.SetBool(b[0] != 0)
+			return nil
+		}
+	// strings
+	case reflect.String:
+		switch {
+		case o.cstr && o.size == 0:
+			return func(d *Decoder, v reflect.Value) error {
+				b, err := d.cstring()
+				if err != nil {
+					return err
+				}
+				v.SetString(d.string(b))
+				return nil
+			}
+		case o.size > 0:
+			return func(d *Decoder, v reflect.Value) error {
+				b, err := d.padded(o)
+				if err != nil {
+					return err
+				}
+				v.SetString(d.string(b))
+				return nil
+			}
+		}
+		return func(d *Decoder, v reflect.Value) error {
+			sz, err := d.length(o)
+			if err != nil {
+				return err
+			}
+			if err := d.allocBytes(sz); err != nil {
+				return err
+			}
+			b, err := d.read(sz)
+			if err != nil {
+				return err
+			}
+			v.SetString(d.string(b))
+			return nil
+		}
+	}
+	return func(*Decoder, reflect.Value) error { return nil }
+}
+
+// field is a struct field included in a plan
+type field struct {
+	index int
+	name  string
+	typ   reflect.Type
+	tag   fieldTag
+	codec *codec
+	// set if the field is a group of bit-fields
+	bits *bitGroup
+	// padding before the field in the C layout
+	pad int
+}
+
+// value returns the field of the struct v. Bit-field
+// groups work on the whole struct.
+func (f *field) value(v reflect.Value) reflect.Value {
+	if f.bits != nil {
+		return v
+	}
+	return v.Field(f.index)
+}
+
+// segment is the path segment of the field in a FieldError.
+// Bit-field groups name the field themselves.
+func (f *field) segment() string {
+	if f.bits != nil {
+		return ""
+	}
+	return "." + f.name
+}
+
+// fields returns the fields of the struct t that should be
+// marshaled, in the order they're written. Unexported fields are
+// always skipped. The options in the tag of a field apply to its
+// value, including its elements, except for size, pad and cstr.
+func (b *planBuilder) fields(t reflect.Type, o codecOptions) ([]field, error) {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		fldTyp := t.Field(i)
+		if fldTyp.PkgPath != "" {
+			continue
+		}
+		tag := fldTyp.Tag.Get(o.tag)
+		if o.onlyTagged && (tag == "" || tag == "-") {
+			continue
+		}
+		ft, err := parseFieldTag(tag, o.tag == DefaultTag)
+		if err != nil {
+			return nil, fmt.Errorf("tag of %s.%s: %s", t, fldTyp.Name, err)
+		}
+		if ft.omit {
+			continue
+		}
+		if err := ft.check(fldTyp.Type); err != nil {
+			return nil, fmt.Errorf("tag of %s.%s: %s", t, fldTyp.Name, err)
+		}
+		f := field{index: i, name: fldTyp.Name, typ: fldTyp.Type, tag: ft}
+		if ft.bits == 0 {
+			f.codec = b.codec(fldTyp.Type, ft.apply(o))
+		}
+		fields = append(fields, f)
+	}
+	if err := checkFieldIDs(t, fields); err != nil {
+		return nil, err
+	}
+	sort.Stable(fieldsByOrder(fields))
+	return groupBits(t, fields), nil
+}
+
+type fieldsByOrder []field
+
+func (f fieldsByOrder) Len() int           { return len(f) }
+func (f fieldsByOrder) Less(i, j int) bool { return f[i].tag.order < f[j].tag.order }
+func (f fieldsByOrder) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -0,0 +1,413 @@
+package structtools
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type node struct {
+	Value uint16
+	Next  *node
+}
+
+func TestPlanCache(t *testing.T) {
+	opts := NewEncoder(nil).options()
+	typ := reflect.TypeOf(MyStruct{})
+	if codecFor(typ, opts) != codecFor(typ, opts) {
+		t.Error("expecting the plan to be cached")
+		return
+	}
+	other := opts
+	other.onlyTagged = true
+	if codecFor(typ, opts) == codecFor(typ, other) {
+		t.Error("expecting a different plan for different options")
+		return
+	}
+}
+
+func TestRecursivePlan(t *testing.T) {
+	n := &node{1, &node{2, &node{3, nil}}}
+	b, err := Marshal(n)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "000100020003" {
+		t.Error("got different values:", xs)
+		return
+	}
+}
+
+func TestConcurrentPlans(t *testing.T) {
+	type rec struct {
+		A uint32
+		B []string
+		C map[string]int16
+	}
+	v := rec{7, []string{"a", "bc"}, map[string]int16{"x": -1}}
+	exp, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := Marshal(v)
+			if err != nil {
+				errs <- err
+				return
+			}
+			var out rec
+			if _, err := Unmarshal(b, &out); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(b, exp) || !reflect.DeepEqual(out, v) {
+				t.Error("got different values")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func BenchmarkMarshalStruct(b *testing.B) {
+	v := MyStruct{A: 1, B: someStr, C: &someStr, D: true, E: otherStr}
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type (
+	port   uint16
+	status int8
+	label  string
+	ratio  float32
+	flag   bool
+)
+
+func TestNamedBasicTypes(t *testing.T) {
+	type rec struct {
+		P port
+		S status
+		L label
+		R ratio
+		F flag
+	}
+	v := rec{8080, -2, "up", 0.5, true}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "1f90"+"fe"+"000000027570"+"3f000000"+"01" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out rec
+	if _, err := Unmarshal(b, &out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out != v {
+		t.Error("got different values", out, v)
+		return
+	}
+}
+
+func TestPresence(t *testing.T) {
+	n := &node{1, &node{2, nil}}
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	enc.Presence = PointerPresence
+	if err := enc.Encode(n); err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b.Bytes()); xs != "0001"+"01"+"0002"+"00" {
+		t.Error("got different values:", xs)
+		return
+	}
+	out := &node{}
+	dec := NewDecoder(b)
+	dec.Presence = PointerPresence
+	if err := dec.Decode(out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out.Value != 1 || out.Next == nil || out.Next.Value != 2 || out.Next.Next != nil {
+		t.Error("got different values")
+		return
+	}
+
+	type rec struct {
+		A []byte
+		B []byte
+		M map[string]bool
+	}
+	v := rec{B: []byte{}}
+	b.Reset()
+	enc.Presence = NilPresence
+	if err := enc.Encode(v); err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b.Bytes()); xs != "00"+"0100000000"+"00" {
+		t.Error("got different values:", xs)
+		return
+	}
+	out2 := rec{A: []byte{1}, M: map[string]bool{}}
+	dec.Presence = NilPresence
+	if err := dec.Decode(&out2); err != nil {
+		t.Error(err)
+		return
+	}
+	if out2.A != nil || out2.B == nil || len(out2.B) != 0 || out2.M != nil {
+		t.Error("got different values", out2)
+		return
+	}
+}
+
+func TestSortedMaps(t *testing.T) {
+	m := map[uint16]string{3: "c", 1: "a", 2: "b"}
+	b, err := Marshal(m)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "00000003"+"0001"+"0000000161"+"0002"+"0000000162"+"0003"+"0000000163" {
+		t.Error("got different values:", xs)
+		return
+	}
+	big := make(map[string][]int8)
+	for i := 0; i < 100; i++ {
+		big[strconv.Itoa(i)] = []int8{int8(i)}
+	}
+	exp, err := Marshal(big)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 10; i++ {
+		if b, err := Marshal(big); err != nil {
+			t.Error(err)
+			return
+		} else if !bytes.Equal(b, exp) {
+			t.Error("expecting the same output every time")
+			return
+		}
+	}
+}
+
+func TestVarInt(t *testing.T) {
+	type rec struct {
+		A int32
+		B uint64
+		C string
+		D []int16
+		E uint16 `bin:",fixed"`
+	}
+	v := rec{-3, 300, "hi", []int16{-1, 64}, 5}
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	enc.VarInt = true
+	if err := enc.Encode(v); err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b.Bytes()); xs != "05"+"ac02"+"026869"+"02"+"01"+"8001"+"0005" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out rec
+	dec := NewDecoder(b)
+	dec.VarInt = true
+	if err := dec.Decode(&out); err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(out, v) {
+		t.Error("got different values", out, v)
+		return
+	}
+
+	type tagged struct {
+		A uint32 `bin:",varint"`
+		B uint32
+	}
+	bb, err := Marshal(tagged{1, 2})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(bb); xs != "01"+"00000002" {
+		t.Error("got different values:", xs)
+		return
+	}
+
+	// 70000 doesn't fit in a uint16
+	var small uint16
+	dec = NewDecoder(bytes.NewReader([]byte{0xf0, 0xa2, 0x04}))
+	dec.VarInt = true
+	if err := dec.Decode(&small); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
+
+func TestLenPrefix(t *testing.T) {
+	type rec struct {
+		A string
+		B []uint8 `bin:",len=u16"`
+		C map[uint8]bool
+	}
+	v := rec{"ab", []uint8{1}, map[uint8]bool{2: true}}
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	enc.LenPrefix = Len8
+	if err := enc.Encode(v); err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b.Bytes()); xs != "026162"+"000101"+"010201" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out rec
+	dec := NewDecoder(b)
+	dec.LenPrefix = Len8
+	if err := dec.Decode(&out); err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(out, v) {
+		t.Error("got different values", out, v)
+		return
+	}
+
+	// too long for the prefix
+	v.A = string(make([]byte, 256))
+	if err := enc.Encode(v); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+
+	type invalid struct {
+		A string `bin:",len=u7"`
+	}
+	if _, err := Marshal(invalid{}); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
+
+// point implements encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+type point struct{ x, y int8 }
+
+func (p point) MarshalBinary() ([]byte, error) { return []byte{byte(p.x), byte(p.y)}, nil }
+
+func (p *point) UnmarshalBinary(b []byte) error {
+	if len(b) != 2 {
+		return fmt.Errorf("expecting 2 bytes, got %d", len(b))
+	}
+	p.x, p.y = int8(b[0]), int8(b[1])
+	return nil
+}
+
+func TestBinaryMarshaler(t *testing.T) {
+	type rec struct {
+		P  point
+		PP *point
+		T  time.Time
+	}
+	v := rec{point{1, -1}, &point{2, 3}, time.Date(2016, 12, 1, 10, 30, 0, 5, time.UTC)}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b[:12]); xs != "00000002"+"01ff"+"00000002"+"0203" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out rec
+	if _, err := Unmarshal(b, &out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out.P != v.P || *out.PP != *v.PP || !out.T.Equal(v.T) {
+		t.Error("got different values", out, v)
+		return
+	}
+
+	// errors from UnmarshalBinary are returned
+	if _, err := Unmarshal([]byte{0, 0, 0, 1, 1}, &point{}); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
+
+// ptrInt marshals itself with pointer receivers only
+type ptrInt int16
+
+func (i *ptrInt) MarshalBinary(w io.Writer) (int, error) {
+	return w.Write([]byte{0xaa, byte(*i)})
+}
+
+func (i *ptrInt) UnmarshalBinary(r io.Reader) (int, error) {
+	b, err := readN(r, 2)
+	if err != nil {
+		return 0, err
+	}
+	if b[0] != 0xaa {
+		return 0, fmt.Errorf("expecting a marker")
+	}
+	*i = ptrInt(b[1])
+	return 2, nil
+}
+
+func TestPointerReceiverMarshaler(t *testing.T) {
+	type rec struct {
+		F ptrInt
+		A [1]ptrInt
+		S []ptrInt
+		M map[uint8]ptrInt
+	}
+	v := rec{1, [1]ptrInt{2}, []ptrInt{3}, map[uint8]ptrInt{4: 5}}
+	for _, in := range []interface{}{v, &v} {
+		b, err := Marshal(in)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if xs := hex.EncodeToString(b); xs != "aa01"+"aa02"+"00000001aa03"+"0000000104aa05" {
+			t.Error("got different values:", xs)
+			return
+		}
+		var out rec
+		if _, err := Unmarshal(b, &out); err != nil {
+			t.Error(err)
+			return
+		}
+		if !reflect.DeepEqual(out, v) {
+			t.Error("got different values", out, v)
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package structtools
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// registry maps the names passed to Register to their types and back
+var registry = struct {
+	sync.RWMutex
+	types   map[string]reflect.Type
+	names   map[reflect.Type]string
+	maxName int
+}{types: make(map[string]reflect.Type), names: make(map[reflect.Type]string)}
+
+// Register records the concrete type of v under name, so values of
+// that type can be marshaled as the value of an interface. They're
+// written as the name, a varint length followed by the bytes, and the
+// value. Nil interfaces are written as an empty name. Like with
+// encoding/gob, a type must be registered under the same name by the
+// Encoder and the Decoder, and Register panics if the name or the
+// type are already registered with something else.
+//
+// The basic types, []byte, []interface{} and map[string]interface{}
+// are registered under their Go names, e.g. "uint16".
+func Register(name string, v interface{}) {
+	if name == "" {
+		panic("structtools: registering an empty name")
+	}
+	t := reflect.TypeOf(v)
+	if t == nil {
+		panic("structtools: registering a nil value")
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if rt, ok := registry.types[name]; ok && rt != t {
+		panic(fmt.Sprintf("structtools: registering %s as %q, already used by %s", t, name, rt))
+	}
+	if rn, ok := registry.names[t]; ok && rn != name {
+		panic(fmt.Sprintf("structtools: registering %s as %q, already registered as %q", t, name, rn))
+	}
+	registry.types[name], registry.names[t] = t, name
+	if len(name) > registry.maxName {
+		registry.maxName = len(name)
+	}
+}
+
+func init() {
+	for _, v := range []interface{}{
+		false, "",
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), complex64(0), complex128(0),
+		[]byte(nil), []interface{}(nil), map[string]interface{}(nil),
+	} {
+		Register(reflect.TypeOf(v).String(), v)
+	}
+}
+
+// registeredName returns the name t was registered with
+func registeredName(t reflect.Type) (string, error) {
+	registry.RLock()
+	name, ok := registry.names[t]
+	registry.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("type %s isn't registered", t)
+	}
+	return name, nil
+}
+
+// registeredType returns the type registered as name
+func registeredType(name []byte) (reflect.Type, error) {
+	registry.RLock()
+	t, ok := registry.types[string(name)]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", name)
+	}
+	return t, nil
+}
+
+// maxRegisteredName is the length of the longest registered name
+func maxRegisteredName() int {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.maxName
+}
+
+// encodeInterface writes the registered name of
+// the value in the interface v, and the value
+func encodeInterface(e *Encoder, o codecOptions, v reflect.Value) error {
+	if v.IsNil() {
+		return e.putUvarint(0)
+	}
+	v = v.Elem()
+	name, err := registeredName(v.Type())
+	if err != nil {
+		return err
+	}
+	if err := e.putUvarint(uint64(len(name))); err != nil {
+		return err
+	}
+	if err := e.writeString(name); err != nil {
+		return err
+	}
+	return codecFor(v.Type(), o).enc(e, v)
+}
+
+// decodeInterface reads a value written by encodeInterface to v,
+// the value must be assignable to the interface type of v
+func decodeInterface(d *Decoder, o codecOptions, v reflect.Value) error {
+	n, err := d.uvarint()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if n > uint64(maxRegisteredName()) {
+		return fmt.Errorf("unknown type name of %d bytes", n)
+	}
+	name, err := d.read(int(n))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	t, err := registeredType(name)
+	if err != nil {
+		return err
+	}
+	if !t.AssignableTo(v.Type()) {
+		return fmt.Errorf("%s isn't assignable to %s", t, v.Type())
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	if err := d.alloc(int64(t.Size())); err != nil {
+		return err
+	}
+	cv := reflect.New(t).Elem()
+	if err := codecFor(t, o).dec(d, cv); err != nil {
+		return err
+	}
+	v.Set(cv)
+	return nil
+}
@@ -0,0 +1,128 @@
+package structtools
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+type shape interface {
+	area() float64
+}
+
+type circle struct{ R float32 }
+
+func (c circle) area() float64 { return 3 * float64(c.R*c.R) }
+
+type square struct{ Side uint8 }
+
+func (s *square) area() float64 { return float64(s.Side) * float64(s.Side) }
+
+func init() {
+	Register("circle", circle{})
+	Register("square", &square{})
+}
+
+func TestInterfaces(t *testing.T) {
+	type drawing struct {
+		Shapes []shape
+		Empty  shape
+	}
+	v := drawing{Shapes: []shape{circle{1}, &square{2}}}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "00000002"+"06636972636c65"+"3f800000"+"06737175617265"+"02"+"00" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out drawing
+	if _, err := Unmarshal(b, &out); err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(out, v) {
+		t.Error("got different values", out, v)
+		return
+	}
+
+	// the output of ToMap
+	m, err := ToMap(testTag, MyStruct{A: 1, B: "b", E: "e"}, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	delete(m, "cc")
+	if b, err = Marshal(m); err != nil {
+		t.Error(err)
+		return
+	}
+	var outMap map[string]interface{}
+	if _, err := Unmarshal(b, &outMap); err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(outMap, m) {
+		t.Error("got different values", outMap, m)
+		return
+	}
+	mk := map[interface{}]bool{uint8(1): true, "a": false, nil: true}
+	if b, err = Marshal(mk); err != nil {
+		t.Error(err)
+		return
+	}
+	var outKeys map[interface{}]bool
+	if _, err := Unmarshal(b, &outKeys); err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(outKeys, mk) {
+		t.Error("got different values", outKeys, mk)
+		return
+	}
+}
+
+func TestInterfaceErrors(t *testing.T) {
+	type unregistered struct{ A int8 }
+	if _, err := Marshal([]interface{}{unregistered{}}); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+	var s shape
+	for _, h := range []string{
+		// unknown name
+		"03666f6f",
+		// a uint8 isn't a shape
+		"0575696e743801",
+		// longer than any name
+		"ff01",
+	} {
+		b, _ := hex.DecodeString(h)
+		if _, err := Unmarshal(b, &s); err == nil {
+			t.Error("expecting an error for", h)
+			return
+		}
+	}
+	var k map[interface{}]bool
+	if _, err := Unmarshal([]byte("\x00\x00\x00\x01\x07[]uint8\x00\x00\x00\x00\x01"), &k); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+	for _, reg := range []func(){
+		func() { Register("circle", square{}) },
+		func() { Register("round", circle{}) },
+		func() { Register("", circle{}) },
+		func() { Register("nil", nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expecting a panic")
+				}
+			}()
+			reg()
+		}()
+	}
+}
@@ -0,0 +1,1029 @@
+package structtools
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// wireType describes the layout of the values of a type in a
+// self-describing stream, where it's written once, before the first
+// value that needs it. Types reference each other by id, so they can
+// be recursive. The options of the Encoder and the field tags that
+// change the layout are part of the type.
+type wireType struct {
+	// a reflect.Kind, or one of the wire kinds below
+	Kind uint8
+	// name of the Go type, only informative
+	Name     string
+	Flags    uint8
+	Presence uint8
+	LenWidth uint8
+	Size     uint32
+	Pad      uint8
+	// tag and TimeFormat used by the concrete values of interfaces
+	Tag        string
+	TimeFormat uint8
+	// pointers, arrays, slices and map values
+	Elem uint32
+	// map keys
+	Key uint32
+	// arrays
+	Len uint32
+	// structs, in the order they're written
+	Fields []wireField
+}
+
+// wireField is a field of a struct wireType
+type wireField struct {
+	Name string
+	Type uint32
+	// bit-fields, packed like groupBits does
+	Bits uint8
+	Lsb  bool
+	// set by the "id" tag option
+	ID uint32
+}
+
+// kinds of values that marshal themselves
+const (
+	// encoding.BinaryMarshaler, a length prefixed blob
+	wireBlob = 100 + iota
+	// Marshaler, only readable by the Unmarshaler of the same type
+	wireOpaque
+)
+
+// kinds of the types written like builtinCodec does
+const (
+	// time.Time in the TimeUnixNano and TimeUnixZone formats
+	wireTimeUnixNano = 110 + iota
+	wireTimeUnixZone
+	wireBigInt
+	wireBigRat
+	wireBigFloat
+)
+
+func isBuiltinKind(k uint8) bool { return k >= wireTimeUnixNano && k <= wireBigFloat }
+
+// builtinKind returns the kind of t if isBuiltin
+func builtinKind(t reflect.Type, o codecOptions) uint8 {
+	switch t {
+	case timeType:
+		if o.timeFormat == TimeUnixNano {
+			return wireTimeUnixNano
+		}
+		return wireTimeUnixZone
+	case bigIntType:
+		return wireBigInt
+	case bigRatType:
+		return wireBigRat
+	}
+	return wireBigFloat
+}
+
+// builtinType returns the type and the options of the
+// values of the builtin kind k, or nil if k isn't one
+func builtinType(k uint8, o codecOptions) (reflect.Type, codecOptions) {
+	switch k {
+	case wireTimeUnixNano:
+		o.timeFormat = TimeUnixNano
+		return timeType, o
+	case wireTimeUnixZone:
+		o.timeFormat = TimeUnixZone
+		return timeType, o
+	case wireBigInt:
+		return bigIntType, o
+	case wireBigRat:
+		return bigRatType, o
+	case wireBigFloat:
+		return bigFloatType, o
+	}
+	return nil, o
+}
+
+// flags of a wireType
+const (
+	wireLittleEndian = 1 << iota
+	wireVarint
+	wireCstr
+	wireOnlyTagged
+	// byte slices written like strings with a size
+	wirePadded
+	// structs with numbered fields
+	wireFieldIDs
+)
+
+// schemaOptions are the options wireTypes are written with
+var schemaOptions = codecOptions{tag: DefaultTag, byteOrder: binary.BigEndian, varint: true}
+
+var wireTypeType = reflect.TypeOf(wireType{})
+
+// options returns the options values of wt were written with
+func (wt *wireType) options() codecOptions {
+	o := codecOptions{
+		tag:        wt.Tag,
+		onlyTagged: wt.Flags&wireOnlyTagged != 0,
+		byteOrder:  binary.BigEndian,
+		presence:   PresenceMode(wt.Presence),
+		varint:     wt.Flags&wireVarint != 0,
+		lenWidth:   LenWidth(wt.LenWidth),
+		size:       int(wt.Size),
+		pad:        wt.Pad,
+		cstr:       wt.Flags&wireCstr != 0,
+		timeFormat: TimeFormat(wt.TimeFormat),
+	}
+	if wt.Flags&wireLittleEndian != 0 {
+		o.byteOrder = binary.LittleEndian
+	}
+	return o
+}
+
+// refs returns the ids of the types wt references
+func (wt *wireType) refs() []uint32 {
+	switch reflect.Kind(wt.Kind) {
+	case reflect.Ptr, reflect.Array, reflect.Slice:
+		return []uint32{wt.Elem}
+	case reflect.Map:
+		return []uint32{wt.Key, wt.Elem}
+	case reflect.Struct:
+		ids := make([]uint32, len(wt.Fields))
+		for i, f := range wt.Fields {
+			ids[i] = f.Type
+		}
+		return ids
+	}
+	return nil
+}
+
+// inline returns the ids of the types that are decoded as part of
+// wt without reading anything first. A type can't contain itself
+// through them, the Decoder would recurse forever.
+func (wt *wireType) inline() []uint32 {
+	switch reflect.Kind(wt.Kind) {
+	case reflect.Ptr:
+		if wt.Presence == uint8(NoPresence) {
+			return []uint32{wt.Elem}
+		}
+	case reflect.Array:
+		if wt.Len > 0 {
+			return []uint32{wt.Elem}
+		}
+	case reflect.Struct:
+		return wt.refs()
+	}
+	return nil
+}
+
+// check validates a wireType read from a stream
+func (wt *wireType) check() error {
+	k := reflect.Kind(wt.Kind)
+	switch {
+	case isBasicKind(k), wt.Kind == wireBlob, wt.Kind == wireOpaque:
+	case isBuiltinKind(wt.Kind):
+	case k == reflect.Interface, k == reflect.Ptr, k == reflect.Struct,
+		k == reflect.Array, k == reflect.Slice, k == reflect.Map:
+	default:
+		return fmt.Errorf("invalid kind %d", wt.Kind)
+	}
+	if wt.Presence > uint8(NilPresence) || wt.LenWidth > uint8(LenVarint) || wt.TimeFormat > uint8(TimeUnixZone) {
+		return fmt.Errorf("invalid options")
+	}
+	for _, f := range wt.Fields {
+		if f.Bits > 64 {
+			return fmt.Errorf("invalid bits %d", f.Bits)
+		}
+	}
+	return nil
+}
+
+// kindTypes are the types of the generic values of the basic kinds
+var kindTypes = map[reflect.Kind]reflect.Type{}
+
+func init() {
+	for _, v := range []interface{}{
+		false, "",
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), complex64(0), complex128(0),
+	} {
+		kindTypes[reflect.TypeOf(v).Kind()] = reflect.TypeOf(v)
+	}
+}
+
+func isBasicKind(k reflect.Kind) bool {
+	_, ok := kindTypes[k]
+	return ok
+}
+
+// wireByteOrder returns the standard byte order that works like bo,
+// only those can be described
+func wireByteOrder(bo binary.ByteOrder) (binary.ByteOrder, error) {
+	b := make([]byte, 2)
+	bo.PutUint16(b, 1)
+	switch {
+	case b[0] == 1 && b[1] == 0:
+		return binary.LittleEndian, nil
+	case b[0] == 0 && b[1] == 1:
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("byte order %s can't be described", bo)
+}
+
+// describer builds the wireTypes of the types that weren't
+// written to a stream yet
+type describer struct {
+	ids map[planKey]uint32
+	// keys added to ids, and their types, children first
+	added []planKey
+	defs  []wireDef
+}
+
+type wireDef struct {
+	id uint32
+	wt wireType
+}
+
+// id returns the id of t, describing t if it's new
+func (s *describer) id(t reflect.Type, o codecOptions) (uint32, error) {
+	k := planKey{t, o}
+	if id, ok := s.ids[k]; ok {
+		return id, nil
+	}
+	id := uint32(len(s.ids) + 1)
+	s.ids[k] = id
+	s.added = append(s.added, k)
+	wt, err := s.describe(t, o)
+	if err != nil {
+		return 0, err
+	}
+	s.defs = append(s.defs, wireDef{id, wt})
+	return id, nil
+}
+
+// rollback forgets the types added, they weren't written
+func (s *describer) rollback() {
+	for _, k := range s.added {
+		delete(s.ids, k)
+	}
+}
+
+// describe builds the wireType of t following the same
+// rules as planBuilder.encoder
+func (s *describer) describe(t reflect.Type, o codecOptions) (wireType, error) {
+	k := t.Kind()
+	wt := wireType{
+		Kind:     uint8(k),
+		Name:     t.String(),
+		Presence: uint8(o.presence),
+		LenWidth: uint8(o.lenWidth),
+		Size:     uint32(o.size),
+		Pad:      o.pad,
+	}
+	if o.byteOrder == binary.LittleEndian {
+		wt.Flags |= wireLittleEndian
+	}
+	if o.varint {
+		wt.Flags |= wireVarint
+	}
+	if o.cstr {
+		wt.Flags |= wireCstr
+	}
+	if isForbiddenKind(k) != reflect.Invalid {
+		return wt, forbiddenKindError(k)
+	}
+	if isBuiltin(t, o) {
+		wt.Kind = builtinKind(t, o)
+		return wt, nil
+	}
+	if hasMarshaler(t) && (k != reflect.Ptr || !hasMarshaler(t.Elem())) {
+		wt.Kind = wireBlob
+		if isMarshaler(t) {
+			wt.Kind = wireOpaque
+		}
+		return wt, nil
+	}
+	if isBasic(t) {
+		return wt, nil
+	}
+	var err error
+	switch k {
+	case reflect.Interface:
+		wt.Tag, wt.TimeFormat = o.tag, uint8(o.timeFormat)
+		if o.onlyTagged {
+			wt.Flags |= wireOnlyTagged
+		}
+	case reflect.Ptr:
+		wt.Elem, err = s.id(t.Elem(), o)
+	case reflect.Struct:
+		var fields []field
+		if fields, err = newPlanBuilder().fields(t, o); err != nil {
+			return wt, err
+		}
+		if hasFieldIDs(fields) {
+			wt.Flags |= wireFieldIDs
+		}
+		for _, f := range fields {
+			if f.bits == nil {
+				id, err := s.id(f.typ, f.tag.apply(o))
+				if err != nil {
+					return wt, err
+				}
+				wt.Fields = append(wt.Fields, wireField{Name: f.tag.wireName(f.name), Type: id, ID: uint32(f.tag.id)})
+				continue
+			}
+			for _, bf := range f.bits.fields {
+				id, err := s.id(bf.typ, o.elem())
+				if err != nil {
+					return wt, err
+				}
+				wt.Fields = append(wt.Fields, wireField{Name: bf.wire, Type: id, Bits: uint8(bf.bits), Lsb: f.bits.lsb})
+			}
+		}
+	case reflect.Array:
+		if uint64(t.Len()) > math.MaxUint32 {
+			return wt, fmt.Errorf("array of %d elements can't be described", t.Len())
+		}
+		wt.Len = uint32(t.Len())
+		wt.Elem, err = s.id(t.Elem(), o.elem())
+	case reflect.Slice:
+		if o.size > 0 && isPaddedBytes(t) {
+			wt.Flags |= wirePadded
+		}
+		wt.Elem, err = s.id(t.Elem(), o.elem())
+	case reflect.Map:
+		if wt.Key, err = s.id(t.Key(), o.elem()); err == nil {
+			wt.Elem, err = s.id(t.Elem(), o.elem())
+		}
+	}
+	return wt, err
+}
+
+// putType writes the types reached by t that weren't written to the
+// stream yet, followed by the id of t. A type is written as its
+// negated id and the wireType, the id of a value as is. The keys of
+// the new types are returned, so they can be forgotten if the value
+// isn't written after all.
+func (e *Encoder) putType(t reflect.Type, o codecOptions) ([]planKey, error) {
+	if o.layout != PackedLayout {
+		return nil, fmt.Errorf("the C layout can't be described")
+	}
+	bo, err := wireByteOrder(o.byteOrder)
+	if err != nil {
+		return nil, err
+	}
+	o.byteOrder = bo
+	if e.typeIDs == nil {
+		e.typeIDs = make(map[planKey]uint32)
+	}
+	s := &describer{ids: e.typeIDs}
+	id, err := s.id(t, o)
+	if err == nil {
+		c := codecFor(wireTypeType, schemaOptions)
+		for i := 0; i < len(s.defs) && err == nil; i++ {
+			if err = e.putVarint(-int64(s.defs[i].id)); err == nil {
+				err = c.enc(e, reflect.ValueOf(&s.defs[i].wt).Elem())
+			}
+		}
+	}
+	if err == nil {
+		err = e.putVarint(int64(id))
+	}
+	if err != nil {
+		s.rollback()
+		return nil, err
+	}
+	return s.added, nil
+}
+
+// forgetTypes forgets types returned by putType
+func (e *Encoder) forgetTypes(keys []planKey) {
+	(&describer{ids: e.typeIDs, added: keys}).rollback()
+}
+
+// decodeSelfDescribing reads the types that precede the
+// next value in a self-describing stream, and the value
+func (d *Decoder) decodeSelfDescribing(v reflect.Value) error {
+	if d.wireTypes == nil {
+		d.wireTypes = make(map[uint32]*wireType)
+		d.checkedTypes = make(map[uint32]bool)
+	}
+	c := codecFor(wireTypeType, schemaOptions)
+	for {
+		id, err := d.varint()
+		if err != nil {
+			return err
+		}
+		if id > 0 && id <= math.MaxUint32 {
+			if err := d.checkType(uint32(id)); err != nil {
+				return err
+			}
+			return d.decodeWire(d.wireTypes[uint32(id)], v)
+		}
+		if id == 0 || -id > math.MaxUint32 {
+			return fmt.Errorf("invalid type id %d", id)
+		}
+		if _, ok := d.wireTypes[uint32(-id)]; ok {
+			return fmt.Errorf("type %d is defined twice", -id)
+		}
+		// the types outlive the input
+		wt, alias := &wireType{}, d.Alias
+		d.Alias = NoAlias
+		err = c.dec(d, reflect.ValueOf(wt).Elem())
+		d.Alias = alias
+		if err != nil {
+			return err
+		}
+		d.wireTypes[uint32(-id)] = wt
+	}
+}
+
+// checkType checks that every type reached by id is defined and valid,
+// and that no type contains itself inline
+func (d *Decoder) checkType(id uint32) error {
+	if d.checkedTypes[id] {
+		return nil
+	}
+	seen := make(map[uint32]bool)
+	var visit func(id uint32) error
+	visit = func(id uint32) error {
+		if seen[id] || d.checkedTypes[id] {
+			return nil
+		}
+		seen[id] = true
+		wt, ok := d.wireTypes[id]
+		if !ok {
+			return fmt.Errorf("type %d isn't defined", id)
+		}
+		if err := wt.check(); err != nil {
+			return fmt.Errorf("type %d: %s", id, err)
+		}
+		for _, r := range wt.refs() {
+			if err := visit(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(id); err != nil {
+		return err
+	}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[uint32]int)
+	var cycle func(id uint32) error
+	cycle = func(id uint32) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("type %d contains itself", id)
+		case done:
+			return nil
+		}
+		state[id] = visiting
+		for _, r := range d.wireTypes[id].inline() {
+			if err := cycle(r); err != nil {
+				return err
+			}
+		}
+		state[id] = done
+		return nil
+	}
+	for id := range seen {
+		if err := cycle(id); err != nil {
+			return err
+		}
+	}
+	for id := range seen {
+		d.checkedTypes[id] = true
+	}
+	return nil
+}
+
+var emptyInterfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// genericType is the type values of wt are decoded to
+// when they're decoded to an empty interface
+func (d *Decoder) genericType(wt *wireType) (reflect.Type, error) {
+	k := reflect.Kind(wt.Kind)
+	switch {
+	case isBasicKind(k):
+		return kindTypes[k], nil
+	case wt.Kind == wireBlob:
+		return reflect.TypeOf([]byte(nil)), nil
+	case isBuiltinKind(wt.Kind):
+		// math/big numbers are used through pointers
+		bt, _ := builtinType(wt.Kind, codecOptions{})
+		if bt == timeType {
+			return bt, nil
+		}
+		return reflect.PtrTo(bt), nil
+	case k == reflect.Struct:
+		return reflect.TypeOf(map[string]interface{}(nil)), nil
+	case k == reflect.Array, k == reflect.Slice:
+		if d.wireTypes[wt.Elem].Kind == uint8(reflect.Uint8) {
+			return reflect.TypeOf([]byte(nil)), nil
+		}
+		return reflect.TypeOf([]interface{}(nil)), nil
+	case k == reflect.Map:
+		if d.wireTypes[wt.Key].Kind == uint8(reflect.String) {
+			return reflect.TypeOf(map[string]interface{}(nil)), nil
+		}
+		return reflect.TypeOf(map[interface{}]interface{}(nil)), nil
+	}
+	return nil, fmt.Errorf("%s has no generic value", wt.Name)
+}
+
+// decodeWire reads a value laid out as wt into v, converting it to the
+// type of v. Struct fields are matched by name, fields that v doesn't
+// have are skipped and fields only v has are left as they are. The
+// value is skipped if v isn't valid, and decoded to a generic value if
+// v is an empty interface: a basic type, []byte, []interface{},
+// map[string]interface{} for structs, map[interface{}]interface{},
+// time.Time, *big.Int, *big.Rat or *big.Float.
+func (d *Decoder) decodeWire(wt *wireType, v reflect.Value) error {
+	k := reflect.Kind(wt.Kind)
+	o := wt.options()
+	if k == reflect.Ptr {
+		// pointers only tell if the value is there
+		if o.presence != NoPresence {
+			if ok, err := d.presence(); err != nil {
+				return err
+			} else if !ok {
+				if v.IsValid() {
+					v.Set(reflect.Zero(v.Type()))
+				}
+				return nil
+			}
+		}
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		return d.decodeWire(d.wireTypes[wt.Elem], v)
+	}
+	for v.IsValid() && v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			if err := d.alloc(int64(v.Type().Elem().Size())); err != nil {
+				return err
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.IsValid() && v.Kind() == reflect.Interface && k != reflect.Interface {
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("can't decode %s into %s", wt.Name, v.Type())
+		}
+		gt, err := d.genericType(wt)
+		if err != nil {
+			return err
+		}
+		gv := reflect.New(gt).Elem()
+		if err := d.decodeWire(wt, gv); err != nil {
+			return err
+		}
+		v.Set(gv)
+		return nil
+	}
+
+	switch {
+	case isBasicKind(k):
+		x := reflect.New(kindTypes[k]).Elem()
+		if err := codecFor(x.Type(), o).dec(d, x); err != nil {
+			return err
+		}
+		if !v.IsValid() {
+			return nil
+		}
+		return convertBasic(v, x)
+	case wt.Kind == wireBlob:
+		n, err := d.length(o)
+		if err != nil {
+			return err
+		}
+		if err := d.allocBytes(n); err != nil {
+			return err
+		}
+		b, err := d.read(n)
+		if err != nil || !v.IsValid() {
+			return err
+		}
+		if v.Kind() != reflect.Slice && reflect.PtrTo(v.Type()).Implements(binaryUnmarshalerType) {
+			return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+		}
+		return convertBytes(v, append([]byte{}, b...))
+	case isBuiltinKind(wt.Kind):
+		bt, o := builtinType(wt.Kind, o)
+		if !v.IsValid() {
+			v = reflect.New(bt).Elem()
+		} else if v.Type() != bt {
+			return fmt.Errorf("can't decode %s into %s", wt.Name, v.Type())
+		}
+		return codecFor(bt, o).dec(d, v)
+	case wt.Kind == wireOpaque:
+		if !v.IsValid() || !reflect.PtrTo(v.Type()).Implements(unmarshalerType) {
+			return fmt.Errorf("%s can only be read by its Unmarshaler", wt.Name)
+		}
+		_, err := v.Addr().Interface().(Unmarshaler).UnmarshalBinary(d.r)
+		return err
+	case k == reflect.Interface:
+		if !v.IsValid() || v.Kind() != reflect.Interface {
+			// read it as it is, then see if it fits
+			var x interface{}
+			xv := reflect.ValueOf(&x).Elem()
+			if err := decodeInterface(d, o, xv); err != nil || !v.IsValid() {
+				return err
+			}
+			if xv.IsNil() {
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			if !xv.Elem().Type().AssignableTo(v.Type()) {
+				return fmt.Errorf("can't decode %s into %s", xv.Elem().Type(), v.Type())
+			}
+			v.Set(xv.Elem())
+			return nil
+		}
+		return decodeInterface(d, o, v)
+	case k == reflect.Struct:
+		return d.decodeWireStruct(wt, v)
+	case k == reflect.Array, k == reflect.Slice:
+		return d.decodeWireSlice(wt, v)
+	case k == reflect.Map:
+		return d.decodeWireMap(wt, v)
+	}
+	return fmt.Errorf("invalid kind %d", wt.Kind)
+}
+
+func (d *Decoder) decodeWireStruct(wt *wireType, v reflect.Value) error {
+	toMap := v.IsValid() && v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String
+	if v.IsValid() && v.Kind() != reflect.Struct && !toMap {
+		return fmt.Errorf("can't decode %s into %s", wt.Name, v.Type())
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	if toMap && v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	if wt.Flags&wireFieldIDs != 0 {
+		return d.decodeWireFieldIDs(wt, v)
+	}
+	for i := 0; i < len(wt.Fields); {
+		if wt.Fields[i].Bits > 0 {
+			n, err := d.decodeWireBits(wt.Fields[i:], v)
+			if err != nil {
+				return err
+			}
+			i += n
+			continue
+		}
+		if err := d.decodeWireField(wt.Fields[i], v); err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+// decodeWireFieldIDs reads the fields of a struct written
+// by encodeFieldIDs, like decodeFieldIDs does
+func (d *Decoder) decodeWireFieldIDs(wt *wireType, v reflect.Value) error {
+	for first := true; ; first = false {
+		id, err := d.uvarint()
+		if err != nil {
+			if err == io.EOF && !first {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if id == 0 {
+			return nil
+		}
+		n, err := d.fieldLength()
+		if err != nil {
+			return err
+		}
+		start := d.r.n
+		for _, f := range wt.Fields {
+			if uint64(f.ID) == id {
+				if err := d.decodeWireField(f, v); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		if err := d.skipRest(n, start); err != nil {
+			return pathError(err, nil, d.r.n, fmt.Sprintf(".#%d", id))
+		}
+	}
+}
+
+// decodeWireField reads the field f of the struct, or map, v
+func (d *Decoder) decodeWireField(f wireField, v reflect.Value) error {
+	toMap := v.IsValid() && v.Kind() == reflect.Map
+	fv := d.structField(v, f.Name)
+	if toMap {
+		fv = reflect.New(v.Type().Elem()).Elem()
+	}
+	if err := d.decodeWire(d.wireTypes[f.Type], fv); err != nil {
+		return pathError(err, valueType(fv), d.r.n, "."+f.Name)
+	}
+	if toMap {
+		v.SetMapIndex(reflect.ValueOf(f.Name).Convert(v.Type().Key()), fv)
+	}
+	return nil
+}
+
+// decodeWireBits reads the group of bit-fields at the start of
+// fields into v and returns the number of fields in the group
+func (d *Decoder) decodeWireBits(fields []wireField, v reflect.Value) (int, error) {
+	g := &bitGroup{lsb: fields[0].Lsb}
+	n, nBits := 0, 0
+	for n < len(fields) && fields[n].Bits > 0 && fields[n].Lsb == g.lsb {
+		nBits += int(fields[n].Bits)
+		n++
+	}
+	b, err := d.read((nBits + 7) / 8)
+	if err != nil {
+		return 0, err
+	}
+	pos := uint(0)
+	for _, f := range fields[:n] {
+		k := reflect.Kind(d.wireTypes[f.Type].Kind)
+		switch k {
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			return 0, fmt.Errorf("bit-field %s can't be a %s", f.Name, k)
+		}
+		x := reflect.New(kindTypes[k]).Elem()
+		bitField{bits: uint(f.Bits)}.set(x, g.get(b, pos, uint(f.Bits)))
+		pos += uint(f.Bits)
+		toMap := v.IsValid() && v.Kind() == reflect.Map
+		fv := d.structField(v, f.Name)
+		if toMap {
+			fv = reflect.New(v.Type().Elem()).Elem()
+		}
+		if !fv.IsValid() {
+			continue
+		}
+		var err error
+		if fv.Kind() == reflect.Interface && fv.NumMethod() == 0 {
+			fv.Set(x)
+		} else {
+			err = convertBasic(fv, x)
+		}
+		if err != nil {
+			return 0, pathError(err, fv.Type(), d.r.n, "."+f.Name)
+		}
+		if toMap {
+			v.SetMapIndex(reflect.ValueOf(f.Name).Convert(v.Type().Key()), fv)
+		}
+	}
+	return n, nil
+}
+
+// structField returns the field called name in the stream of the
+// struct v, or an invalid value if v has no such field or it wouldn't
+// be decoded. Fields are called by the name in their tag, if any
+func (d *Decoder) structField(v reflect.Value, name string) reflect.Value {
+	if !v.IsValid() || v.Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := sf.Tag.Get(d.Tag)
+		if d.OnlyTagged && (tag == "" || tag == "-") {
+			continue
+		}
+		ft, err := parseFieldTag(tag, d.Tag == DefaultTag)
+		if err != nil || ft.omit || ft.wireName(sf.Name) != name {
+			continue
+		}
+		return v.Field(i)
+	}
+	return reflect.Value{}
+}
+
+func (d *Decoder) decodeWireSlice(wt *wireType, v reflect.Value) error {
+	o, elem := wt.options(), d.wireTypes[wt.Elem]
+	if v.IsValid() && v.Kind() != reflect.Array && v.Kind() != reflect.Slice &&
+		!(v.Kind() == reflect.String && elem.Kind == uint8(reflect.Uint8)) {
+		return fmt.Errorf("can't decode %s into %s", wt.Name, v.Type())
+	}
+	n := int(wt.Len)
+	if wt.Kind == uint8(reflect.Slice) {
+		if o.presence == NilPresence {
+			if ok, err := d.presence(); err != nil {
+				return err
+			} else if !ok {
+				if v.IsValid() && v.Kind() == reflect.Slice {
+					v.Set(reflect.Zero(v.Type()))
+				}
+				return nil
+			}
+		}
+		if wt.Flags&wirePadded != 0 {
+			b, err := d.padded(o)
+			if err != nil || !v.IsValid() {
+				return err
+			}
+			return convertBytes(v, append([]byte{}, b...))
+		}
+		var err error
+		if n, err = d.lengthOrSize(o); err != nil {
+			return err
+		}
+	}
+	size := uintptr(1)
+	if v.IsValid() && v.Kind() != reflect.String {
+		size = v.Type().Elem().Size()
+	}
+	if err := d.allocElements(n, size); err != nil {
+		return err
+	}
+	if elem.Kind == uint8(reflect.Uint8) {
+		b, err := d.bytes(n)
+		if err != nil || !v.IsValid() {
+			return err
+		}
+		return convertBytes(v, b)
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	if v.IsValid() && v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+	for i := 0; i < n; i++ {
+		var ev reflect.Value
+		switch {
+		case !v.IsValid():
+		case v.Kind() == reflect.Slice:
+			ev = reflect.New(v.Type().Elem()).Elem()
+		case i < v.Len():
+			ev = v.Index(i)
+		}
+		if err := d.decodeWire(elem, ev); err != nil {
+			return pathError(err, valueType(ev), d.r.n, indexSegment(i))
+		}
+		if v.IsValid() && v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, ev))
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) decodeWireMap(wt *wireType, v reflect.Value) error {
+	o := wt.options()
+	if v.IsValid() && v.Kind() != reflect.Map {
+		return fmt.Errorf("can't decode %s into %s", wt.Name, v.Type())
+	}
+	if o.presence == NilPresence {
+		if ok, err := d.presence(); err != nil {
+			return err
+		} else if !ok {
+			if v.IsValid() {
+				v.Set(reflect.Zero(v.Type()))
+			}
+			return nil
+		}
+	}
+	n, err := d.length(o)
+	if err != nil {
+		return err
+	}
+	size := uintptr(1)
+	if v.IsValid() {
+		size = v.Type().Key().Size() + v.Type().Elem().Size()
+	}
+	if err := d.allocElements(n, size); err != nil {
+		return err
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	if v.IsValid() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	key, elem := d.wireTypes[wt.Key], d.wireTypes[wt.Elem]
+	for i := 0; i < n; i++ {
+		var kv, ev reflect.Value
+		if v.IsValid() {
+			kv, ev = reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		}
+		if err := d.decodeWire(key, kv); err != nil {
+			return pathError(err, valueType(kv), d.r.n, indexSegment(i))
+		}
+		if kv.IsValid() && kv.Kind() == reflect.Interface && !kv.IsNil() && !kv.Elem().Type().Comparable() {
+			return pathError(fmt.Errorf("%s can't be a map key", kv.Elem().Type()), kv.Type(), d.r.n, indexSegment(i))
+		}
+		if err := d.decodeWire(elem, ev); err != nil {
+			return pathError(err, valueType(ev), d.r.n, indexSegment(i))
+		}
+		if v.IsValid() {
+			v.SetMapIndex(kv, ev)
+		}
+	}
+	return nil
+}
+
+// valueType returns the type of v, or nil if v isn't valid
+func valueType(v reflect.Value) reflect.Type {
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Type()
+}
+
+// convertBasic sets v to the basic value x, if they're both
+// integers, floats, complexes, bools or strings and x fits in v.
+// Strings can also be set to byte slices.
+func convertBasic(v, x reflect.Value) error {
+	switch kx, kv := kindClass(x.Kind()), kindClass(v.Kind()); {
+	case kx == reflect.Int && kv == reflect.Int:
+		if n := x.Int(); !v.OverflowInt(n) {
+			v.SetInt(n)
+			return nil
+		}
+	case kx == reflect.Int && kv == reflect.Uint:
+		if n := x.Int(); n >= 0 && !v.OverflowUint(uint64(n)) {
+			v.SetUint(uint64(n))
+			return nil
+		}
+	case kx == reflect.Uint && kv == reflect.Uint:
+		if n := x.Uint(); !v.OverflowUint(n) {
+			v.SetUint(n)
+			return nil
+		}
+	case kx == reflect.Uint && kv == reflect.Int:
+		if n := x.Uint(); n <= uint64(maxInt64) && !v.OverflowInt(int64(n)) {
+			v.SetInt(int64(n))
+			return nil
+		}
+	case kx == reflect.Float64 && kv == reflect.Float64:
+		v.SetFloat(x.Float())
+		return nil
+	case kx == reflect.Complex128 && kv == reflect.Complex128:
+		v.SetComplex(x.Complex())
+		return nil
+	case kx == reflect.Bool && kv == reflect.Bool:
+		v.SetBool(x.Bool())
+		return nil
+	case kx == reflect.String && (kv == reflect.String || kv == reflect.Slice):
+		return convertBytes(v, []byte(x.String()))
+	default:
+		return fmt.Errorf("can't decode %s into %s", x.Type(), v.Type())
+	}
+	return fmt.Errorf("%v overflows %s", x, v.Type())
+}
+
+// kindClass groups the kinds that convertBasic converts between
+func kindClass(k reflect.Kind) reflect.Kind {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.Int
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.Uint
+	case reflect.Float32:
+		return reflect.Float64
+	case reflect.Complex64:
+		return reflect.Complex128
+	}
+	return k
+}
+
+// convertBytes sets v, a string, a byte array or a
+// slice of integers, to b. v may alias b
+func convertBytes(v reflect.Value, b []byte) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(b))
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(b)
+		return nil
+	case v.Kind() == reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), len(b), len(b)))
+	case v.Kind() != reflect.Array:
+		return fmt.Errorf("can't decode bytes into %s", v.Type())
+	}
+	for i := 0; i < len(b) && i < v.Len(); i++ {
+		if err := convertBasic(v.Index(i), reflect.ValueOf(b[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
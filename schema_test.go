@@ -0,0 +1,249 @@
+package structtools
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type order struct {
+	ID    uint32
+	Items []item
+	Note  *string
+	Tags  map[string]int16
+	When  time.Time
+	Shape shape
+	Flags struct {
+		Paid   bool  `bin:",bits=1"`
+		Status uint8 `bin:",bits=3"`
+	}
+	Code string `bin:",size=4,pad=space"`
+}
+
+type item struct {
+	Sku   string
+	Qty   int16 `bin:",varint"`
+	Price float64
+}
+
+func TestSelfDescribing(t *testing.T) {
+	note := "fragile"
+	v := order{
+		ID:    7,
+		Items: []item{{"a", 1, 0.5}, {"b", -2, 1}},
+		Note:  &note,
+		Tags:  map[string]int16{"x": 1},
+		When:  time.Date(2016, 12, 1, 10, 30, 0, 0, time.UTC),
+		Shape: circle{2},
+		Code:  "ab",
+	}
+	v.Flags.Paid, v.Flags.Status = true, 5
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	enc.SelfDescribing, enc.Presence = true, PointerPresence
+	for i := 0; i < 2; i++ {
+		if err := enc.Encode(v); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	plain := &bytes.Buffer{}
+	penc := NewEncoder(plain)
+	penc.Presence = PointerPresence
+	if err := penc.Encode(v); err != nil {
+		t.Error(err)
+		return
+	}
+	// the types are only described once, then referenced by a 1 byte id
+	// followed by the value as it's written without descriptions
+	if second := b.Bytes()[b.Len()-plain.Len()-1:]; second[0] != 2 || !bytes.Equal(second[1:], plain.Bytes()) {
+		t.Error("got different values", second, plain.Bytes())
+		return
+	}
+
+	dec := NewDecoder(b)
+	dec.SelfDescribing = true
+	var out order
+	if err := dec.Decode(&out); err != nil {
+		t.Error(err)
+		return
+	}
+	if !out.When.Equal(v.When) {
+		t.Error("got different values", out.When, v.When)
+		return
+	}
+	out.When = v.When
+	if !reflect.DeepEqual(out, v) {
+		t.Error("got different values", out, v)
+		return
+	}
+
+	// a different struct, with fields missing, added and widened
+	type otherItem struct {
+		Price float32
+		Qty   int64
+		Sku   []byte
+		Color string
+	}
+	type otherOrder struct {
+		Code  string
+		Items []otherItem
+		ID    *uint64
+		Flags struct{ Status int }
+	}
+	var other otherOrder
+	if err := dec.Decode(&other); err != nil {
+		t.Error(err)
+		return
+	}
+	if other.Code != "ab" || *other.ID != 7 || other.Flags.Status != 5 ||
+		!reflect.DeepEqual(other.Items, []otherItem{{0.5, 1, []byte("a"), ""}, {1, -2, []byte("b"), ""}}) {
+		t.Error("got different values", other)
+		return
+	}
+	if err := dec.Decode(&other); err != io.EOF {
+		t.Error("expecting io.EOF, got", err)
+		return
+	}
+}
+
+func TestSelfDescribingGeneric(t *testing.T) {
+	n := &node{1, &node{2, nil}}
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	enc.SelfDescribing, enc.Presence = true, PointerPresence
+	if err := enc.Encode(n); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := enc.Encode(map[uint8][]int8{1: {-1}}); err != nil {
+		t.Error(err)
+		return
+	}
+	dec := NewDecoder(b)
+	dec.SelfDescribing = true
+	var g interface{}
+	if err := dec.Decode(&g); err != nil {
+		t.Error(err)
+		return
+	}
+	exp := map[string]interface{}{
+		"Value": uint16(1),
+		"Next":  map[string]interface{}{"Value": uint16(2), "Next": nil},
+	}
+	if !reflect.DeepEqual(g, exp) {
+		t.Error("got different values", g, exp)
+		return
+	}
+	if err := dec.Decode(&g); err != nil {
+		t.Error(err)
+		return
+	}
+	if exp := map[interface{}]interface{}{uint8(1): []interface{}{int8(-1)}}; !reflect.DeepEqual(g, exp) {
+		t.Error("got different values", g, exp)
+		return
+	}
+}
+
+func TestSelfDescribingTagNames(t *testing.T) {
+	type old struct {
+		A     uint16 `bin:"amount"`
+		B     string
+		Flags struct {
+			X uint8 `bin:"x,bits=3"`
+		}
+	}
+	type renamed struct {
+		Total uint32 `bin:"amount"`
+		A     uint16
+		B     string `bin:"-"`
+		Flags struct {
+			Y uint8 `bin:"x,bits=4"`
+		}
+	}
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, SelfDescribing: true}
+	v := old{A: 300, B: "b"}
+	v.Flags.X = 5
+	b, err := enc.Append(nil, v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dec := NewBytesDecoder(b)
+	dec.SelfDescribing = true
+	var out renamed
+	if err := dec.Decode(&out); err != nil {
+		t.Error(err)
+		return
+	}
+	if out.Total != 300 || out.A != 0 || out.B != "" || out.Flags.Y != 5 {
+		t.Error("got different values", out)
+		return
+	}
+	dec = NewBytesDecoder(b)
+	dec.SelfDescribing = true
+	var g interface{}
+	if err := dec.Decode(&g); err != nil {
+		t.Error(err)
+		return
+	}
+	if m, ok := g.(map[string]interface{}); !ok || m["amount"] != uint16(300) {
+		t.Error("got different values", g)
+		return
+	}
+}
+
+func TestSelfDescribingErrors(t *testing.T) {
+	types := func(id int64, wts ...wireType) []byte {
+		b := &bytes.Buffer{}
+		e := NewEncoder(b)
+		for i, wt := range wts {
+			e.putVarint(-int64(i + 1))
+			codecFor(wireTypeType, schemaOptions).enc(e, reflect.ValueOf(wt))
+		}
+		e.putVarint(id)
+		e.flush()
+		return b.Bytes()
+	}
+	tests := [][]byte{
+		// undefined type
+		types(1),
+		types(2, wireType{Kind: uint8(reflect.Uint8)}),
+		// a struct that contains itself
+		types(1, wireType{Kind: uint8(reflect.Struct), Fields: []wireField{{Name: "A", Type: 1}}}),
+		// a pointer without presence to itself
+		types(1, wireType{Kind: uint8(reflect.Ptr), Elem: 1}),
+		// invalid kind
+		types(1, wireType{Kind: uint8(reflect.Chan)}),
+	}
+	// defined twice
+	def := types(1, wireType{Kind: uint8(reflect.Uint8)})
+	tests = append(tests, append(def[:len(def)-1:len(def)-1], def...))
+	for i, b := range tests {
+		dec := NewBytesDecoder(b)
+		dec.SelfDescribing = true
+		var g interface{}
+		if err := dec.Decode(&g); err == nil {
+			t.Errorf("test %d: expecting an error", i)
+			return
+		}
+	}
+
+	// types that don't fit
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	enc.SelfDescribing = true
+	if err := enc.Encode(item{Sku: "a"}); err != nil {
+		t.Error(err)
+		return
+	}
+	dec := NewDecoder(b)
+	dec.SelfDescribing = true
+	var wrong struct{ Sku int }
+	if err := dec.Decode(&wrong); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
@@ -0,0 +1,382 @@
+package structtools
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// sizeFunc returns the number of bytes the encodeFunc
+// of the same plan writes for v
+type sizeFunc func(v reflect.Value) (int, error)
+
+// Size returns the number of bytes Marshal writes for v
+func Size(v interface{}) (int, error) {
+	enc := encoderPool.Get().(*Encoder)
+	enc.Tag, enc.OnlyTagged, enc.ByteOrder = DefaultTag, false, DefaultByteOrder
+	n, err := enc.Size(v)
+	encoderPool.Put(enc)
+	return n, err
+}
+
+// Size returns the number of bytes Encode writes for v, with the
+// settings of the Encoder. Values of a fixed size aren't walked, so
+// Size only reports the errors found while computing the size, like
+// lengths that don't fit in their prefix or failing custom marshalers.
+// Custom marshalers are called to count the bytes they write. In a
+// self-describing stream, the types that weren't written yet count
+func (e *Encoder) Size(v interface{}) (int, error) {
+	val := reflect.ValueOf(v)
+	if !val.IsValid() {
+		return 0, nil
+	}
+	// like encode, a top level pointer is the value to marshal
+	if val.Kind() == reflect.Ptr && (!hasMarshaler(val.Type()) || hasMarshaler(val.Type().Elem())) {
+		if val.IsNil() {
+			return 0, nil
+		}
+		val = val.Elem()
+	}
+	opts := e.options()
+	n := 0
+	if e.SelfDescribing {
+		// write the descriptions and drop them
+		e.hold++
+		start := len(e.buf)
+		types, err := e.putType(val.Type(), opts)
+		n = len(e.buf) - start
+		e.buf = e.buf[:start]
+		e.hold--
+		e.forgetTypes(types)
+		if err != nil {
+			return 0, pathError(err, val.Type(), -1, typeName(val.Type()))
+		}
+	}
+	sz, err := codecFor(val.Type(), opts).size(val)
+	if err != nil {
+		return 0, pathError(err, val.Type(), -1, typeName(val.Type()))
+	}
+	return n + sz, nil
+}
+
+// FixedSize reports if every value of type t is marshaled to the same
+// number of bytes by Marshal, and returns it. Strings and slices only
+// have a fixed size with the "size" tag option, pointers, maps,
+// interfaces and types with custom marshalers never do
+func FixedSize(t reflect.Type) (int, bool) {
+	n := codecFor(t, codecOptions{tag: DefaultTag, byteOrder: DefaultByteOrder}).fixed
+	return n, n >= 0
+}
+
+// fixedSize returns the size of the values of type t,
+// or -1 if it depends on the value
+func (b *planBuilder) fixedSize(t reflect.Type, o codecOptions) int {
+	k := t.Kind()
+	if isForbiddenKind(k) != reflect.Invalid || hasMarshaler(t) && (k != reflect.Ptr || !hasMarshaler(t.Elem())) {
+		return -1
+	}
+	if isBasic(t) {
+		return basicSize(t, o)
+	}
+	switch k {
+	case reflect.Struct:
+		fields, tail, err := b.structFields(t, o)
+		if err != nil {
+			return -1
+		}
+		n := tail
+		for _, f := range fields {
+			fixed := f.codec.fixed
+			if fixed < 0 {
+				return -1
+			}
+			if hasFieldIDs(fields) {
+				n += uvarintSize(uint64(f.tag.id)) + uvarintSize(uint64(fixed))
+			}
+			n += f.pad + fixed
+		}
+		if hasFieldIDs(fields) {
+			// the 0 id
+			n++
+		}
+		return n
+	case reflect.Array:
+		if elem := b.codec(t.Elem(), o.elem()); elem.fixed >= 0 {
+			return t.Len() * elem.fixed
+		}
+	case reflect.Slice:
+		// nil slices write a presence byte only
+		if o.size == 0 || o.presence == NilPresence {
+			return -1
+		}
+		if isPaddedBytes(t) {
+			return o.size
+		}
+		if elem := b.codec(t.Elem(), o.elem()); elem.fixed >= 0 {
+			return o.size * elem.fixed
+		}
+	}
+	return -1
+}
+
+// basicSize is fixedSize for the types handled by basicEncoder
+func basicSize(t reflect.Type, o codecOptions) int {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1
+	case reflect.String:
+		if o.size > 0 {
+			return o.size
+		}
+		return -1
+	}
+	switch t.Kind() {
+	case reflect.Float32:
+		return 4
+	case reflect.Float64, reflect.Complex64:
+		return 8
+	case reflect.Complex128:
+		return 16
+	}
+	// integers
+	if o.varint {
+		return -1
+	}
+	switch t.Kind() {
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int32, reflect.Uint32:
+		return 4
+	case reflect.Int, reflect.Uint:
+		if o.layout == CLayout {
+			return 4
+		}
+	}
+	return 8
+}
+
+// sizer returns the sizeFunc of the plan for t, fixed is its fixedSize
+func (b *planBuilder) sizer(t reflect.Type, o codecOptions, fixed int) sizeFunc {
+	if fixed >= 0 {
+		return func(reflect.Value) (int, error) { return fixed, nil }
+	}
+	k := t.Kind()
+	if isForbiddenKind(k) != reflect.Invalid {
+		return func(reflect.Value) (int, error) { return 0, forbiddenKindError(k) }
+	}
+
+	if hasMarshaler(t) && (k != reflect.Ptr || !hasMarshaler(t.Elem())) {
+		if isMarshaler(t) {
+			ptrReceiver := !t.Implements(marshalerType)
+			return func(v reflect.Value) (int, error) {
+				var w countWriter
+				_, err := marshaler(v, ptrReceiver).(Marshaler).MarshalBinary(&w)
+				return int(w), err
+			}
+		}
+		ptrReceiver := !t.Implements(binaryMarshalerType)
+		return func(v reflect.Value) (int, error) {
+			b, err := marshaler(v, ptrReceiver).(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				return 0, err
+			}
+			n, err := lenSize(o, len(b))
+			return n + len(b), err
+		}
+	}
+
+	if isBasic(t) {
+		switch {
+		case k == reflect.String && o.cstr:
+			return func(v reflect.Value) (int, error) { return v.Len() + 1, nil }
+		case k == reflect.String:
+			return func(v reflect.Value) (int, error) {
+				n, err := lenSize(o, v.Len())
+				return n + v.Len(), err
+			}
+		case reflect.Int16 <= k && k <= reflect.Int64 || k == reflect.Int:
+			return func(v reflect.Value) (int, error) { return varintSize(v.Int()), nil }
+		}
+		return func(v reflect.Value) (int, error) { return uvarintSize(v.Uint()), nil }
+	}
+
+	switch k {
+	case reflect.Interface:
+		o := o.elem()
+		return func(v reflect.Value) (int, error) {
+			if v.IsNil() {
+				return 1, nil
+			}
+			v = v.Elem()
+			name, err := registeredName(v.Type())
+			if err != nil {
+				return 0, err
+			}
+			n, err := codecFor(v.Type(), o).size(v)
+			return uvarintSize(uint64(len(name))) + len(name) + n, err
+		}
+	case reflect.Ptr:
+		elem := b.codec(t.Elem(), o)
+		presence := 0
+		if o.presence != NoPresence {
+			presence = 1
+		}
+		return func(v reflect.Value) (int, error) {
+			if v.IsNil() {
+				return presence, nil
+			}
+			n, err := elem.size(v.Elem())
+			return presence + n, err
+		}
+	case reflect.Struct:
+		fields, tail, err := b.structFields(t, o)
+		if err != nil {
+			return func(reflect.Value) (int, error) { return 0, err }
+		}
+		if hasFieldIDs(fields) {
+			return sizeFieldIDs(fields, o)
+		}
+		return func(v reflect.Value) (int, error) {
+			n := tail
+			for _, f := range fields {
+				fn, err := f.codec.size(f.value(v))
+				if err != nil {
+					return 0, pathError(err, f.typ, -1, f.segment())
+				}
+				n += f.pad + fn
+			}
+			return n, nil
+		}
+	case reflect.Array:
+		elem := b.codec(t.Elem(), o.elem())
+		return func(v reflect.Value) (int, error) { return sizeElems(t, elem, v) }
+	case reflect.Slice:
+		if o.size > 0 && isPaddedBytes(t) {
+			return b.markNilSizer(o, func(reflect.Value) (int, error) { return o.size, nil })
+		}
+		elem := b.codec(t.Elem(), o.elem())
+		return b.markNilSizer(o, func(v reflect.Value) (int, error) {
+			n, err := lenOrSizeSize(o, v.Len())
+			if err != nil {
+				return 0, err
+			}
+			en, err := sizeElems(t, elem, v)
+			return n + en, err
+		})
+	case reflect.Map:
+		key, elem := b.codec(t.Key(), o.elem()), b.codec(t.Elem(), o.elem())
+		return b.markNilSizer(o, func(v reflect.Value) (int, error) {
+			n, err := lenSize(o, v.Len())
+			if err != nil {
+				return 0, err
+			}
+			if key.fixed >= 0 && elem.fixed >= 0 {
+				return n + v.Len()*(key.fixed+elem.fixed), nil
+			}
+			for _, k := range v.MapKeys() {
+				kn, err := key.size(k)
+				if err != nil {
+					return 0, pathError(err, t.Key(), -1, keySegment(k))
+				}
+				en, err := elem.size(v.MapIndex(k))
+				if err != nil {
+					return 0, pathError(err, t.Elem(), -1, keySegment(k))
+				}
+				n += kn + en
+			}
+			return n, nil
+		})
+	}
+	return func(reflect.Value) (int, error) { return 0, nil }
+}
+
+// sizeElems returns the size of the elements of the array or slice v
+func sizeElems(t reflect.Type, elem *codec, v reflect.Value) (int, error) {
+	if elem.fixed >= 0 {
+		return v.Len() * elem.fixed, nil
+	}
+	n := 0
+	for i := 0; i < v.Len(); i++ {
+		en, err := elem.size(v.Index(i))
+		if err != nil {
+			return 0, pathError(err, t.Elem(), -1, indexSegment(i))
+		}
+		n += en
+	}
+	return n, nil
+}
+
+// markNilSizer is the counterpart of markNilEncoder
+func (b *planBuilder) markNilSizer(o codecOptions, size sizeFunc) sizeFunc {
+	if o.presence != NilPresence {
+		return size
+	}
+	return func(v reflect.Value) (int, error) {
+		if v.IsNil() {
+			return 1, nil
+		}
+		n, err := size(v)
+		return n + 1, err
+	}
+}
+
+// lenSize returns the size of the length prefix for n,
+// with the errors of putLen
+func lenSize(o codecOptions, n int) (int, error) {
+	switch o.lenPrefix() {
+	case Len8:
+		if n > math.MaxUint8 {
+			return 0, fmt.Errorf("length %d doesn't fit in a uint8 prefix", n)
+		}
+		return 1, nil
+	case Len16:
+		if n > math.MaxUint16 {
+			return 0, fmt.Errorf("length %d doesn't fit in a uint16 prefix", n)
+		}
+		return 2, nil
+	case Len64:
+		return 8, nil
+	case LenVarint:
+		return uvarintSize(uint64(n)), nil
+	}
+	if uint64(n) > math.MaxUint32 {
+		return 0, fmt.Errorf("length %d doesn't fit in a uint32 prefix", n)
+	}
+	return 4, nil
+}
+
+// lenOrSizeSize is lenSize with the checks of putLenOrSize
+func lenOrSizeSize(o codecOptions, n int) (int, error) {
+	if o.size > 0 {
+		if n != o.size {
+			return 0, fmt.Errorf("length %d doesn't match size %d", n, o.size)
+		}
+		return 0, nil
+	}
+	return lenSize(o, n)
+}
+
+func uvarintSize(n uint64) int {
+	sz := 1
+	for ; n >= 0x80; n >>= 7 {
+		sz++
+	}
+	return sz
+}
+
+func varintSize(n int64) int {
+	un := uint64(n) << 1
+	if n < 0 {
+		un = ^un
+	}
+	return uvarintSize(un)
+}
+
+// countWriter counts the bytes written by custom marshalers
+type countWriter int
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	*w += countWriter(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,149 @@
+package structtools
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSize(t *testing.T) {
+	note := "fragile"
+	def := uint32(9)
+	values := []interface{}{
+		order{
+			ID:    7,
+			Items: []item{{"a", 1, 0.5}, {"b", -300, 1}},
+			Note:  &note,
+			Tags:  map[string]int16{"x": 1, "yy": -1},
+			When:  time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+			Shape: &square{3},
+			Code:  "ab",
+		},
+		order{},
+		recordV2{B: "hi", C: []int8{1, 2}, A: 5, D: &def},
+		[]shape{circle{1}, nil, &square{2}},
+		map[uint8][]point{1: {{1, 2}}, 2: nil},
+		struct {
+			A []uint16 `bin:",size=3"`
+			B []byte   `bin:",size=4"`
+			C string   `bin:",cstr"`
+			D *ptrInt
+		}{A: []uint16{1, 2, 3}, B: []byte{1}, C: "abc"},
+	}
+	for _, test := range mustPassTests {
+		values = append(values, test.v)
+	}
+	encoders := []*Encoder{
+		NewEncoder(nil),
+		{Tag: DefaultTag, ByteOrder: binary.LittleEndian, VarInt: true, Presence: NilPresence},
+		{Tag: DefaultTag, ByteOrder: DefaultByteOrder, Presence: PointerPresence, LenPrefix: Len16},
+	}
+	for i, enc := range encoders {
+		for _, v := range values {
+			b, err := enc.Append(nil, v)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if n, err := enc.Size(v); err != nil || n != len(b) {
+				t.Errorf("encoder %d, %#v: got %d, %v, expected %d", i, v, n, err, len(b))
+				return
+			}
+		}
+	}
+
+	// only the types that weren't described yet count
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, SelfDescribing: true}
+	for i := 0; i < 2; i++ {
+		n, err := enc.Size(values[0])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		before := len(enc.buf)
+		if err := enc.Encode(values[0]); err != nil {
+			t.Error(err)
+			return
+		}
+		if written := len(enc.buf) - before; n != written {
+			t.Error("got different sizes:", n, written)
+			return
+		}
+	}
+}
+
+func TestSizeErrors(t *testing.T) {
+	enc := &Encoder{Tag: DefaultTag, ByteOrder: DefaultByteOrder, LenPrefix: Len8}
+	if _, err := enc.Size(struct{ S []string }{[]string{string(make([]byte, 256))}}); err == nil {
+		t.Error("expecting an error")
+		return
+	} else if fe, ok := err.(*FieldError); !ok || !strings.HasSuffix(fe.Path, ".S[0]") || fe.Offset != -1 {
+		t.Error("got unexpected error:", err)
+		return
+	}
+	for _, test := range mustFailTests {
+		if _, err := Size(test.v); err == nil {
+			t.Error("expecting an error")
+			return
+		}
+	}
+	if _, err := Size([]shape{nil, &triangle{}}); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
+
+// triangle isn't registered
+type triangle struct{}
+
+func (triangle) area() float64 { return 0 }
+
+func TestFixedSize(t *testing.T) {
+	for _, test := range []struct {
+		v    interface{}
+		size int
+	}{
+		{int16(0), 2},
+		{complex128(0), 16},
+		{[3]uint32{}, 12},
+		{struct {
+			A uint8
+			B string  `bin:",size=5"`
+			C []int16 `bin:",size=2"`
+			D bool    `bin:",bits=1"`
+			E int8    `bin:",bits=7"`
+		}{C: []int16{1, 2}}, 1 + 5 + 4 + 1},
+		{recordV1{}, -1},
+		{struct {
+			A uint16 `bin:",id=1"`
+			B int32  `bin:",id=200"`
+		}{}, 1 + 1 + 2 + 2 + 1 + 4 + 1},
+		{struct {
+			A int64 `bin:",varint"`
+		}{}, -1},
+		{"", -1},
+		{[]byte{}, -1},
+		{(*int8)(nil), -1},
+		{map[int8]int8{}, -1},
+		{point{}, -1},
+		{myInt(0), -1},
+		{node{}, -1},
+		{make(chan int), -1},
+	} {
+		typ := reflect.TypeOf(test.v)
+		n, ok := FixedSize(typ)
+		if ok != (test.size >= 0) || ok && n != test.size {
+			t.Error(typ, "got unexpected size:", n, ok)
+			return
+		}
+		if !ok {
+			continue
+		}
+		if b, err := Marshal(test.v); err != nil || len(b) != n {
+			t.Error(typ, "got different sizes:", len(b), n, err)
+			return
+		}
+	}
+}
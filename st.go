@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"reflect"
+	"strings"
+	"sync"
+	"unsafe"
 )
 
 var (
@@ -21,20 +23,59 @@ var (
 	ErrCantSet = errors.New("can't set field")
 )
 
+// FieldError is returned by the Encoder, Decoder, FromMap and AddToMap
+// when a value can't be handled. Truncated input is reported by the
+// Decoder with Err set to io.ErrUnexpectedEOF.
+type FieldError struct {
+	// type of the value that failed
+	Type reflect.Type
+	// path to the value, starting with the name of the
+	// top level type, e.g. Order.Items[3].Sku
+	Path string
+	// offset in the stream where the error was found,
+	// or -1 if the error doesn't come from a stream
+	Offset int64
+	// underlying error
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("%s (%s): %s", e.Path, e.Type, e.Err)
+	}
+	return fmt.Sprintf("%s (%s) at offset %d: %s", e.Path, e.Type, e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// typeName is the first segment of the path in a FieldError
+func typeName(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	if n := t.Name(); n != "" {
+		return n
+	}
+	return t.String()
+}
+
+// mapError builds a FieldError for FromMap and AddToMap
+func mapError(err error, t reflect.Type, path string) error {
+	return &FieldError{Type: t, Path: path, Offset: -1, Err: err}
+}
+
 // FromMap sets the fields of the struct s that are tagged with t
 // and exist in the map m. The fields that are looked up and set,
 // depend on the onlyTagged value. If is set to true, FromMap only
 // looks for fields with a tag, otherwise it attempts to set every field.
 func FromMap(t string, m map[string]interface{}, s interface{}, onlyTagged bool) error {
 	// we need a pointer to a struct
-	if reflect.TypeOf(s).Kind() != reflect.Ptr {
-		return ErrNotAStructPtr
+	if st := reflect.TypeOf(s); st.Kind() != reflect.Ptr || st.Elem().Kind() != reflect.Struct {
+		return mapError(ErrNotAStructPtr, st, typeName(st))
 	}
 	vals := reflect.ValueOf(s).Elem()
 	typ := reflect.TypeOf(s).Elem()
-	if vals.Type().Kind() != reflect.Struct {
-		return ErrNotAStructPtr
-	}
 	// find values in the map with a corresponding name
 	for i := 0; i < vals.NumField(); i++ {
 		fldTyp := typ.Field(i)
@@ -63,12 +104,12 @@ func FromMap(t string, m map[string]interface{}, s interface{}, onlyTagged bool)
 		v := vals.Field(i)
 		// can we set the field ?
 		if !v.CanSet() {
-			return ErrCantSet
+			return mapError(ErrCantSet, fldTyp.Type, typeName(typ)+"."+fldTyp.Name)
 		}
 		// check if the types are the same
 		tmp := reflect.ValueOf(mval)
-		if v.Type() != tmp.Type() {
-			return ErrDataTypesDontMatch
+		if !tmp.IsValid() || v.Type() != tmp.Type() {
+			return mapError(ErrDataTypesDontMatch, fldTyp.Type, typeName(typ)+"."+fldTyp.Name)
 		}
 		v.Set(tmp)
 	}
@@ -87,7 +128,7 @@ func AddToMap(t string, s interface{}, m map[string]interface{}, onlyTagged bool
 		typ = typ.Elem()
 	}
 	if vals.Type().Kind() != reflect.Struct {
-		return ErrNotAStruct
+		return mapError(ErrNotAStruct, typ, typeName(typ))
 	}
 	for i := 0; i < vals.NumField(); i++ {
 		fldTyp := typ.Field(i)
@@ -120,7 +161,17 @@ func ToMap(t string, s interface{}, onlyTagged bool) (map[string]interface{}, er
 	return m, nil
 }
 
-// Marshaler should be implemented by any types with custom marshaling
+// Marshaler should be implemented by any types with custom marshaling.
+//
+// The Encoder and Decoder also recognise encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler, writing the blob they produce with a length
+// prefix. Both have to be implemented by T or *T. If a type implements
+// Marshaler or Unmarshaler, those take precedence, and if it implements
+// neither, its value is marshaled using reflection.
+//
+// Methods with a pointer receiver are used for values of type T too,
+// wherever they are: struct fields, array and slice elements, map keys
+// and values. When a value isn't addressable, a copy is marshaled.
 type Marshaler interface {
 	MarshalBinary(w io.Writer) (int, error)
 }
@@ -138,39 +189,175 @@ const DefaultTag = "bin"
 // ByteOrder field of the Encoder/Decoder.
 var DefaultByteOrder = binary.BigEndian
 
+// PresenceMode selects which values are preceded by a presence
+// byte (0 for nil, 1 otherwise) by the Encoder/Decoder.
+type PresenceMode uint8
+
+const (
+	// NoPresence writes nothing for nil pointers and always
+	// allocates pointers when decoding
+	NoPresence PresenceMode = iota
+	// PointerPresence marks pointers, so nil pointers round-trip
+	PointerPresence
+	// NilPresence marks pointers, slices and maps, so nil slices
+	// and maps can be told apart from empty ones
+	NilPresence
+)
+
+// LenWidth selects how the length prefix of strings,
+// slices and maps is written by the Encoder/Decoder.
+type LenWidth uint8
+
+const (
+	// LenDefault is a uint32, or a varint in VarInt mode
+	LenDefault LenWidth = iota
+	// Len8 is a uint8
+	Len8
+	// Len16 is a uint16
+	Len16
+	// Len32 is a uint32
+	Len32
+	// Len64 is a uint64
+	Len64
+	// LenVarint is a LEB128 varint
+	LenVarint
+)
+
+// LayoutMode selects how structs are laid out by the Encoder/Decoder.
+type LayoutMode uint8
+
+const (
+	// PackedLayout writes the fields of a struct one after the other
+	PackedLayout LayoutMode = iota
+	// CLayout mirrors the memory layout of C structs. Fields are aligned
+	// to the size of their type, the alignment of their elements for
+	// arrays and of their most aligned field for structs, with zeros
+	// before them. Structs end with zeros up to a multiple of their
+	// alignment. Go int and uint are a C int and unsigned int, 4 bytes.
+	// The "packed" and "align" tag options change the alignment of a
+	// field. Every field must have a fixed size, see FixedSize, and
+	// numbered fields and bit-fields can't be used. C compilers don't
+	// agree on the storage of bit-fields, it depends on the ABI
+	CLayout
+)
+
+// TimeFormat selects how time.Time values are written by the
+// Encoder/Decoder. Every format drops the monotonic clock reading.
+// time.Duration is an int64 of nanoseconds, like any other int64.
+// The "time" tag option sets the format of a field.
+type TimeFormat uint8
+
+const (
+	// TimeBinary is the output of the MarshalBinary method of
+	// time.Time with a length prefix, it keeps the offset of the zone
+	// in minutes
+	TimeBinary TimeFormat = iota
+	// TimeUnixNano is an int64 of nanoseconds since the Unix epoch,
+	// for the years 1678 to 2262. Values are decoded in UTC
+	TimeUnixNano
+	// TimeUnixZone is an int64 of seconds since the Unix epoch, a
+	// uint32 of nanoseconds and an int32 with the offset of the zone
+	// in seconds east of UTC. Values are decoded in a fixed zone with
+	// that offset, or in UTC, the name of the zone isn't kept
+	TimeUnixZone
+)
+
+// AliasMode selects which decoded values share memory with the input
+// of a Decoder that reads from a byte slice. Aliased values are only
+// valid as long as the input isn't modified or reused, retaining them
+// after that is unsafe. Aliased strings break the immutability of
+// strings, if the input changes so do they.
+type AliasMode uint8
+
+const (
+	// NoAlias copies every string and byte slice
+	NoAlias AliasMode = iota
+	// AliasBytes makes byte slices alias the input
+	AliasBytes
+	// AliasStrings makes byte slices and strings alias the input
+	AliasStrings
+)
+
 // Marshal value v
 func Marshal(v interface{}) ([]byte, error) {
-	b := bytes.NewBuffer(make([]byte, 0, 128))
-	if err := NewEncoder(b).Encode(v); err != nil {
+	b, err := AppendMarshal(make([]byte, 0, 128), v)
+	if err != nil {
 		return nil, err
 	}
-	return b.Bytes(), nil
+	return b, nil
+}
+
+// AppendMarshal appends the encoding of v to dst and returns the
+// extended buffer. If dst has enough room, the only allocations
+// are the ones made by custom marshalers
+func AppendMarshal(dst []byte, v interface{}) ([]byte, error) {
+	enc := encoderPool.Get().(*Encoder)
+	enc.Tag, enc.OnlyTagged, enc.ByteOrder = DefaultTag, false, DefaultByteOrder
+	b, err := enc.Append(dst, v)
+	encoderPool.Put(enc)
+	return b, err
 }
 
+// encoderPool holds Encoders for AppendMarshal, only
+// the fields set by AppendMarshal may differ from zero
+var encoderPool = sync.Pool{New: func() interface{} { return &Encoder{} }}
+
 // MarshalOnly is an utility function that creates an *Encoder and sets
 // the field OnlyTagged to true and the field Tag to tag. In these
 // conditions, struct fields are marshaled only if they are tagged with
 // something other than "" or "-"
 func MarshalOnly(v interface{}, tag string) ([]byte, error) {
-	b := bytes.NewBuffer(make([]byte, 0, 128))
-	enc := NewEncoder(b)
-	enc.OnlyTagged = true
-	enc.Tag = tag
-	if err := enc.Encode(v); err != nil {
+	b, err := NewEncoderWithTags(nil, tag, true).Append(make([]byte, 0, 128), v)
+	if err != nil {
 		return nil, err
 	}
-	return b.Bytes(), nil
+	return b, nil
 }
 
-// Encoder is used to marshal several values to an io.Writer
+// Encoder is used to marshal several values to an io.Writer. Values
+// are encoded to a buffer that is written to the io.Writer at the end
+// of each call to Encode, or as it fills up for large values. The
+// buffer is reused, so an Encoder doesn't allocate for values without
+// maps or custom marshalers
 type Encoder struct {
 	w io.Writer
+	// pending output, starting at buf[start]
+	buf   []byte
+	start int
+	// bytes written to w
+	n int64
 	// byte order
 	ByteOrder binary.ByteOrder
 	// tag to look for
 	Tag string
 	// only marshal tagged fields
 	OnlyTagged bool
+	// presence bytes for nil values
+	Presence PresenceMode
+	// write map entries in iteration order instead of sorting them
+	// by their encoded keys. Faster, but the output isn't deterministic
+	UnsortedMaps bool
+	// write integers wider than a byte and length prefixes as LEB128
+	// varints, signed integers are zigzag encoded. Can be set per field
+	// with the "varint" and "fixed" tag options, e.g. `bin:",varint"`
+	VarInt bool
+	// width of the length prefixes. Can be set per field with the "len"
+	// tag option, e.g. `bin:",len=u16"`. Lengths that don't fit are errors
+	LenPrefix LenWidth
+	// write a description of each type before its first value, so the
+	// stream can be decoded without the types that wrote it. See the
+	// SelfDescribing field of the Decoder
+	SelfDescribing bool
+	// layout of structs. The C layout can't be self-describing
+	Layout LayoutMode
+	// format of time.Time values. Can be set per field with the
+	// "time" tag option, e.g. `bin:",time=unixnano"`
+	TimeFormat TimeFormat
+
+	// ids of the types described to the stream
+	typeIDs map[planKey]uint32
+	// the buffer isn't flushed while hold > 0
+	hold int
 }
 
 // NewEncoder creates a new encoder that writes to w. The field DefaultTag
@@ -188,6 +375,41 @@ func NewEncoderWithTags(w io.Writer, tag string, onlyTagged bool) *Encoder {
 // Encode value V
 func (e *Encoder) Encode(v interface{}) error { return encode(e, v) }
 
+// BytesWritten returns the number of bytes written by the Encoder,
+// including the bytes written by custom marshalers
+func (e *Encoder) BytesWritten() int64 { return e.offset() }
+
+// Append appends the encoding of v to dst and returns the extended
+// buffer, with the settings of the Encoder. Nothing is written to its
+// io.Writer and the bytes aren't counted by BytesWritten. On error,
+// dst is returned unchanged
+func (e *Encoder) Append(dst []byte, v interface{}) ([]byte, error) {
+	w, buf, start, n, ids := e.w, e.buf, e.start, e.n, e.typeIDs
+	// self-describing output is self-contained
+	e.w, e.buf, e.start, e.n, e.typeIDs = nil, dst, len(dst), 0, nil
+	err := e.Encode(v)
+	b := e.buf
+	e.w, e.buf, e.start, e.n, e.typeIDs = w, buf, start, n, ids
+	if err != nil {
+		return dst, err
+	}
+	return b, nil
+}
+
+// Reset makes the Encoder write to w as a new stream and resets
+// BytesWritten. The settings and the buffer are kept, so Encoders
+// can be pooled
+func (e *Encoder) Reset(w io.Writer) {
+	e.w, e.buf, e.start, e.n, e.typeIDs = w, e.buf[:0], 0, 0, nil
+}
+
+// WriteTo marshals v to w and returns the number of bytes written
+func WriteTo(w io.Writer, v interface{}) (int64, error) {
+	enc := NewEncoder(w)
+	err := enc.Encode(v)
+	return enc.BytesWritten(), err
+}
+
 // will not marshal/unmarshal those
 var forbiddenKinds = []reflect.Kind{
 	reflect.Invalid,
@@ -195,7 +417,6 @@ var forbiddenKinds = []reflect.Kind{
 	reflect.UnsafePointer,
 	reflect.Chan,
 	reflect.Func,
-	reflect.Interface,
 }
 
 func isForbiddenKind(k reflect.Kind) reflect.Kind { return inSlice(k, forbiddenKinds) }
@@ -210,183 +431,333 @@ func inSlice(k reflect.Kind, s []reflect.Kind) reflect.Kind {
 }
 
 func writeAll(w io.Writer, b []byte) error {
-	sz, err := io.Copy(w, bytes.NewReader(b))
+	sz, err := w.Write(b)
 	if err != nil {
 		return err
 	}
-	if sz != int64(len(b)) {
+	if sz != len(b) {
 		return fmt.Errorf("only %d bytes of %d written", sz, len(b))
 	}
 	return nil
 }
 
-func encode(enc *Encoder, v interface{}) error {
-	// don't handle forbidden kinds
-	val := reflect.ValueOf(v)
-	if k := isForbiddenKind(val.Kind()); k != reflect.Invalid {
-		return fmt.Errorf("can't handle %s", k.String())
+func (e *Encoder) options() codecOptions {
+	return codecOptions{tag: e.Tag, onlyTagged: e.OnlyTagged, byteOrder: e.ByteOrder, presence: e.Presence, varint: e.VarInt, lenWidth: e.LenPrefix, layout: e.Layout, timeFormat: e.TimeFormat}
+}
+
+// flushSize is the size at which the buffer of
+// the Encoder is written out in the middle of a value
+const flushSize = 1 << 12
+
+// offset is the number of bytes encoded so far
+func (e *Encoder) offset() int64 { return e.n + int64(len(e.buf)-e.start) }
+
+// flush writes the buffer to w, unless the Encoder is appending
+func (e *Encoder) flush() error {
+	if e.w == nil || len(e.buf) == 0 {
+		return nil
+	}
+	n, err := e.w.Write(e.buf)
+	e.n += int64(n)
+	if err == nil && n != len(e.buf) {
+		err = fmt.Errorf("only %d bytes of %d written", n, len(e.buf))
+	}
+	e.buf = e.buf[:0]
+	return err
+}
+
+// grow extends the buffer by n bytes and returns them
+func (e *Encoder) grow(n int) []byte {
+	l := len(e.buf)
+	if l+n > cap(e.buf) {
+		b := make([]byte, l, 2*cap(e.buf)+n)
+		copy(b, e.buf)
+		e.buf = b
+	}
+	e.buf = e.buf[:l+n]
+	return e.buf[l:]
+}
+
+// written is called after the buffer is extended
+func (e *Encoder) written() error {
+	if len(e.buf) >= flushSize && e.hold == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+func (e *Encoder) write(b []byte) error {
+	e.buf = append(e.buf, b...)
+	return e.written()
+}
+
+func (e *Encoder) writeByte(c byte) error {
+	e.buf = append(e.buf, c)
+	return e.written()
+}
+
+func (e *Encoder) writeString(s string) error {
+	e.buf = append(e.buf, s...)
+	return e.written()
+}
+
+func (e *Encoder) putUint16(bo binary.ByteOrder, n uint16) error {
+	bo.PutUint16(e.grow(2), n)
+	return e.written()
+}
+
+func (e *Encoder) putUint32(bo binary.ByteOrder, n uint32) error {
+	bo.PutUint32(e.grow(4), n)
+	return e.written()
+}
+
+func (e *Encoder) putUint64(bo binary.ByteOrder, n uint64) error {
+	bo.PutUint64(e.grow(8), n)
+	return e.written()
+}
+
+func (e *Encoder) putUvarint(n uint64) error {
+	for n >= 0x80 {
+		e.buf = append(e.buf, byte(n)|0x80)
+		n >>= 7
+	}
+	e.buf = append(e.buf, byte(n))
+	return e.written()
+}
+
+func (e *Encoder) putVarint(n int64) error {
+	un := uint64(n) << 1
+	if n < 0 {
+		un = ^un
+	}
+	return e.putUvarint(un)
+}
+
+// bufWriter is the io.Writer passed to custom marshalers,
+// it appends to the buffer of the Encoder
+type bufWriter Encoder
+
+func (w *bufWriter) Write(b []byte) (int, error) {
+	if err := (*Encoder)(w).write(b); err != nil {
+		return 0, err
 	}
+	return len(b), nil
+}
 
-	// got a marshaler
-	if marshaler, ok := v.(Marshaler); ok {
-		_, err := marshaler.MarshalBinary(enc.w)
+// putLen writes the length prefix of a string, slice or map
+func (e *Encoder) putLen(o codecOptions, n int) error {
+	// lengths that don't fit
+	if _, err := lenSize(o, n); err != nil {
 		return err
 	}
+	switch o.lenPrefix() {
+	case Len8:
+		return e.writeByte(byte(n))
+	case Len16:
+		return e.putUint16(o.byteOrder, uint16(n))
+	case Len64:
+		return e.putUint64(o.byteOrder, uint64(n))
+	case LenVarint:
+		return e.putUvarint(uint64(n))
+	}
+	return e.putUint32(o.byteOrder, uint32(n))
+}
 
-	// got a pointer
-	if k := val.Kind(); k == reflect.Invalid {
-		return nil
-	} else if k == reflect.Ptr {
-		// anything to marshal
-		if val.IsNil() {
-			return nil
+// putLenOrSize writes the length prefix, or checks the
+// length if the size is fixed by the "size" tag option
+func (e *Encoder) putLenOrSize(o codecOptions, n int) error {
+	if o.size > 0 {
+		if n != o.size {
+			return fmt.Errorf("length %d doesn't match size %d", n, o.size)
 		}
-		val = val.Elem()
+		return nil
 	}
+	return e.putLen(o, n)
+}
 
-	var b []byte
-	switch v := val.Interface().(type) {
-	// ints
-	case int8:
-		b = []byte{byte(v)}
-	case uint8:
-		b = []byte{byte(v)}
-	case uint16:
-		b = make([]byte, 2)
-		enc.ByteOrder.PutUint16(b, v)
-	case uint32:
-		b = make([]byte, 4)
-		enc.ByteOrder.PutUint32(b, v)
-	case uint64:
-		b = make([]byte, 8)
-		enc.ByteOrder.PutUint64(b, v)
-	case uint:
-		b = make([]byte, 8)
-		enc.ByteOrder.PutUint64(b, uint64(v))
-	case int16:
-		b = make([]byte, 2)
-		enc.ByteOrder.PutUint16(b, uint16(v))
-	case int32:
-		b = make([]byte, 4)
-		enc.ByteOrder.PutUint32(b, uint32(v))
-	case int64:
-		b = make([]byte, 8)
-		enc.ByteOrder.PutUint64(b, uint64(v))
-	case int:
-		b = make([]byte, 8)
-		enc.ByteOrder.PutUint64(b, uint64(v))
-	// floats
-	case float32:
-		b = make([]byte, 4)
-		enc.ByteOrder.PutUint32(b, math.Float32bits(v))
-	case float64:
-		b = make([]byte, 8)
-		enc.ByteOrder.PutUint64(b, math.Float64bits(v))
-	// complexes
-	case complex64:
-		b = make([]byte, 8)
-		enc.ByteOrder.PutUint32(b, math.Float32bits(real(v)))
-		enc.ByteOrder.PutUint32(b[4:], math.Float32bits(imag(v)))
-	case complex128:
-		b = make([]byte, 16)
-		enc.ByteOrder.PutUint64(b, math.Float64bits(real(v)))
-		enc.ByteOrder.PutUint64(b[8:], math.Float64bits(imag(v)))
-	// bools
-	case bool:
-		var bb byte
-		if v {
-			bb = 1
+// putPadded writes b padded to the size set by the "size" tag option
+func (e *Encoder) putPadded(o codecOptions, b []byte) error {
+	max := o.size
+	if o.cstr {
+		// room for the NUL
+		max--
+		if bytes.IndexByte(b, 0) >= 0 {
+			return fmt.Errorf("C string contains a NUL byte")
 		}
-		b = []byte{bb}
-	// strings
-	case string:
-		b = []byte(v)
-		if err := encode(enc, uint32(len(b))); err != nil {
-			return err
-		}
-	default:
-		switch k := val.Kind(); k {
-		// structs
-		case reflect.Struct:
-			for i := 0; i < val.NumField(); i++ {
-				fldTyp := val.Type().Field(i)
-				if tag := fldTyp.Tag.Get(enc.Tag); enc.OnlyTagged && (tag == "" || tag == "-") {
-					continue
-				}
-				if err := encode(enc, val.Field(i).Interface()); err != nil {
-					return err
-				}
-			}
-			return nil
-		// arrays and slices
-		case reflect.Array, reflect.Slice:
-			if k == reflect.Slice {
-				if err := encode(enc, uint32(val.Len())); err != nil {
-					return err
-				}
-			}
-			for i := 0; i < val.Len(); i++ {
-				if err := encode(enc, val.Index(i).Interface()); err != nil {
-					return err
-				}
-			}
-			return nil
-		// maps
-		case reflect.Map:
-			ve := val.Type().Elem().Kind()
-			vk := val.Type().Key().Kind()
-			if vk == reflect.Interface || ve == reflect.Interface {
-				return fmt.Errorf("will not encode a map with interface{} as keys/values")
-			}
-			if err := encode(enc, uint32(val.Len())); err != nil {
-				return err
-			}
-			for _, k := range val.MapKeys() {
-				if err := encode(enc, k.Interface()); err != nil {
-					return err
-				}
-				if err := encode(enc, val.MapIndex(k).Interface()); err != nil {
-					return err
-				}
-			}
+	}
+	if len(b) > max {
+		return fmt.Errorf("%d bytes don't fit in size %d", len(b), o.size)
+	}
+	p := e.grow(o.size)
+	n := copy(p, b)
+	if o.cstr {
+		// NUL terminator, the buffer isn't zeroed
+		p[n] = 0
+		n++
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = o.pad
+	}
+	return e.written()
+}
+
+// putCString writes s followed by a NUL
+func (e *Encoder) putCString(s string) error {
+	if strings.IndexByte(s, 0) >= 0 {
+		return fmt.Errorf("C string contains a NUL byte")
+	}
+	e.buf = append(append(e.buf, s...), 0)
+	return e.written()
+}
+
+func (e *Encoder) putPresence(present bool) error {
+	if present {
+		return e.writeByte(1)
+	}
+	return e.writeByte(0)
+}
+
+func encode(enc *Encoder, v interface{}) error {
+	val := reflect.ValueOf(v)
+	// nothing to marshal
+	if !val.IsValid() {
+		return nil
+	}
+	// a top level pointer is the value to marshal, not an optional
+	// value, so it gets no presence byte (unless it's a marshaler)
+	if val.Kind() == reflect.Ptr && (!hasMarshaler(val.Type()) || hasMarshaler(val.Type().Elem())) {
+		if val.IsNil() {
 			return nil
 		}
+		val = val.Elem()
+	}
+	opts := enc.options()
+	c := codecFor(val.Type(), opts)
+	var (
+		types []planKey
+		err   error
+	)
+	if enc.SelfDescribing {
+		types, err = enc.putType(val.Type(), opts)
+	}
+	if err == nil {
+		err = c.enc(enc, val)
+	}
+	if err != nil {
+		// drop the rest of the value
+		enc.buf = enc.buf[:enc.start]
+		enc.forgetTypes(types)
+		return pathError(err, val.Type(), enc.offset(), typeName(val.Type()))
 	}
-	return writeAll(enc.w, b)
+	return enc.flush()
 }
 
 // Decoder can be used to unmarshal several values from an io.Reader
 type Decoder struct {
-	r io.Reader
+	r *countingReader
 	// byte order
 	ByteOrder binary.ByteOrder
 	// tag to look for
 	Tag string
 	// only unmarshal tagged fields
 	OnlyTagged bool
+	// presence bytes for nil values
+	Presence PresenceMode
+	// read integers wider than a byte and length prefixes as varints
+	VarInt bool
+	// width of the length prefixes
+	LenPrefix LenWidth
+	// layout of structs
+	Layout LayoutMode
+	// format of time.Time values
+	TimeFormat TimeFormat
+	// resources used by each call to Decode
+	Limits Limits
+	// share memory with the input, only used when reading from a
+	// byte slice. See AliasMode before setting it
+	Alias AliasMode
+	// read a stream written by an Encoder with SelfDescribing set.
+	// Values don't need the types that wrote them: struct fields are
+	// matched by name, the one in their tag if set, numbers can be
+	// decoded to any type they fit in, and anything can be decoded to
+	// an interface{} as basic values, []byte, []interface{} and maps
+	SelfDescribing bool
+
+	// state of the current call to Decode
+	depth     int
+	allocated int64
+	// reused by small reads
+	buf []byte
+	// types described by the stream
+	wireTypes    map[uint32]*wireType
+	checkedTypes map[uint32]bool
 }
 
 // NewDecoder creates a new decoder that reads from r
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{r: r, Tag: DefaultTag, ByteOrder: DefaultByteOrder}
+	return &Decoder{r: &countingReader{r: r}, Tag: DefaultTag, ByteOrder: DefaultByteOrder}
+}
+
+// NewBytesDecoder creates a new decoder that reads from data. Reading
+// from a byte slice is faster than reading from an io.Reader, and
+// the decoded values can alias data if the field Alias is set
+func NewBytesDecoder(data []byte) *Decoder {
+	return &Decoder{r: &countingReader{data: data}, Tag: DefaultTag, ByteOrder: DefaultByteOrder}
 }
 
 // NewDecoderWithTags creates a new decoder with the given options,
 // ByteOrder still defaults to DefaultByteOrder
 func NewDecoderWithTags(r io.Reader, tag string, onlyTagged bool) *Decoder {
-	return &Decoder{r: r, Tag: tag, OnlyTagged: onlyTagged, ByteOrder: DefaultByteOrder}
+	return &Decoder{r: &countingReader{r: r}, Tag: tag, OnlyTagged: onlyTagged, ByteOrder: DefaultByteOrder}
 }
 
-// Decode value v
+// Decode value v. Decode returns io.EOF if the stream ends before v,
+// so a stream of values can be read until io.EOF. If the stream ends
+// in the middle of v, the error wraps io.ErrUnexpectedEOF.
 func (d *Decoder) Decode(v interface{}) error { return decode(d, v) }
 
+// InputOffset returns the number of bytes read by the Decoder, including
+// the bytes read by custom unmarshalers. The Decoder doesn't buffer, it
+// never reads past the end of the last value decoded.
+func (d *Decoder) InputOffset() int64 { return d.r.n }
+
+// Reset makes the Decoder read from r and resets InputOffset. The
+// settings and the buffer are kept, so Decoders can be pooled
+func (d *Decoder) Reset(r io.Reader) {
+	if d.r == nil {
+		d.r = &countingReader{}
+	}
+	d.r.r, d.r.data, d.r.n = r, nil, 0
+	d.wireTypes, d.checkedTypes = nil, nil
+}
+
+// ReadFrom unmarshals v from r and returns the number of bytes read.
+// Only the bytes that make up v are read from r.
+func ReadFrom(r io.Reader, v interface{}) (int64, error) {
+	dec := NewDecoder(r)
+	err := dec.Decode(v)
+	return dec.InputOffset(), err
+}
+
 // Unmarshal data into v and return number of used bytes or an error
 func Unmarshal(data []byte, v interface{}) (int, error) {
-	b := bytes.NewReader(data)
-	if err := NewDecoder(b).Decode(v); err != nil {
+	dec := NewBytesDecoder(data)
+	if err := dec.Decode(v); err != nil {
 		return 0, err
 	}
-	return len(data) - b.Len(), nil
+	return int(dec.InputOffset()), nil
+}
+
+// UnmarshalAlias is like Unmarshal, but byte slices, and strings
+// too with AliasStrings, alias data instead of being copied. It's
+// unsafe to use them after data is modified or reused
+func UnmarshalAlias(data []byte, v interface{}, mode AliasMode) (int, error) {
+	dec := NewBytesDecoder(data)
+	dec.Alias = mode
+	if err := dec.Decode(v); err != nil {
+		return 0, err
+	}
+	return int(dec.InputOffset()), nil
 }
 
 // UnmarshalOnly is an utility function that creates a *Decoder and
@@ -394,242 +765,320 @@ func Unmarshal(data []byte, v interface{}) (int, error) {
 // conditions, struct fields are unmarshaled only if they are tagged
 // with something other than "" or "-"
 func UnmarshalOnly(data []byte, v interface{}, tag string) (int, error) {
-	b := bytes.NewReader(data)
-	dec := NewDecoder(b)
-	dec.OnlyTagged = true
-	dec.Tag = tag
+	dec := NewBytesDecoder(data)
+	dec.Tag, dec.OnlyTagged = tag, true
 	if err := dec.Decode(v); err != nil {
 		return 0, err
 	}
-	return len(data) - b.Len(), nil
+	return int(dec.InputOffset()), nil
 }
 
-func readN(r io.Reader, n uint32) ([]byte, error) {
-	b := make([]byte, n)
-	sz := uint32(0)
-	for sz < n {
-		nBytes, err := r.Read(b[sz:])
-		if err != nil {
-			if err != io.EOF {
-				return b[:sz], err
-			}
+// readN reads exactly n bytes from r. It returns io.EOF if no bytes
+// were read and io.ErrUnexpectedEOF if only some of them were.
+func readN(r io.Reader, n int) ([]byte, error) {
+	if n <= readChunk {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
 		}
-		if nBytes == 0 {
-			break
+		return b, nil
+	}
+	// don't trust n, grow the buffer as the data arrives
+	b := make([]byte, 0, readChunk)
+	for len(b) < n {
+		chunk := n - len(b)
+		if chunk > readChunk {
+			chunk = readChunk
+		}
+		b = append(b, make([]byte, chunk)...)
+		if _, err := io.ReadFull(r, b[len(b)-chunk:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
 		}
-		sz += uint32(nBytes)
 	}
 	return b, nil
 }
 
-func decode(dec *Decoder, v interface{}) error {
-	// don't handle forbidden kinds
-	val := reflect.ValueOf(v)
-	if k := isForbiddenKind(val.Kind()); k != reflect.Invalid {
-		return fmt.Errorf("can't handle %s", k.String())
+// readChunk is the largest buffer readN allocates before reading
+const readChunk = 1 << 16
+
+// countingReader counts the bytes read from r, or from
+// data if the Decoder reads from a byte slice
+type countingReader struct {
+	r    io.Reader
+	data []byte
+	n    int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	if c.r == nil {
+		if c.n >= int64(len(c.data)) && len(b) > 0 {
+			return 0, io.EOF
+		}
+		n := copy(b, c.data[c.n:])
+		c.n += int64(n)
+		return n, nil
 	}
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
 
-	// got a unmarshaler
-	if unmarshaler, ok := v.(Unmarshaler); ok {
-		_, err := unmarshaler.UnmarshalBinary(dec.r)
-		if err != nil {
-			return err
+// next returns the next n bytes of data, like readN
+func (c *countingReader) next(n int) ([]byte, error) {
+	rest := c.data[c.n:]
+	if len(rest) < n {
+		c.n = int64(len(c.data))
+		if len(rest) == 0 {
+			return nil, io.EOF
 		}
-		return nil
+		return nil, io.ErrUnexpectedEOF
 	}
+	c.n += int64(n)
+	// appending to the result mustn't overwrite data
+	return rest[:n:n], nil
+}
 
-	// check if it's a pointer not nil
-	if k := val.Kind(); k != reflect.Ptr {
-		return fmt.Errorf("can only unmarshal to a pointer")
-	} else if val.IsNil() {
-		return nil
+func (d *Decoder) options() codecOptions {
+	return codecOptions{tag: d.Tag, onlyTagged: d.OnlyTagged, byteOrder: d.ByteOrder, presence: d.Presence, varint: d.VarInt, lenWidth: d.LenPrefix, layout: d.Layout, timeFormat: d.TimeFormat}
+}
+
+// read reads n bytes. Unless n is large, they're read to the buffer
+// of the Decoder, or are part of its input, so they must be copied
+func (d *Decoder) read(n int) ([]byte, error) {
+	if d.r.r == nil {
+		return d.r.next(n)
+	}
+	if n > readChunk {
+		return readN(d.r, n)
+	}
+	if cap(d.buf) < n {
+		d.buf = make([]byte, n)
+	}
+	b := d.buf[:n]
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (d *Decoder) uint32(bo binary.ByteOrder) (uint32, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
 	}
-	val = val.Elem()
+	return bo.Uint32(b), nil
+}
 
-	switch val.Interface().(type) {
-	// ints
-	case uint8:
-		b, err := readN(dec.r, 1)
-		if err != nil {
-			return err
-		}
-		val.SetUint(uint64(b[0]))
-	case uint16:
-		b, err := readN(dec.r, 2)
-		if err != nil {
-			return err
-		}
-		val.SetUint(uint64(dec.ByteOrder.Uint16(b)))
-	case uint32:
-		b, err := readN(dec.r, 4)
-		if err != nil {
-			return err
-		}
-		val.SetUint(uint64(dec.ByteOrder.Uint32(b)))
-	case uint64:
-		b, err := readN(dec.r, 8)
-		if err != nil {
-			return err
-		}
-		val.SetUint(dec.ByteOrder.Uint64(b))
-	case uint:
-		b, err := readN(dec.r, 8)
-		if err != nil {
-			return err
-		}
-		val.SetUint(dec.ByteOrder.Uint64(b))
-	case int8:
-		b, err := readN(dec.r, 1)
-		if err != nil {
-			return err
-		}
-		val.SetInt(int64(b[0]))
-	case int16:
-		b, err := readN(dec.r, 2)
-		if err != nil {
-			return err
-		}
-		val.SetInt(int64(dec.ByteOrder.Uint16(b)))
-	case int32:
-		b, err := readN(dec.r, 4)
-		if err != nil {
-			return err
-		}
-		val.SetInt(int64(dec.ByteOrder.Uint32(b)))
-	case int64:
-		b, err := readN(dec.r, 8)
-		if err != nil {
-			return err
-		}
-		val.SetInt(int64(dec.ByteOrder.Uint64(b)))
-	case int:
-		b, err := readN(dec.r, 8)
+func (d *Decoder) uint64(bo binary.ByteOrder) (uint64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return bo.Uint64(b), nil
+}
+
+// bytes reads n bytes that the caller can keep
+func (d *Decoder) bytes(n int) ([]byte, error) {
+	if d.r.r != nil && n > readChunk {
+		// not read to the buffer
+		return readN(d.r, n)
+	}
+	b, err := d.read(n)
+	if err != nil || d.aliasing(AliasBytes) {
+		return b, err
+	}
+	return append(make([]byte, 0, n), b...), nil
+}
+
+// string converts b, that was read from the input, to a string
+func (d *Decoder) string(b []byte) string {
+	if d.aliasing(AliasStrings) {
+		return *(*string)(unsafe.Pointer(&b))
+	}
+	return string(b)
+}
+
+// aliasing reports if values can alias the input as mode allows
+func (d *Decoder) aliasing(mode AliasMode) bool {
+	return d.r.r == nil && d.Alias >= mode
+}
+
+// errVarintOverflow is returned for varints that don't fit in 64 bits
+var errVarintOverflow = errors.New("varint overflows a 64-bit integer")
+
+func (d *Decoder) uvarint() (uint64, error) {
+	var (
+		n uint64
+		s uint
+	)
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b, err := d.read(1)
 		if err != nil {
-			return err
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
 		}
-		val.SetInt(int64(dec.ByteOrder.Uint64(b)))
-	// floats
-	case float32:
-		b, err := readN(dec.r, 4)
-		if err != nil {
-			return err
+		if b[0] < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b[0] > 1 {
+				return 0, errVarintOverflow
+			}
+			return n | uint64(b[0])<<s, nil
 		}
-		val.SetFloat(float64(math.Float32frombits(dec.ByteOrder.Uint32(b))))
-	case float64:
-		b, err := readN(dec.r, 8)
-		if err != nil {
-			return err
+		n |= uint64(b[0]&0x7f) << s
+		s += 7
+	}
+	return 0, errVarintOverflow
+}
+
+func (d *Decoder) varint() (int64, error) {
+	un, err := d.uvarint()
+	n := int64(un >> 1)
+	if un&1 != 0 {
+		n = ^n
+	}
+	return n, err
+}
+
+// maxInt is the largest value of an int
+const maxInt = int(^uint(0) >> 1)
+
+// length reads the length prefix of a string, slice or map
+func (d *Decoder) length(o codecOptions) (int, error) {
+	var (
+		n   uint64
+		b   []byte
+		err error
+	)
+	switch o.lenPrefix() {
+	case Len8:
+		if b, err = d.read(1); err == nil {
+			n = uint64(b[0])
 		}
-		val.SetFloat(math.Float64frombits(dec.ByteOrder.Uint64(b)))
-	// complexes
-	case complex64:
-		b, err := readN(dec.r, 8)
-		if err != nil {
-			return err
+	case Len16:
+		if b, err = d.read(2); err == nil {
+			n = uint64(o.byteOrder.Uint16(b))
 		}
-		val.SetComplex(complex128(complex(
-			math.Float32frombits(dec.ByteOrder.Uint32(b)),
-			math.Float32frombits(dec.ByteOrder.Uint32(b[4:])),
-		)))
-	case complex128:
-		b, err := readN(dec.r, 16)
-		if err != nil {
-			return err
+	case Len64:
+		n, err = d.uint64(o.byteOrder)
+	case LenVarint:
+		n, err = d.uvarint()
+	default:
+		var n32 uint32
+		n32, err = d.uint32(o.byteOrder)
+		n = uint64(n32)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(maxInt) {
+		return 0, fmt.Errorf("length %d overflows an int", n)
+	}
+	return int(n), nil
+}
+
+// lengthOrSize reads the length prefix, unless the
+// size is fixed by the "size" tag option
+func (d *Decoder) lengthOrSize(o codecOptions) (int, error) {
+	if o.size > 0 {
+		return o.size, nil
+	}
+	return d.length(o)
+}
+
+// padded reads a value written by putPadded and trims the padding
+func (d *Decoder) padded(o codecOptions) ([]byte, error) {
+	if err := d.allocBytes(o.size); err != nil {
+		return nil, err
+	}
+	b, err := d.read(o.size)
+	if err != nil {
+		return nil, err
+	}
+	if o.cstr {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			return b[:i:i], nil
 		}
-		val.SetComplex(complex(
-			math.Float64frombits(dec.ByteOrder.Uint64(b)),
-			math.Float64frombits(dec.ByteOrder.Uint64(b[8:])),
-		))
-	// bools
-	case bool:
-		b, err := readN(dec.r, 1)
+		return nil, fmt.Errorf("C string isn't NUL terminated")
+	}
+	b = bytes.TrimRight(b, string(o.pad))
+	return b[:len(b):len(b)], nil
+}
+
+// cstring reads a NUL terminated string, without the NUL
+func (d *Decoder) cstring() ([]byte, error) {
+	var s []byte
+	for {
+		b, err := d.read(1)
 		if err != nil {
-			return err
-		}
-		var v bool
-		if b[0] != 0 {
-			v = true
+			if err == io.EOF && len(s) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
 		}
-		val.SetBool(v)
-	// strings
-	case string:
-		var sz uint32
-		if err := decode(dec, &sz); err != nil {
-			return err
+		if b[0] == 0 {
+			return s, d.allocBytes(len(s))
 		}
-		b, err := readN(dec.r, sz)
-		if err != nil {
-			return err
+		if max := d.Limits.MaxBytes; max > 0 && int64(len(s)) >= max {
+			return nil, &LimitError{Limit: "MaxBytes", Value: int64(len(s)) + 1, Max: max}
 		}
-		val.SetString(string(b))
-	default:
-		switch k := val.Kind(); k {
-		// structs
-		case reflect.Struct:
-			for i := 0; i < val.NumField(); i++ {
-				fldTyp := val.Type().Field(i)
-				if tag := fldTyp.Tag.Get(dec.Tag); dec.OnlyTagged && (tag == "" || tag == "-") {
-					continue
-				}
-				fldVal := val.Field(i)
-				if fldVal.Kind() != reflect.Ptr {
-					fldVal = fldVal.Addr()
-				} else if fldVal.IsNil() {
-					newV := reflect.New(fldTyp.Type.Elem())
-					fldVal.Set(newV)
-				}
-				if err := decode(dec, fldVal.Interface()); err != nil {
-					return err
-				}
-			}
-		// arrays and slices
-		case reflect.Array, reflect.Slice:
-			var (
-				addElem func(int, reflect.Value)
-				sz      uint32
-			)
-			if k == reflect.Slice {
-				newS := reflect.New(reflect.SliceOf(val.Type().Elem()))
-				val.Set(newS.Elem())
-				if err := decode(dec, &sz); err != nil {
-					return err
-				}
-				addElem = func(i int, v reflect.Value) { val.Set(reflect.Append(val, v)) }
-			} else {
-				sz = uint32(val.Len())
-				addElem = func(i int, v reflect.Value) { val.Index(i).Set(v) }
-			}
+		s = append(s, b[0])
+	}
+}
 
-			for i := uint32(0); i < sz; i++ {
-				v := reflect.New(val.Type().Elem())
-				if err := decode(dec, v.Interface()); err != nil {
-					return err
-				}
-				addElem(int(i), v.Elem())
-			}
-		// maps
-		case reflect.Map:
-			if vk, ve := val.Type().Key().Kind(), val.Type().Elem().Kind(); ve == reflect.Interface || vk == reflect.Interface {
-				return fmt.Errorf("will not encode a map with interface{} as key/value")
-			}
-			var sz uint32
-			if err := decode(dec, &sz); err != nil {
-				return err
-			}
-			val.Set(reflect.MakeMap(val.Type()))
-			for i := uint32(0); i < sz; i++ {
-				k := reflect.New(val.Type().Key())
-				v := reflect.New(val.Type().Elem())
-				if err := decode(dec, k.Interface()); err != nil {
-					return err
-				}
-				if err := decode(dec, v.Interface()); err != nil {
-					return err
-				}
-				val.SetMapIndex(k.Elem(), v.Elem())
-			}
-		}
+// presence reads a presence byte
+func (d *Decoder) presence() (bool, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return false, err
+	}
+	switch b[0] {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid presence byte %d", b[0])
+}
 
+func decode(dec *Decoder, v interface{}) error {
+	// don't handle forbidden kinds
+	val, typ := reflect.ValueOf(v), reflect.TypeOf(v)
+	if k := isForbiddenKind(val.Kind()); k != reflect.Invalid {
+		return pathError(forbiddenKindError(k), typ, dec.r.n, typeName(typ))
 	}
-	return nil
+
+	start := dec.r.n
+	dec.depth, dec.allocated = 0, 0
+	var err error
+	if unmarshaler, ok := v.(Unmarshaler); ok && val.Kind() != reflect.Ptr {
+		// got a unmarshaler
+		_, err = unmarshaler.UnmarshalBinary(dec.r)
+	} else if val.Kind() != reflect.Ptr {
+		err = fmt.Errorf("can only unmarshal to a pointer")
+	} else if val.IsNil() {
+		return nil
+	} else {
+		val, typ = val.Elem(), typ.Elem()
+		if dec.SelfDescribing {
+			err = dec.decodeSelfDescribing(val)
+		} else {
+			err = codecFor(typ, dec.options()).dec(dec, val)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	fe := pathError(err, typ, dec.r.n, typeName(typ)).(*FieldError)
+	if fe.Err == io.EOF {
+		// the stream ended cleanly, before v
+		if dec.r.n == start {
+			return io.EOF
+		}
+		fe.Err = io.ErrUnexpectedEOF
+	}
+	return fe
 }
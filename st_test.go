@@ -1,9 +1,11 @@
 package structtools
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"io"
+	"reflect"
 	"strings"
 	"testing"
 	"unsafe"
@@ -459,3 +461,271 @@ func TestDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeTruncated(t *testing.T) {
+	b, _ := hex.DecodeString(hexS)
+	for i := 1; i < len(b); i++ {
+		var v MyStruct
+		_, err := Unmarshal(b[:i], &v)
+		if fe, ok := err.(*FieldError); !ok || fe.Err != io.ErrUnexpectedEOF {
+			t.Errorf("expecting io.ErrUnexpectedEOF with %d bytes, got: %v", i, err)
+			return
+		}
+	}
+	var v MyStruct
+	if _, err := Unmarshal(nil, &v); err != io.EOF {
+		t.Error("expecting io.EOF, got:", err)
+		return
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	b, _ := hex.DecodeString("0001" + "0002" + "0003")
+	dec := NewDecoder(bytes.NewReader(b))
+	var got []uint16
+	for {
+		var v uint16
+		if err := dec.Decode(&v); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Error(err)
+			return
+		}
+		got = append(got, v)
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Error("got different values", got)
+		return
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	type item struct {
+		Sku string
+		Ch  chan int
+		Qty uint16
+	}
+	type order struct {
+		ID    uint32
+		Items []item
+	}
+	_, err := Marshal(order{1, []item{{Sku: "a"}, {Sku: "b"}}})
+	fe, ok := err.(*FieldError)
+	if !ok {
+		t.Error("expecting a *FieldError, got:", err)
+		return
+	}
+	if fe.Path != "order.Items[0].Ch" || fe.Type != reflect.TypeOf(make(chan int)) || fe.Offset != 13 {
+		t.Error("got different values:", fe.Path, fe.Type, fe.Offset)
+		return
+	}
+
+	type line struct {
+		Sku string
+		Qty uint16
+	}
+	type invoice struct {
+		ID    uint32
+		Lines []line
+	}
+	b, _ := hex.DecodeString("00000001" + "00000002" + "0000000161" + "0001" + "0000000162")
+	_, err = Unmarshal(b, &invoice{})
+	if fe, ok = err.(*FieldError); !ok {
+		t.Error("expecting a *FieldError, got:", err)
+		return
+	}
+	if fe.Path != "invoice.Lines[1].Qty" || fe.Offset != 20 || fe.Err != io.ErrUnexpectedEOF {
+		t.Error("got different values:", fe.Path, fe.Offset, fe.Err)
+		return
+	}
+
+	err = FromMap(testTag, map[string]interface{}{"b": 1}, &MyStruct{}, false)
+	if fe, ok = err.(*FieldError); !ok || fe.Err != ErrDataTypesDontMatch || fe.Path != "MyStruct.B" {
+		t.Error("expecting a *FieldError, got:", err)
+		return
+	}
+	if err = AddToMap(testTag, 1, map[string]interface{}{}, false); err == nil || err.(*FieldError).Err != ErrNotAStruct {
+		t.Error("expecting a *FieldError, got:", err)
+		return
+	}
+}
+
+func TestByteCounts(t *testing.T) {
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	for i, v := range []interface{}{uint16(1), myInt(2), "abc"} {
+		if err := enc.Encode(v); err != nil {
+			t.Error(err)
+			return
+		}
+		if exp := []int64{2, 10, 17}[i]; enc.BytesWritten() != exp {
+			t.Error("got different values", enc.BytesWritten(), exp)
+			return
+		}
+	}
+	// a record followed by something else
+	b.WriteString("trailer")
+	var (
+		u uint16
+		m myInt
+		s string
+	)
+	dec := NewDecoder(b)
+	for i, v := range []interface{}{&u, &m, &s} {
+		if err := dec.Decode(v); err != nil {
+			t.Error(err)
+			return
+		}
+		if exp := []int64{2, 10, 17}[i]; dec.InputOffset() != exp {
+			t.Error("got different values", dec.InputOffset(), exp)
+			return
+		}
+	}
+	if b.String() != "trailer" {
+		t.Error("expecting the decoder to stop at the end of the value")
+		return
+	}
+
+	n, err := WriteTo(b, s)
+	if err != nil || n != 7 {
+		t.Error("got different values", n, err)
+		return
+	}
+	s = ""
+	n, err = ReadFrom(strings.NewReader(b.String()[7:]), &s)
+	if err != nil || n != 7 || s != "abc" {
+		t.Error("got different values", n, err, s)
+		return
+	}
+}
+
+func TestAppendMarshal(t *testing.T) {
+	type rec struct {
+		A uint16
+		B int64
+		C string
+		D [2]float32
+		E bool
+	}
+	v := rec{1, -2, "abc", [2]float32{0.5, 1}, true}
+	exp, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	b, err := AppendMarshal([]byte("head"), v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(b[:4]) != "head" || !bytes.Equal(b[4:], exp) {
+		t.Error("got different values", b)
+		return
+	}
+	// an error leaves dst as it was
+	if b, err := AppendMarshal([]byte("head"), []interface{}{struct{}{}}); err == nil || string(b) != "head" {
+		t.Error("expecting an error", b, err)
+		return
+	}
+
+	buf := make([]byte, 0, 64)
+	if n := testing.AllocsPerRun(100, func() {
+		if _, err := AppendMarshal(buf[:0], &v); err != nil {
+			t.Error(err)
+		}
+	}); n != 0 {
+		t.Error("expecting no allocations, got", n)
+	}
+
+	// pooled encoders and decoders
+	w := bytes.NewBuffer(make([]byte, 0, 64))
+	enc := NewEncoder(nil)
+	r := bytes.NewReader(nil)
+	dec := NewDecoder(nil)
+	var out rec
+	if n := testing.AllocsPerRun(100, func() {
+		w.Reset()
+		enc.Reset(w)
+		if err := enc.Encode(&v); err != nil {
+			t.Error(err)
+		}
+		if enc.BytesWritten() != int64(len(exp)) {
+			t.Error("got different values", enc.BytesWritten(), len(exp))
+		}
+		r.Reset(w.Bytes())
+		dec.Reset(r)
+		if err := dec.Decode(&out); err != nil {
+			t.Error(err)
+		}
+		if dec.InputOffset() != int64(len(exp)) {
+			t.Error("got different values", dec.InputOffset(), len(exp))
+		}
+		// only the decoded string is allocated
+	}); n != 1 {
+		t.Error("expecting 1 allocation, got", n)
+	}
+	if out.C != v.C || out.D != v.D || out.B != v.B {
+		t.Error("got different values", out, v)
+		return
+	}
+}
+
+func TestUnmarshalAlias(t *testing.T) {
+	type rec struct {
+		B []byte
+		S string
+		P []byte `bin:",size=4"`
+	}
+	v := rec{[]byte{1, 2}, "abc", []byte{3}}
+	data, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var out rec
+	if n, err := UnmarshalAlias(data, &out, AliasStrings); err != nil || n != len(data) {
+		t.Error("got different values", n, err)
+		return
+	}
+	if !reflect.DeepEqual(out, v) {
+		t.Error("got different values", out, v)
+		return
+	}
+	if &out.B[0] != &data[4] || &out.P[0] != &data[13] {
+		t.Error("expecting byte slices to alias the input")
+		return
+	}
+	// appending doesn't overwrite the input
+	out.B = append(out.B, 0xff)
+	out.P = append(out.P, 0xff)
+	if data[6] != 0 || data[14] != 0 {
+		t.Error("expecting the input not to change", data)
+		return
+	}
+	// strings change with the input
+	data[10] = 'x'
+	if out.S != "xbc" {
+		t.Error("expecting the string to alias the input", out.S)
+		return
+	}
+
+	var copied rec
+	if _, err := UnmarshalAlias(data, &copied, AliasBytes); err != nil {
+		t.Error(err)
+		return
+	}
+	data[4], data[10] = 7, 'y'
+	if copied.B[0] != 7 || copied.S != "xbc" {
+		t.Error("expecting only byte slices to alias the input", copied)
+		return
+	}
+	if _, err := Unmarshal(data, &copied); err != nil {
+		t.Error(err)
+		return
+	}
+	data[4] = 8
+	if copied.B[0] != 7 {
+		t.Error("expecting Unmarshal to copy", copied)
+		return
+	}
+}
@@ -0,0 +1,250 @@
+package structtools
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// fieldTag is the parsed tag of a struct field. The tag is a name
+// followed by comma separated options, e.g. `bin:"name,le,size=16"`.
+// The name is the one of the field in self-describing streams, where
+// fields are matched by name, and defaults to the name of the field:
+//
+//	le, be    byte order of the field
+//	varint    write integers and length prefixes as varints
+//	fixed     write integers with a fixed width, even in VarInt mode
+//	len=W     width of the length prefixes: u8, u16, u32, u64 or varint
+//	size=N    strings and byte slices are padded to N bytes, other
+//	          slices must have N elements. There's no length prefix
+//	pad=P     padding of strings and byte slices with a size, "nul"
+//	          (the default) or "space". It's trimmed when decoding
+//	cstr      strings are NUL terminated instead of length prefixed.
+//	          With a size, the NUL must fit in it, like a C char[N]
+//	bits=N    pack the field in N bits, together with the bit-fields
+//	          next to it. Only for bools and integers, and not in the
+//	          C layout
+//	lsb, msb  pack bit-fields starting from the least or the most
+//	          (the default) significant bit of each byte
+//	omit      never marshal the field
+//	order=N   fields are written sorted by order (default 0), fields
+//	          with the same order keep their declaration order
+//	id=N      number of the field, N > 0. Structs with numbered fields
+//	          are written field by field as the id, the length of the
+//	          value and the value, both varints, ending with a 0 id.
+//	          Fields the Decoder doesn't know are skipped and fields
+//	          missing from the input are left as they are, so fields
+//	          can be added, removed and reordered. Every field of the
+//	          struct needs an id, and bits can't be used
+//	packed    in the C layout, the field isn't aligned
+//	align=N   in the C layout, the field is aligned to N bytes, a
+//	          power of 2, instead of the alignment of its type
+//	time=F    format of time.Time values: binary, unixnano or
+//	          unixzone, see TimeFormat
+type fieldTag struct {
+	name      string
+	byteOrder binary.ByteOrder
+	varint    bool
+	fixed     bool
+	lenWidth  LenWidth
+	size      int
+	pad       byte
+	cstr      bool
+	bits      int
+	lsb       bool
+	omit      bool
+	order     int
+	id        int
+	packed    bool
+	align     int
+	time      string
+}
+
+// lenWidths maps the values of the "len" tag option to a LenWidth
+var lenWidths = map[string]LenWidth{
+	"u8":     Len8,
+	"u16":    Len16,
+	"u32":    Len32,
+	"u64":    Len64,
+	"varint": LenVarint,
+}
+
+// timeFormats maps the values of the "time" tag option to a TimeFormat
+var timeFormats = map[string]TimeFormat{
+	"binary":   TimeBinary,
+	"unixnano": TimeUnixNano,
+	"unixzone": TimeUnixZone,
+}
+
+// parseFieldTag parses tag. Unknown options are errors if strict,
+// otherwise they're ignored: tags other than the one of the package
+// are shared with other packages, like encoding/json
+func parseFieldTag(tag string, strict bool) (fieldTag, error) {
+	parts := strings.Split(tag, ",")
+	ft := fieldTag{name: parts[0]}
+	for _, opt := range parts[1:] {
+		key, val := opt, ""
+		if i := strings.Index(opt, "="); i >= 0 {
+			key, val = opt[:i], opt[i+1:]
+		}
+		var err error
+		switch key {
+		case "":
+			continue
+		case "le":
+			ft.byteOrder = binary.LittleEndian
+		case "be":
+			ft.byteOrder = binary.BigEndian
+		case "varint":
+			ft.varint = true
+		case "fixed":
+			ft.fixed = true
+		case "len":
+			var ok bool
+			if ft.lenWidth, ok = lenWidths[val]; !ok {
+				return ft, fmt.Errorf("invalid length prefix %q", val)
+			}
+		case "size":
+			if ft.size, err = strconv.Atoi(val); err != nil || ft.size <= 0 {
+				return ft, fmt.Errorf("invalid size %q", val)
+			}
+		case "pad":
+			switch val {
+			case "nul":
+				ft.pad = 0
+			case "space":
+				ft.pad = ' '
+			default:
+				return ft, fmt.Errorf("invalid padding %q", val)
+			}
+		case "cstr":
+			ft.cstr = true
+		case "bits":
+			if ft.bits, err = strconv.Atoi(val); err != nil || ft.bits <= 0 || ft.bits > 64 {
+				return ft, fmt.Errorf("invalid bits %q", val)
+			}
+		case "lsb":
+			ft.lsb = true
+		case "msb":
+			ft.lsb = false
+		case "omit":
+			ft.omit = true
+		case "order":
+			if ft.order, err = strconv.Atoi(val); err != nil {
+				return ft, fmt.Errorf("invalid order %q", val)
+			}
+		case "id":
+			if ft.id, err = strconv.Atoi(val); err != nil || ft.id <= 0 || uint64(ft.id) > math.MaxUint32 {
+				return ft, fmt.Errorf("invalid id %q", val)
+			}
+		case "packed":
+			ft.packed = true
+		case "align":
+			if ft.align, err = strconv.Atoi(val); err != nil || ft.align <= 0 || ft.align&(ft.align-1) != 0 {
+				return ft, fmt.Errorf("invalid alignment %q", val)
+			}
+		case "time":
+			if _, ok := timeFormats[val]; !ok {
+				return ft, fmt.Errorf("invalid time format %q", val)
+			}
+			ft.time = val
+		default:
+			if strict {
+				return ft, fmt.Errorf("unknown option %q", opt)
+			}
+		}
+	}
+	if ft.bits > 0 && (ft.size > 0 || ft.cstr || ft.varint || ft.lenWidth != LenDefault) {
+		return ft, fmt.Errorf("bits can't be used with size, cstr, varint or len")
+	}
+	if ft.bits > 0 && (ft.packed || ft.align > 0) {
+		return ft, fmt.Errorf("bits can't be used with packed or align")
+	}
+	if ft.bits > 0 && ft.id > 0 {
+		return ft, fmt.Errorf("bits and id can't be used together")
+	}
+	if ft.varint && ft.fixed {
+		return ft, fmt.Errorf("varint and fixed can't be used together")
+	}
+	return ft, nil
+}
+
+// wireName returns the name of the field called name
+// in self-describing streams
+func (ft fieldTag) wireName(name string) string {
+	if ft.name != "" {
+		return ft.name
+	}
+	return name
+}
+
+// apply returns o with the options in the tag
+func (ft fieldTag) apply(o codecOptions) codecOptions {
+	if ft.byteOrder != nil {
+		o.byteOrder = ft.byteOrder
+	}
+	if ft.varint {
+		o.varint = true
+	} else if ft.fixed {
+		o.varint = false
+	}
+	if ft.lenWidth != LenDefault {
+		o.lenWidth = ft.lenWidth
+	}
+	if ft.time != "" {
+		o.timeFormat = timeFormats[ft.time]
+	}
+	o.size, o.pad, o.cstr = ft.size, ft.pad, ft.cstr
+	return o
+}
+
+// check reports if the options can be used for a field of type t
+func (ft fieldTag) check(t reflect.Type) error {
+	if ft.bits > 0 {
+		switch t.Kind() {
+		case reflect.Bool:
+			if ft.bits != 1 {
+				return fmt.Errorf("bools only take 1 bit")
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if ft.bits > t.Bits() {
+				return fmt.Errorf("%d bits don't fit in %s", ft.bits, t)
+			}
+		default:
+			return fmt.Errorf("bits only applies to bools and integers")
+		}
+	}
+	if ft.time != "" && !reachesTime(t) {
+		return fmt.Errorf("time only applies to times")
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if ft.size > 0 && t.Kind() != reflect.String && t.Kind() != reflect.Slice {
+		return fmt.Errorf("size only applies to strings and slices")
+	}
+	if ft.cstr && t.Kind() != reflect.String {
+		return fmt.Errorf("cstr only applies to strings")
+	}
+	if ft.pad != 0 && (ft.size == 0 || t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8) {
+		return fmt.Errorf("pad only applies to strings and byte slices with a size")
+	}
+	return nil
+}
+
+// reachesTime reports if t is a time.Time, or pointers, arrays, slices
+// or maps of them. The "time" tag option applies to their elements too
+func reachesTime(t reflect.Type) bool {
+	for {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Array, reflect.Slice, reflect.Map:
+			t = t.Elem()
+		default:
+			return t == timeType
+		}
+	}
+}
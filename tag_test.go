@@ -0,0 +1,158 @@
+package structtools
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseFieldTag(t *testing.T) {
+	ft, err := parseFieldTag("name,le,size=16,len=u8,varint,order=-2", true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	exp := fieldTag{
+		name:      "name",
+		byteOrder: binary.LittleEndian,
+		varint:    true,
+		lenWidth:  Len8,
+		size:      16,
+		order:     -2,
+	}
+	if ft != exp {
+		t.Error("got different values", ft, exp)
+		return
+	}
+	for _, tag := range []string{"a,size=0", "a,size=x", "a,len=u7", "a,bogus", "a,varint,fixed", "a,order=", "a,id=0", "a,id=-1"} {
+		if _, err := parseFieldTag(tag, true); err == nil {
+			t.Error("expecting an error for", tag)
+			return
+		}
+	}
+}
+
+func TestTagOptions(t *testing.T) {
+	type header struct {
+		Length  uint16   `bin:"length,le"`
+		Magic   [2]byte  `bin:"magic,order=-1"`
+		Words   []uint16 `bin:"words,size=2"`
+		Scratch string   `bin:"scratch,omit"`
+		Flags   uint8
+	}
+	v := header{Length: 0x0102, Magic: [2]byte{'S', 'T'}, Words: []uint16{3, 4}, Scratch: "x", Flags: 5}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "5354"+"0201"+"00030004"+"05" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out header
+	if _, err := Unmarshal(b, &out); err != nil {
+		t.Error(err)
+		return
+	}
+	v.Scratch = ""
+	if !reflect.DeepEqual(out, v) {
+		t.Error("got different values", out, v)
+		return
+	}
+
+	// words must have exactly 2 elements
+	v.Words = v.Words[:1]
+	if _, err := Marshal(v); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+
+	type invalid struct {
+		A uint32 `bin:",size=4"`
+	}
+	if _, err := Marshal(invalid{}); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
+
+func TestFixedStrings(t *testing.T) {
+	type header struct {
+		Name  string `bin:",size=6"`
+		Label string `bin:",size=4,pad=space"`
+		Path  string `bin:",cstr"`
+		Short string `bin:",size=4,cstr"`
+		Raw   []byte `bin:",size=3"`
+	}
+	v := header{"abc", "xy", "/tmp", "ok", []byte{1}}
+	b, err := Marshal(v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if xs := hex.EncodeToString(b); xs != "616263000000"+"78792020"+"2f746d7000"+"6f6b0000"+"010000" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out header
+	if _, err := Unmarshal(b, &out); err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(out, v) {
+		t.Error("got different values", out, v)
+		return
+	}
+
+	for _, bad := range []header{
+		{Name: "too long"},
+		{Short: "abcd"},
+		{Path: "a\x00b"},
+		{Raw: []byte{1, 2, 3, 4}},
+	} {
+		if _, err := Marshal(bad); err == nil {
+			t.Error("expecting an error for", bad)
+			return
+		}
+	}
+
+	// no terminator
+	if _, err := Unmarshal([]byte("x\x00\x00\x00\x00\x00    /"), &out); err == nil {
+		t.Error("expecting an error")
+		return
+	}
+}
+
+func TestForeignTag(t *testing.T) {
+	type probe struct {
+		A uint16 `json:"a,omitempty" bin:"a,le"`
+		B uint8  `json:"b,string"`
+		C uint8
+	}
+	v := probe{A: 0x0102, B: 3, C: 4}
+	b, err := MarshalOnly(v, "json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the options of the bin tag don't apply
+	if xs := hex.EncodeToString(b); xs != "0102"+"03" {
+		t.Error("got different values:", xs)
+		return
+	}
+	var out probe
+	if _, err := UnmarshalOnly(b, &out, "json"); err != nil {
+		t.Error(err)
+		return
+	}
+	if out.A != v.A || out.B != v.B || out.C != 0 {
+		t.Error("got different values", out)
+		return
+	}
+	if _, err := parseFieldTag("a,omitempty", false); err != nil {
+		t.Error(err)
+		return
+	}
+}